@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// accountConn is a control connection that answers the server's request for an
+// account, reply 332 to USER or PASS, with "ACCT <account>". The FTP client has
+// no ACCT command and fails the login on a 332, so the reply is kept from it and
+// it reads the server's reply to ACCT in its place, 230 once logged in. It only
+// sees the plain text of the connection, so it cannot be used when the client
+// upgrades the connection to TLS itself with AUTH TLS.
+type accountConn struct {
+	net.Conn
+	account string
+
+	writeMu sync.Mutex
+	// sent is set once ACCT was sent. A second 332 is passed to the client,
+	// which fails the login with it.
+	sent bool
+	// pending holds the start of a reply line not yet complete, ready the lines
+	// to return to the client and readErr the read error to return after them.
+	pending []byte
+	ready   []byte
+	readErr error
+}
+
+func newAccountConn(conn net.Conn, account string) *accountConn {
+	return &accountConn{Conn: conn, account: account}
+}
+
+func (c *accountConn) Read(b []byte) (int, error) {
+	buf := make([]byte, 4096)
+	for len(c.ready) == 0 && c.readErr == nil {
+		n, err := c.Conn.Read(buf)
+		c.pending = append(c.pending, buf[:n]...)
+		for {
+			end := bytes.IndexByte(c.pending, '\n')
+			if end < 0 {
+				break
+			}
+			line := c.pending[:end+1]
+			c.pending = c.pending[end+1:]
+			if c.sent || !bytes.HasPrefix(line, []byte("332")) {
+				c.ready = append(c.ready, line...)
+				continue
+			}
+			// The lines of a multi-line 332 are dropped with it; ACCT is sent
+			// once the last one arrived.
+			if len(line) > 3 && line[3] == ' ' {
+				writeErr := c.sendAccount()
+				if writeErr != nil {
+					return 0, writeErr
+				}
+			}
+		}
+		if err != nil {
+			c.ready = append(c.ready, c.pending...)
+			c.pending = nil
+			c.readErr = err
+		}
+	}
+	if len(c.ready) == 0 {
+		return 0, c.readErr
+	}
+	n := copy(b, c.ready)
+	c.ready = c.ready[n:]
+	return n, nil
+}
+
+func (c *accountConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.Conn.Write(b)
+}
+
+// sendAccount sends ACCT with the account to the server.
+func (c *accountConn) sendAccount() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.sent = true
+	debugf("FTP server requested an account, sending ACCT")
+	_, err := fmt.Fprintf(c.Conn, "ACCT %s\r\n", c.account)
+	return err
+}
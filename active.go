@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// activeConn is a control connection that opens the data connections in active
+// mode. The FTP client only knows passive mode: it asks for a data connection
+// with EPSV, or PASV, and dials the port of the reply. activeConn keeps these
+// commands from the server. It listens for the data connection itself, sends
+// the address it listens on with PORT, or EPRT over IPv6, and answers the
+// client as the server would have answered EPSV or PASV. The dial of the data
+// connection then returns the connection the server opens to the listener, see
+// activeDataConn. As it rewrites the plain text of the control connection, it
+// cannot be used once that connection is encrypted.
+type activeConn struct {
+	net.Conn
+	dialer *ftpDialer
+	// reader reads the replies of the server, those to PORT and EPRT as well as
+	// those returned to the client.
+	reader *bufio.Reader
+	// reply is the answer to EPSV or PASV not yet read by the client.
+	reply []byte
+}
+
+func newActiveConn(conn net.Conn, dialer *ftpDialer) *activeConn {
+	return &activeConn{Conn: conn, dialer: dialer, reader: bufio.NewReader(conn)}
+}
+
+func (c *activeConn) Read(b []byte) (int, error) {
+	if len(c.reply) > 0 {
+		n := copy(b, c.reply)
+		c.reply = c.reply[n:]
+		return n, nil
+	}
+	return c.reader.Read(b)
+}
+
+func (c *activeConn) Write(b []byte) (int, error) {
+	command := strings.ToUpper(strings.TrimSpace(string(b)))
+	if command != "EPSV" && command != "PASV" {
+		return c.Conn.Write(b)
+	}
+	reply, err := c.sendPort(command)
+	if err != nil {
+		return 0, err
+	}
+	c.reply = []byte(reply)
+	return len(b), nil
+}
+
+// sendPort listens for the data connection and sends its address to the server
+// in place of command, EPSV or PASV. It returns the reply to command the client
+// reads: the listening port, or the server's rejection of the address.
+func (c *activeConn) sendPort(command string) (string, error) {
+	listener, err := c.dialer.listenActive(c.Conn.LocalAddr())
+	if err != nil {
+		return "", err
+	}
+	addr := listener.Addr().(*net.TCPAddr)
+	request := fmt.Sprintf("EPRT |2|%s|%d|", addr.IP, addr.Port)
+	if ip := addr.IP.To4(); ip != nil {
+		request = fmt.Sprintf("PORT %d,%d,%d,%d,%d,%d", ip[0], ip[1], ip[2], ip[3], addr.Port>>8, addr.Port&0xff)
+	}
+	_, err = fmt.Fprintf(c.Conn, "%s\r\n", request)
+	if err != nil {
+		c.dialer.closeActive()
+		return "", err
+	}
+
+	_, _, err = textproto.NewReader(c.reader).ReadResponse(2)
+	if err != nil {
+		c.dialer.closeActive()
+		var protoErr *textproto.Error
+		if errors.As(err, &protoErr) {
+			// The client fails the transfer with the server's reply.
+			return fmt.Sprintf("%d %s\r\n", protoErr.Code, strings.ReplaceAll(protoErr.Msg, "\n", " ")), nil
+		}
+		return "", err
+	}
+	debugf("Listening on %s for the active mode data connection", addr)
+	if command == "EPSV" {
+		return fmt.Sprintf("229 Entering Extended Passive Mode (|||%d|)\r\n", addr.Port), nil
+	}
+	// The client dials the address of the reply, which the dial of the data
+	// connection ignores in active mode.
+	return fmt.Sprintf("227 Entering Passive Mode (0,0,0,0,%d,%d)\r\n", addr.Port>>8, addr.Port&0xff), nil
+}
+
+// listenPortRange listens on host at the first free port from min to max, or
+// at any port when no range is set.
+func listenPortRange(host string, min int, max int) (*net.TCPListener, error) {
+	if min == 0 {
+		listener, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+		if err != nil {
+			return nil, err
+		}
+		return listener.(*net.TCPListener), nil
+	}
+	var err error
+	for port := min; port <= max; port++ {
+		var listener net.Listener
+		listener, err = net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err == nil {
+			return listener.(*net.TCPListener), nil
+		}
+	}
+	return nil, fmt.Errorf("no free port in ftp_active_port_min/max %d-%d for the data connection: %w", min, max, err)
+}
+
+// activeDataConn is a data connection in active mode. The server only connects
+// to the listener once the client sent the transfer command, after the client
+// got its data connection, so the connection is accepted on first use. Only a
+// connection from the FTP server is accepted.
+type activeDataConn struct {
+	listener *net.TCPListener
+	serverIP net.IP
+
+	acceptOnce sync.Once
+	mu         sync.Mutex
+	conn       net.Conn
+	acceptErr  error
+	closed     bool
+	// readDeadline and writeDeadline are applied to the connection once it is
+	// accepted. Until then the listener waits until the latest deadline set.
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// accept waits for the server to connect, on the first call, and returns the
+// connection.
+func (c *activeDataConn) accept() (net.Conn, error) {
+	c.acceptOnce.Do(func() {
+		conn, err := c.listener.AcceptTCP()
+		_ = c.listener.Close()
+		if err == nil && !conn.RemoteAddr().(*net.TCPAddr).IP.Equal(c.serverIP) {
+			_ = conn.Close()
+			err = fmt.Errorf("active mode data connection from %s, not from the FTP server %s", conn.RemoteAddr(), c.serverIP)
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if err == nil && c.closed {
+			_ = conn.Close()
+			err = net.ErrClosed
+		}
+		if err == nil {
+			err = conn.SetReadDeadline(c.readDeadline)
+		}
+		if err == nil {
+			err = conn.SetWriteDeadline(c.writeDeadline)
+		}
+		if err == nil {
+			c.conn = conn
+		}
+		c.acceptErr = err
+	})
+	return c.conn, c.acceptErr
+}
+
+func (c *activeDataConn) Read(b []byte) (int, error) {
+	conn, err := c.accept()
+	if err != nil {
+		return 0, err
+	}
+	return conn.Read(b)
+}
+
+func (c *activeDataConn) Write(b []byte) (int, error) {
+	conn, err := c.accept()
+	if err != nil {
+		return 0, err
+	}
+	return conn.Write(b)
+}
+
+func (c *activeDataConn) Close() error {
+	err := c.listener.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.conn != nil {
+		return c.conn.Close()
+	}
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func (c *activeDataConn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		return c.conn.LocalAddr()
+	}
+	return c.listener.Addr()
+}
+
+func (c *activeDataConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		return c.conn.RemoteAddr()
+	}
+	return &net.TCPAddr{IP: c.serverIP}
+}
+
+func (c *activeDataConn) SetDeadline(t time.Time) error {
+	return c.setDeadline(t, true, true)
+}
+
+func (c *activeDataConn) SetReadDeadline(t time.Time) error {
+	return c.setDeadline(t, true, false)
+}
+
+func (c *activeDataConn) SetWriteDeadline(t time.Time) error {
+	return c.setDeadline(t, false, true)
+}
+
+// setDeadline sets the read and/or write deadline of the connection, or keeps
+// it for the connection to accept.
+func (c *activeDataConn) setDeadline(t time.Time, read bool, write bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if read {
+		c.readDeadline = t
+	}
+	if write {
+		c.writeDeadline = t
+	}
+	if c.conn != nil {
+		if read && write {
+			return c.conn.SetDeadline(t)
+		} else if read {
+			return c.conn.SetReadDeadline(t)
+		}
+		return c.conn.SetWriteDeadline(t)
+	}
+	if c.closed || c.acceptErr != nil {
+		return nil
+	}
+	var deadline time.Time
+	if !c.readDeadline.IsZero() && !c.writeDeadline.IsZero() {
+		deadline = c.readDeadline
+		if c.writeDeadline.After(deadline) {
+			deadline = c.writeDeadline
+		}
+	}
+	return c.listener.SetDeadline(deadline)
+}
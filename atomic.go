@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jlaffaye/ftp"
+	"log"
+	"net/textproto"
+	"path/filepath"
+)
+
+// atomicTempPrefix and atomicTempSuffix surround the name of a file while it is
+// uploaded with AtomicRemoteUpload, so that "snapshot001.jpg" is sent as
+// ".snapshot001.jpg.tmp". Receivers that skip hidden files do not see it.
+const (
+	atomicTempPrefix = "."
+	atomicTempSuffix = ".tmp"
+)
+
+// atomicTempName returns the remote name targetFile is uploaded under before it
+// is renamed to targetFile.
+func atomicTempName(targetFile string) string {
+	return filepath.Join(filepath.Dir(targetFile), atomicTempPrefix+filepath.Base(targetFile)+atomicTempSuffix)
+}
+
+// storName returns the remote name targetFile is stored under: its temporary
+// name with AtomicRemoteUpload, otherwise targetFile itself.
+func storName(config *Config, targetFile string) string {
+	if config.AtomicRemoteUpload {
+		return atomicTempName(targetFile)
+	}
+	return targetFile
+}
+
+// finishAtomicUpload completes the upload stored under tempFile, see storName.
+// With AtomicRemoteUpload it checks the size of the upload against size, when
+// known, and renames it to targetFile. A server that does not report sizes is
+// trusted. Servers that refuse to rename over an existing file get the old one
+// deleted first, see renameBlockedByTarget. An incomplete upload is removed, so
+// the next attempt starts afresh. The caller holds FTPLock.
+func finishAtomicUpload(config *Config, tempFile string, targetFile string, size int64) error {
+	if tempFile == targetFile {
+		return nil
+	}
+	if size >= 0 {
+		remoteSize, err := config.FTPConn.FileSize(tempFile)
+		if err == nil && remoteSize != size {
+			_ = config.FTPConn.Delete(tempFile)
+			return fmt.Errorf("upload of '%s' incomplete, the server holds %d of %d bytes", targetFile, remoteSize, size)
+		}
+	}
+
+	err := config.FTPConn.Rename(tempFile, targetFile)
+	if err != nil && renameBlockedByTarget(config, err, targetFile) {
+		debugf("Deleting '%s' to rename '%s' over it", targetFile, tempFile)
+		if config.FTPConn.Delete(targetFile) == nil {
+			err = config.FTPConn.Rename(tempFile, targetFile)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to rename '%s' to '%s': %w", tempFile, targetFile, classifyFTPError(err))
+	}
+	debugf("Renamed '%s' to '%s'", tempFile, targetFile)
+	return nil
+}
+
+// renameBlockedByTarget reports whether the server refused, with err, to rename
+// a file to targetFile because targetFile exists: the reply rejects the file
+// name, and the server reports the size of targetFile. Other failures, such as
+// a dropped connection or a permission error on a new name, must not get the
+// existing file deleted.
+func renameBlockedByTarget(config *Config, err error, targetFile string) bool {
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) {
+		return false
+	}
+	if protoErr.Code != ftp.StatusFileUnavailable && protoErr.Code != ftp.StatusBadFileName {
+		return false
+	}
+	_, err = config.FTPConn.FileSize(targetFile)
+	return err == nil
+}
+
+// removeAtomicLeftovers deletes the files left under their temporary names in
+// the remote directory dir by uploads of an earlier run that crashed. With
+// ResumeUploads they are kept, to be resumed. Only the temporary names of the
+// files this run uploads to dir are deleted: other hidden files there may be
+// the uploads of another client, or of a run still in progress.
+func removeAtomicLeftovers(config *Config, dir string) {
+	expected, err := expectedRemoteFiles(*config)
+	if err != nil {
+		debugf("Failed to look for leftover uploads in '%s': %v", dir, err)
+		return
+	}
+	files, err := listRemoteDir(config, dir)
+	if err != nil {
+		debugf("Failed to list remote directory '%s' for leftover uploads: %v", dir, err)
+		return
+	}
+
+	config.FTPLock.Lock()
+	defer config.FTPLock.Unlock()
+	for remoteFile := range expected {
+		if filepath.Dir(remoteFile) != filepath.Clean(dir) {
+			continue
+		}
+		leftover := atomicTempName(remoteFile)
+		if _, ok := files[filepath.Base(leftover)]; !ok {
+			continue
+		}
+		err = config.FTPConn.Delete(leftover)
+		if err != nil {
+			log.Printf("Failed to delete leftover upload '%s': %v", leftover, err)
+			continue
+		}
+		log.Printf("Deleted leftover upload '%s' of an earlier run", leftover)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+)
+
+// TestFinishAtomicUpload renames uploads over an existing file the server
+// refuses to replace, and checks that the existing file is only deleted when
+// the rename failed because of it.
+func TestFinishAtomicUpload(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		renameReply string
+		existing    bool
+		wantErr     bool
+		wantDelete  bool
+		// want is the content of the target afterwards, empty when missing.
+		want string
+	}{
+		{"renamed", "", true, false, false, "new"},
+		{"target exists", "553 file exists", true, false, true, "new"},
+		{"permission denied", "550 permission denied", false, true, false, ""},
+		{"local error", "451 local error in processing", true, true, false, "old"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			server, err := newFTPResponder(t, "tcp4", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			server.mu.Lock()
+			server.stored[".snapshot001.jpg.tmp"] = "new"
+			if test.existing {
+				server.stored["snapshot001.jpg"] = "old"
+			}
+			server.renameReply = test.renameReply
+			server.mu.Unlock()
+
+			config := defaultConfig()
+			config.FTPHost = "127.0.0.1"
+			config.FTPPort = server.listener.Addr().(*net.TCPAddr).Port
+			config.FTPUser = "user"
+			config.FTPPassword = "password"
+			config.AtomicRemoteUpload = true
+			err = establishFTPConnection(context.Background(), &config)
+			if err != nil {
+				t.Fatalf("establishFTPConnection: %v", err)
+			}
+			defer func() { _ = config.FTPConn.Quit() }()
+
+			err = finishAtomicUpload(&config, ".snapshot001.jpg.tmp", "snapshot001.jpg", 3)
+			if (err != nil) != test.wantErr {
+				t.Errorf("finishAtomicUpload error %v, want error %t", err, test.wantErr)
+			}
+			if deleted := slices.Contains(server.received(), "DELE"); deleted != test.wantDelete {
+				t.Errorf("target deleted %t, want %t", deleted, test.wantDelete)
+			}
+			server.mu.Lock()
+			defer server.mu.Unlock()
+			if content := server.stored["snapshot001.jpg"]; content != test.want {
+				t.Errorf("snapshot001.jpg holds %q, want %q", content, test.want)
+			}
+		})
+	}
+}
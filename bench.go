@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// benchStages are the stages reported by -bench, in pipeline order. The
+// generation stages are timed per resolution and added up, while "generate"
+// and "upload" are the wall time of the whole phase.
+var benchStages = []string{"video", "snapshots", "contact_sheet", "sprite", "metadata", "generate", "upload"}
+
+// timeStage starts timing stage and returns the function that stops it,
+// adding the time to the stage's total.
+func (s *Stats) timeStage(stage string) func() {
+	start := time.Now()
+	return func() {
+		s.addDuration(stage, time.Since(start))
+	}
+}
+
+// addDuration adds d to the time of stage, for stages run once per resolution.
+func (s *Stats) addDuration(stage string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Durations == nil {
+		s.Durations = map[string]time.Duration{}
+	}
+	s.Durations[stage] += d
+}
+
+// countBytes records n bytes sent to the upload destination.
+func (s *Stats) countBytes(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.UploadedBytes += n
+}
+
+// printBench prints the -bench breakdown of the run to standard output: the
+// time of every stage that ran and the upload throughput.
+func (s *Stats) printBench(runID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Printf("Benchmark of run %s:\n", runID)
+	for _, stage := range benchStages {
+		if d, ok := s.Durations[stage]; ok {
+			fmt.Printf("  %-14s %s\n", stage, d.Round(time.Millisecond))
+		}
+	}
+	upload := s.Durations["upload"]
+	if upload <= 0 {
+		fmt.Printf("  %-14s not measured, the uploads were skipped\n", "throughput")
+		return
+	}
+	fmt.Printf("  %-14s %d bytes in %s, %.0f bytes/s\n", "throughput", s.UploadedBytes, upload.Round(time.Millisecond), float64(s.UploadedBytes)/upload.Seconds())
+}
+
+// benchUploader counts the bytes of the successful uploads in stats for the
+// throughput of -bench. Appended files count in full.
+type benchUploader struct {
+	Uploader
+	stats *Stats
+}
+
+func (u benchUploader) Upload(ctx context.Context, sourceFile string, targetFile string) error {
+	err := u.Uploader.Upload(ctx, sourceFile, targetFile)
+	if err == nil {
+		u.countFile(sourceFile)
+	}
+	return err
+}
+
+func (u benchUploader) Append(ctx context.Context, sourceFile string, targetFile string) error {
+	err := u.Uploader.Append(ctx, sourceFile, targetFile)
+	if err == nil {
+		u.countFile(sourceFile)
+	}
+	return err
+}
+
+func (u benchUploader) UploadReader(ctx context.Context, r io.Reader, targetFile string) error {
+	// Readers of a known size are passed on as they are, so that the backends
+	// can still tell their size.
+	size := readerSize(r)
+	if size >= 0 {
+		err := u.Uploader.UploadReader(ctx, r, targetFile)
+		if err == nil {
+			u.stats.countBytes(size)
+		}
+		return err
+	}
+	counter := &countingReader{r: r}
+	err := u.Uploader.UploadReader(ctx, counter, targetFile)
+	if err == nil {
+		u.stats.countBytes(counter.n)
+	}
+	return err
+}
+
+// countFile counts the size of the uploaded sourceFile.
+func (u benchUploader) countFile(sourceFile string) {
+	info, err := os.Stat(sourceFile)
+	if err == nil {
+		u.stats.countBytes(info.Size())
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// ErrRetryBudget reports that the run used up its RetryBudget and was aborted.
+var ErrRetryBudget = errors.New("retry budget exhausted")
+
+// retryBudget counts the retries of a run against RetryBudget: the further
+// connection attempts of dialFTP, the reconnections of reconnectFTP and the
+// further attempts of retryUpload. It is shared by the configurations of all
+// destinations and resolutions of the run. A nil budget is unlimited.
+type retryBudget struct {
+	mu    sync.Mutex
+	limit int
+	used  int
+	// abort cancels the context of the run once the budget is exhausted.
+	abort context.CancelCauseFunc
+}
+
+// newRetryBudget returns the budget of a run allowing limit retries in total,
+// or nil when limit is zero. abort is called once it is exhausted.
+func newRetryBudget(limit int, abort context.CancelCauseFunc) *retryBudget {
+	if limit <= 0 {
+		return nil
+	}
+	return &retryBudget{limit: limit, abort: abort}
+}
+
+// spend takes one retry from the budget before it is made. When none is left
+// it aborts the run and returns an error wrapping ErrRetryBudget, and the
+// retry must not be made.
+func (b *retryBudget) spend() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used >= b.limit {
+		err := b.err()
+		b.abort(err)
+		return err
+	}
+	b.used++
+	return nil
+}
+
+// err returns the error of the exhausted budget. The caller holds mu.
+func (b *retryBudget) err() error {
+	return fmt.Errorf("%w: retry_budget of %d used up", ErrRetryBudget, b.limit)
+}
+
+// ErrByteBudget reports that an upload was refused because the run sent
+// MaxUploadBytes.
+var ErrByteBudget = errors.New("byte budget exhausted")
+
+// byteBudget counts the bytes sent by the uploads of a run against
+// MaxUploadBytes, every attempt in full. It is shared by the configurations of
+// all destinations and resolutions of the run. A nil budget is unlimited.
+type byteBudget struct {
+	mu        sync.Mutex
+	limit     int64
+	used      int64
+	exhausted bool
+}
+
+// newByteBudget returns the budget of a run allowing limit bytes in total, or
+// nil when limit is zero.
+func newByteBudget(limit int64) *byteBudget {
+	if limit <= 0 {
+		return nil
+	}
+	return &byteBudget{limit: limit}
+}
+
+// spend takes n bytes from the budget before they are sent. Once they do not
+// fit, the budget is exhausted and refuses every further upload with an error
+// wrapping ErrByteBudget, so that no later file is sent out of order.
+func (b *byteBudget) spend(n int64) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.exhausted && b.used+n > b.limit {
+		b.exhausted = true
+		warnf("Byte budget exhausted, max_upload_bytes of %d would be exceeded after %d bytes, the remaining files are left for the next run", b.limit, b.used)
+	}
+	if b.exhausted {
+		return fmt.Errorf("%w: max_upload_bytes of %d reached", ErrByteBudget, b.limit)
+	}
+	b.used += n
+	return nil
+}
+
+// spendAgain takes the size of r, rewound to its start, from the budget before
+// it is sent once more, as when an upload is repeated over a new connection.
+// Readers of unknown size are charged as they are read, by budgetReader.
+func (b *byteBudget) spendAgain(r io.Reader) error {
+	size := readerSize(r)
+	if size < 0 {
+		return nil
+	}
+	return b.spend(size)
+}
+
+// budgetUploader takes the bytes of every transfer from a byteBudget before it
+// starts. Appended files count in full. The transfers an FTP upload repeats by
+// itself, after a reconnection or a failed resume, are charged by spendAgain.
+type budgetUploader struct {
+	Uploader
+	budget *byteBudget
+}
+
+func (u budgetUploader) Upload(ctx context.Context, sourceFile string, targetFile string) error {
+	if err := u.spendFile(sourceFile); err != nil {
+		return err
+	}
+	return u.Uploader.Upload(ctx, sourceFile, targetFile)
+}
+
+func (u budgetUploader) Append(ctx context.Context, sourceFile string, targetFile string) error {
+	if err := u.spendFile(sourceFile); err != nil {
+		return err
+	}
+	return u.Uploader.Append(ctx, sourceFile, targetFile)
+}
+
+func (u budgetUploader) UploadReader(ctx context.Context, r io.Reader, targetFile string) error {
+	// Readers of a known size are passed on as they are, so that the backends
+	// can still tell their size. The others are charged as they are read.
+	size := readerSize(r)
+	if size < 0 {
+		return u.Uploader.UploadReader(ctx, &budgetReader{r: r, budget: u.budget}, targetFile)
+	}
+	if err := u.budget.spend(size); err != nil {
+		return err
+	}
+	return u.Uploader.UploadReader(ctx, r, targetFile)
+}
+
+// spendFile takes the size of sourceFile from the budget.
+func (u budgetUploader) spendFile(sourceFile string) error {
+	info, err := os.Stat(sourceFile)
+	if err != nil {
+		return err
+	}
+	return u.budget.spend(info.Size())
+}
+
+// budgetReader takes the bytes read through it from a byteBudget, failing the
+// read that would exceed it.
+type budgetReader struct {
+	r      io.Reader
+	budget *byteBudget
+}
+
+func (b *budgetReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if n > 0 {
+		if budgetErr := b.budget.spend(int64(n)); budgetErr != nil {
+			return 0, budgetErr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// runTestLogin logs in to the FTP server and quits at once, for the -test-login
+// flag, reporting whether and how the connection is encrypted. Unlike runCheck
+// it writes nothing on the server.
+func runTestLogin(config Config) error {
+	if config.TransferProtocol != "" && config.TransferProtocol != "ftp" {
+		return fmt.Errorf("-test-login only tests FTP logins, transfer_protocol is %q", config.TransferProtocol)
+	}
+	config.FTPKeepaliveInterval = 0
+	err := establishFTPConnection(context.Background(), &config)
+	if err != nil {
+		return err
+	}
+	defer closeFTPConnection(&config)
+	log.Printf("FTP login as '%s' succeeded", config.FTPUser)
+
+	state := config.ftpDialer.tlsState()
+	if state == nil {
+		log.Println("TLS: not used, the credentials and files are sent in clear text")
+		return nil
+	}
+	subject := "none"
+	if len(state.PeerCertificates) > 0 {
+		subject = state.PeerCertificates[0].Subject.String()
+	}
+	log.Printf("TLS: %s FTPS, %s, %s, server certificate %s", config.FTPTLS, tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite), subject)
+	return nil
+}
+
+// runCheck performs the self-test behind the -check flag. The configuration has
+// already been validated by the time it runs. It confirms that ffmpeg can be
+// executed and that the FTP or SFTP server accepts a login and a small
+// create/upload/delete round-trip in a temporary remote directory. For S3 the
+// round-trip uploads and deletes a probe object instead, and for the tcp
+// protocol, which cannot delete what it sent, only the connection is tested.
+func runCheck(config Config) error {
+	version, err := ffmpegVersion()
+	if err != nil {
+		return fmt.Errorf("ffmpeg is not usable: %v", err)
+	}
+	log.Printf("Found %s", version)
+
+	if config.TransferProtocol == "s3" {
+		uploader, err := newS3Uploader(&config)
+		if err != nil {
+			return err
+		}
+		err = uploader.selfTest(filepath.Join(config.OutputDir, fmt.Sprintf(".check-%d.txt", time.Now().UnixNano())))
+		if err != nil {
+			return err
+		}
+		log.Println("S3 write round-trip succeeded")
+		return nil
+	}
+
+	if config.TransferProtocol == "sftp" {
+		uploader, err := newSFTPUploader(context.Background(), &config)
+		if err != nil {
+			return err
+		}
+		defer uploader.Close()
+		log.Println("SFTP login succeeded")
+		err = uploader.selfTest(filepath.Join(config.OutputDir, fmt.Sprintf(".check-%d", time.Now().UnixNano())))
+		if err != nil {
+			return err
+		}
+		log.Println("SFTP write round-trip succeeded")
+		return nil
+	}
+
+	if config.TransferProtocol == "tcp" {
+		uploader, err := newTCPUploader(context.Background(), &config)
+		if err != nil {
+			return err
+		}
+		log.Println("TCP connection succeeded")
+		return uploader.Close()
+	}
+
+	// The check is short and issues its own commands, so no keepalive is needed.
+	config.FTPKeepaliveInterval = 0
+	err = establishFTPConnection(context.Background(), &config)
+	if err != nil {
+		return err
+	}
+	defer closeFTPConnection(&config)
+	log.Println("FTP login succeeded")
+
+	dir := filepath.Join(config.OutputDir, fmt.Sprintf(".check-%d", time.Now().UnixNano()))
+	probe := filepath.Join(dir, "probe.txt")
+
+	err = config.FTPConn.MakeDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to create remote directory '%s': %v", dir, err)
+	}
+	err = config.FTPConn.Stor(probe, strings.NewReader("FTPDataGenerator self-test\n"))
+	if err != nil {
+		return fmt.Errorf("failed to upload remote file '%s': %v", probe, err)
+	}
+	err = config.FTPConn.Delete(probe)
+	if err != nil {
+		return fmt.Errorf("failed to delete remote file '%s': %v", probe, err)
+	}
+	err = config.FTPConn.RemoveDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to remove remote directory '%s': %v", dir, err)
+	}
+	log.Println("FTP write round-trip succeeded")
+
+	return nil
+}
+
+// ffmpegVersion returns the first line of `ffmpeg -version`.
+func ffmpegVersion() (string, error) {
+	out, err := exec.Command("ffmpeg", "-version").Output()
+	if err != nil {
+		return "", err
+	}
+	line, _, _ := bytes.Cut(out, []byte("\n"))
+	return string(line), nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// uploadCheckpoint records the snapshots uploaded to one destination, so that a
+// run restarted after a crash skips them. It is kept in a JSON file in the output
+// directory and discarded once all snapshots have been uploaded.
+type uploadCheckpoint struct {
+	path string
+
+	mu       sync.Mutex
+	hash     string
+	uploaded map[string]bool
+}
+
+// checkpointFile is the JSON form of an uploadCheckpoint.
+type checkpointFile struct {
+	ConfigHash string   `json:"config_hash"`
+	Uploaded   []string `json:"uploaded"`
+}
+
+// loadCheckpoint returns the checkpoint of the destination of config, with the
+// uploads recorded by an earlier run of the same configuration. A checkpoint
+// written for a different configuration is ignored.
+func loadCheckpoint(config Config) *uploadCheckpoint {
+	name := ".upload-checkpoint.json"
+	if config.destinationName != "" {
+		name = fmt.Sprintf(".upload-checkpoint-%s.json", strings.NewReplacer("/", "_", `\`, "_").Replace(config.destinationName))
+	}
+	c := &uploadCheckpoint{
+		path:     filepath.Join(config.OutputDir, name),
+		hash:     configHash(config),
+		uploaded: make(map[string]bool),
+	}
+
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to read checkpoint '%s', starting over: %v", c.path, err)
+		}
+		return c
+	}
+	var file checkpointFile
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		log.Printf("Failed to parse checkpoint '%s', starting over: %v", c.path, err)
+		return c
+	}
+	if file.ConfigHash != c.hash {
+		log.Printf("Checkpoint '%s' was written for a different configuration, starting over", c.path)
+		return c
+	}
+	for _, targetFile := range file.Uploaded {
+		c.uploaded[targetFile] = true
+	}
+	log.Printf("Resuming from checkpoint '%s', %d snapshots already uploaded", c.path, len(c.uploaded))
+	return c
+}
+
+// done reports whether targetFile was uploaded according to the checkpoint.
+func (c *uploadCheckpoint) done(targetFile string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.uploaded[targetFile]
+}
+
+// record adds targetFile to the checkpoint and rewrites the checkpoint file.
+func (c *uploadCheckpoint) record(targetFile string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.uploaded[targetFile] = true
+
+	file := checkpointFile{ConfigHash: c.hash, Uploaded: make([]string, 0, len(c.uploaded))}
+	for uploaded := range c.uploaded {
+		file.Uploaded = append(file.Uploaded, uploaded)
+	}
+	sort.Strings(file.Uploaded)
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(c.path, data)
+	}
+	if err != nil {
+		log.Printf("Failed to write checkpoint '%s': %v", c.path, err)
+	}
+}
+
+// remove deletes the checkpoint file once the batch is complete.
+func (c *uploadCheckpoint) remove() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := os.Remove(c.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Failed to remove checkpoint '%s': %v", c.path, err)
+	}
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// over path, so that readers see either the old or the new content.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-"+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// With ChunkedUpload, a file larger than ChunkSize is uploaded as parts next to
+// where the file would be stored, followed by a manifest:
+//
+//	video.mp4.part001, video.mp4.part002, ...  ChunkSize bytes each, the last
+//	                                            one holding the remainder
+//	video.mp4.sha256                            one "<sha256>  <part name>" line
+//	                                            per part, in order
+//
+// The manifest is uploaded last, so its presence means all parts are complete.
+// The receiver checks the parts with "sha256sum -c video.mp4.sha256" and joins
+// them in the order of the manifest to restore the file. Parts have at least
+// three digits; with more than 999 parts the manifest order, not the name order,
+// is the one to follow.
+//
+// With EncryptUploads every part, and the manifest, is encrypted on its own and
+// stored with encryptedSuffix, as "video.mp4.part001.enc". The manifest still
+// holds the checksums of the plain parts under their plain names, so the parts
+// must be decrypted to those names, with -decrypt, before the check; checking
+// the stored files fails.
+const (
+	chunkPartFormat     = "%s.part%03d"
+	chunkManifestSuffix = ".sha256"
+)
+
+// filePart is one part of a chunked upload.
+type filePart struct {
+	name   string
+	offset int64
+	size   int64
+}
+
+// chunkedFile reports whether a file of size bytes is uploaded in parts.
+func chunkedFile(config Config, size int64) bool {
+	return config.ChunkedUpload && size > config.ChunkSize
+}
+
+// fileParts splits a file of size bytes uploaded to targetFile into parts of
+// chunkSize bytes.
+func fileParts(targetFile string, size int64, chunkSize int64) []filePart {
+	var parts []filePart
+	for offset := int64(0); offset < size; offset += chunkSize {
+		parts = append(parts, filePart{
+			name:   fmt.Sprintf(chunkPartFormat, targetFile, len(parts)+1),
+			offset: offset,
+			size:   min(chunkSize, size-offset),
+		})
+	}
+	return parts
+}
+
+// chunkingUploader uploads files larger than the chunk size of its
+// configuration in parts, each part retried on its own, so that a dropped
+// transfer only costs one part.
+type chunkingUploader struct {
+	Uploader
+	config *Config
+}
+
+func (u chunkingUploader) Upload(ctx context.Context, sourceFile string, targetFile string) error {
+	f, err := os.Open(sourceFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !chunkedFile(*u.config, info.Size()) {
+		return u.Uploader.Upload(ctx, sourceFile, targetFile)
+	}
+
+	parts := fileParts(targetFile, info.Size(), u.config.ChunkSize)
+	var manifest strings.Builder
+	for i, part := range parts {
+		hash := sha256.New()
+		err = retryUpload(ctx, u.config, fmt.Sprintf("part %d/%d of '%s'", i+1, len(parts), sourceFile), func() error {
+			hash.Reset()
+			section := io.NewSectionReader(f, part.offset, part.size)
+			return u.Uploader.UploadReader(ctx, io.TeeReader(section, hash), part.name)
+		})
+		if err != nil {
+			return fmt.Errorf("part %d/%d: %w", i+1, len(parts), err)
+		}
+		fmt.Fprintf(&manifest, "%s  %s\n", hex.EncodeToString(hash.Sum(nil)), filepath.Base(part.name))
+	}
+	return retryUpload(ctx, u.config, fmt.Sprintf("manifest of '%s'", sourceFile), func() error {
+		return u.Uploader.UploadReader(ctx, strings.NewReader(manifest.String()), targetFile+chunkManifestSuffix)
+	})
+}
+
+// Append uploads the whole file, as parts cannot be extended.
+func (u chunkingUploader) Append(ctx context.Context, sourceFile string, targetFile string) error {
+	return u.Upload(ctx, sourceFile, targetFile)
+}
+
+// Unchanged reports false for chunked files, whose parts cannot be compared
+// with the local file.
+func (u chunkingUploader) Unchanged(sourceFile string, targetFile string) bool {
+	info, err := os.Stat(sourceFile)
+	if err != nil || chunkedFile(*u.config, info.Size()) {
+		return false
+	}
+	return u.Uploader.Unchanged(sourceFile, targetFile)
+}
+
+// remoteParts returns the remote names of the parts of a file of size bytes
+// uploaded as remoteFile, mapped to their sizes on the server. remoteFile
+// carries the suffix of encrypted uploads, which the parts carry instead.
+func remoteParts(config Config, remoteFile string, size int64) map[string]int64 {
+	suffix := ""
+	if config.EncryptUploads {
+		suffix = encryptedSuffix
+		remoteFile = strings.TrimSuffix(remoteFile, suffix)
+	}
+	parts := make(map[string]int64)
+	for _, part := range fileParts(remoteFile, size, config.ChunkSize) {
+		parts[part.name+suffix] = uploadedSize(config, part.size)
+	}
+	return parts
+}
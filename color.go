@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// The values ffmpeg accepts for its -color_primaries, -color_trc and -colorspace
+// options, with the aliases it also knows.
+var (
+	colorPrimariesValues = []string{
+		"bt709", "bt470m", "bt470bg", "smpte170m", "smpte240m", "film", "bt2020",
+		"smpte428", "smpte428_1", "smpte431", "smpte432", "jedec-p22", "ebu3213",
+	}
+	colorTRCValues = []string{
+		"bt709", "gamma22", "gamma28", "smpte170m", "smpte240m", "linear",
+		"log100", "log", "log316", "log_sqrt", "iec61966-2-4", "iec61966_2_4",
+		"bt1361e", "bt1361", "iec61966-2-1", "iec61966_2_1", "bt2020-10",
+		"bt2020_10bit", "bt2020-12", "bt2020_12bit", "smpte2084", "smpte428",
+		"smpte428_1", "arib-std-b67",
+	}
+	colorspaceValues = []string{
+		"rgb", "bt709", "fcc", "bt470bg", "smpte170m", "smpte240m", "ycgco",
+		"ycocg", "bt2020nc", "bt2020_ncl", "bt2020c", "bt2020_cl", "smpte2085",
+		"chroma-derived-nc", "chroma-derived-c", "ictcp",
+	}
+)
+
+// colorArgs returns the ffmpeg output options tagging the video and the
+// snapshots with the configured color properties.
+func colorArgs(config Config) []string {
+	var args []string
+	if config.ColorPrimaries != "" {
+		args = append(args, "-color_primaries", config.ColorPrimaries)
+	}
+	if config.ColorTRC != "" {
+		args = append(args, "-color_trc", config.ColorTRC)
+	}
+	if config.Colorspace != "" {
+		args = append(args, "-colorspace", config.Colorspace)
+	}
+	return args
+}
+
+// validateColor checks the color properties against the values ffmpeg knows.
+func validateColor(config Config) error {
+	settings := []struct {
+		key    string
+		value  string
+		values []string
+	}{
+		{"color_primaries", config.ColorPrimaries, colorPrimariesValues},
+		{"color_trc", config.ColorTRC, colorTRCValues},
+		{"colorspace", config.Colorspace, colorspaceValues},
+	}
+	for _, setting := range settings {
+		if setting.value != "" && !slices.Contains(setting.values, setting.value) {
+			values := slices.Clone(setting.values)
+			sort.Strings(values)
+			return fmt.Errorf("unknown %s %q, ffmpeg accepts %s", setting.key, setting.value, strings.Join(values, ", "))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/sync/semaphore"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+)
+
+// concurrencyLimit bounds the ffmpeg processes and uploads running at a time
+// across the whole pipeline. It is nil when MaxConcurrency is not set.
+var concurrencyLimit *semaphore.Weighted
+
+// setMaxConcurrency installs the limit of MaxConcurrency; zero removes it.
+func setMaxConcurrency(n int) {
+	if n <= 0 {
+		concurrencyLimit = nil
+		return
+	}
+	concurrencyLimit = semaphore.NewWeighted(int64(n))
+}
+
+// acquireSlot waits for a free slot of the concurrency limit and returns the
+// function releasing it. Operations holding a slot must not acquire another.
+func acquireSlot(ctx context.Context) (func(), error) {
+	limit := concurrencyLimit
+	if limit == nil {
+		return func() {}, nil
+	}
+	err := limit.Acquire(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+	return func() { limit.Release(1) }, nil
+}
+
+// runLimited calls fn with every index below n, in at most workers goroutines at
+// a time. It returns once all calls have returned, with the error of the lowest
+// index that failed.
+func runLimited(workers int, n int, fn func(i int) error) error {
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, max(workers, 1))
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			errs[i] = fn(i)
+		}(i)
+	}
+
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// threadArgs returns the ffmpeg option limiting the threads of a process to
+// FFmpegThreads, or nothing to leave the choice to ffmpeg.
+func threadArgs(config Config) []string {
+	if config.FFmpegThreads <= 0 {
+		return nil
+	}
+	return []string{"-threads", strconv.Itoa(config.FFmpegThreads)}
+}
+
+// runFFmpeg runs ffmpeg with args in a slot of the concurrency limit. With a
+// Timezone, ffmpeg runs with TZ set to it, so that the localtime overlay shows
+// the time in that zone. ffmpeg logs at FFmpegLogLevel, with the level of each
+// line, so that its warnings are logged and its errors fail the command, see
+// ffmpegOutput. With DebugFFmpeg, the output of ffmpeg is written to the log
+// file of the command name as well, see ffmpegLogFile.
+func runFFmpeg(ctx context.Context, config Config, name string, args []string) error {
+	release, err := acquireSlot(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	args = append([]string{"-loglevel", "level+" + config.FFmpegLogLevel}, args...)
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	if config.Timezone != "" {
+		cmd.Env = append(os.Environ(), "TZ="+config.Timezone)
+	}
+	output := &ffmpegOutput{name: name}
+	cmd.Stderr = output
+	if !config.DebugFFmpeg {
+		return output.result(cmd.Run())
+	}
+
+	logFile, err := createFFmpegLog(config, name, args)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+	cmd.Stdout, cmd.Stderr = logFile, io.MultiWriter(logFile, output)
+	err = output.result(cmd.Run())
+	if err != nil {
+		return fmt.Errorf("%w, see '%s'", err, logFile.Name())
+	}
+	return nil
+}
+
+// limitedUploader runs every transfer of an Uploader in a slot of the
+// concurrency limit.
+type limitedUploader struct {
+	Uploader
+}
+
+func (u limitedUploader) Upload(ctx context.Context, sourceFile string, targetFile string) error {
+	release, err := acquireSlot(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return u.Uploader.Upload(ctx, sourceFile, targetFile)
+}
+
+func (u limitedUploader) Append(ctx context.Context, sourceFile string, targetFile string) error {
+	release, err := acquireSlot(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return u.Uploader.Append(ctx, sourceFile, targetFile)
+}
+
+func (u limitedUploader) UploadReader(ctx context.Context, r io.Reader, targetFile string) error {
+	release, err := acquireSlot(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return u.Uploader.UploadReader(ctx, r, targetFile)
+}
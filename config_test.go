@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// openFDs returns the number of file descriptors open in the process.
+func openFDs(t *testing.T) int {
+	t.Helper()
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Fatalf("failed to list open file descriptors: %v", err)
+	}
+	return len(entries)
+}
+
+// TestReadConfigClosesFiles loads configurations, valid and invalid, many times
+// and checks that no file descriptor is left open.
+func TestReadConfigClosesFiles(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("counting open file descriptors needs /proc/self/fd")
+	}
+
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.json")
+	overlay := filepath.Join(dir, "overlay.json")
+	invalid := filepath.Join(dir, "invalid.json")
+	for file, content := range map[string]string{
+		base:    `{"resolution": "320x240", "fps": 25, "duration": 2, "ftp_host": "127.0.0.1", "ftp_port": 21}`,
+		overlay: `{"ftp_port": 2121}`,
+		invalid: `{"no_such_key": true}`,
+	} {
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	before := openFDs(t)
+	for i := 0; i < 200; i++ {
+		config, err := readConfig([]string{base, overlay})
+		if err != nil {
+			t.Fatalf("readConfig: %v", err)
+		}
+		if config.FTPPort != 2121 {
+			t.Fatalf("ftp_port = %d, want 2121 from the overlay", config.FTPPort)
+		}
+		if _, err := readConfig([]string{base, invalid}); err == nil {
+			t.Fatal("readConfig accepted an unknown key")
+		}
+		if _, err := readConfig([]string{filepath.Join(dir, "missing.json")}); err == nil {
+			t.Fatal("readConfig accepted a missing file")
+		}
+	}
+	if after := openFDs(t); after > before {
+		t.Errorf("%d file descriptors open after loading the configuration 600 times, %d before", after, before)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"path/filepath"
+)
+
+// contactSheetTileWidth is the width in pixels of each snapshot on the contact sheet.
+const contactSheetTileWidth = 320
+
+// generateContactSheet renders the snapshots of config into a single overview
+// image at ContactSheetPath, in a grid as close to square as possible.
+func generateContactSheet(ctx context.Context, config Config) error {
+	snapshotFiles, err := globSnapshots(config)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve snapshot files: %v", err)
+	}
+	if len(snapshotFiles) == 0 {
+		return fmt.Errorf("no snapshots for the contact sheet")
+	}
+
+	log.Println("Generating contact sheet...")
+	err = createDirectory(filepath.Dir(config.ContactSheetPath))
+	if err != nil {
+		return err
+	}
+	workDir, err := makeWorkDir(config, filepath.Dir(config.ContactSheetPath))
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %v", err)
+	}
+	defer removeWorkDir(workDir)
+	workFile := filepath.Join(workDir, filepath.Base(config.ContactSheetPath))
+
+	columns := int(math.Ceil(math.Sqrt(float64(len(snapshotFiles)))))
+	rows := (len(snapshotFiles) + columns - 1) / columns
+	args := []string{ffmpegOverwriteFlag(config), "-i", snapshotPattern(config),
+		"-vf", fmt.Sprintf("scale=%d:-1,tile=%dx%d", contactSheetTileWidth, columns, rows),
+		"-frames:v", "1"}
+	args = append(args, threadArgs(config)...)
+	args = append(args, workFile)
+	err = runFFmpeg(ctx, config, "contact_sheet", args)
+	if err != nil {
+		return fmt.Errorf("failed to generate contact sheet: %v", err)
+	}
+	err = checkOutputFile(workFile)
+	if err != nil {
+		return fmt.Errorf("ffmpeg did not produce the contact sheet: %v", err)
+	}
+	err = moveFile(workFile, config.ContactSheetPath)
+	if err != nil {
+		return fmt.Errorf("failed to move contact sheet to '%s': %v", config.ContactSheetPath, err)
+	}
+	log.Printf("Contact sheet of %d snapshots (%dx%d) written to '%s'", len(snapshotFiles), columns, rows, config.ContactSheetPath)
+	return nil
+}
+
+// contactSheetRemoteName returns the remote base name of the contact sheet,
+// "contact_sheet" with the extension of ContactSheetPath.
+func contactSheetRemoteName(config Config) string {
+	return "contact_sheet" + filepath.Ext(config.ContactSheetPath)
+}
+
+// uploadContactSheet uploads the contact sheet to the remote directory.
+func uploadContactSheet(ctx context.Context, config *Config) {
+	if ctx.Err() != nil {
+		log.Println("Contact sheet upload cancelled.")
+		return
+	}
+
+	targetFile := filepath.Join(remoteDir(*config), remoteName(*config, contactSheetRemoteName(*config), config.ContactSheetPath))
+	if config.SkipExisting && config.Uploader.Unchanged(config.ContactSheetPath, targetFile) {
+		debugf("Skipping contact sheet '%s', already on the server", config.ContactSheetPath)
+		config.Stats.countSkipped()
+		return
+	}
+
+	err := config.Uploader.Upload(ctx, config.ContactSheetPath, targetFile)
+	if err != nil {
+		fileLogf(config.ContactSheetPath, "Failed to upload contact sheet '%s': %v", config.ContactSheetPath, err)
+		config.Stats.countFailed(config.ContactSheetPath, err)
+	} else {
+		fileLogf(config.ContactSheetPath, "Uploaded contact sheet '%s'", config.ContactSheetPath)
+		config.Stats.countUploaded()
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// videoContainer describes a value of VideoContainer: the ffmpeg muxer passed
+// with -f and the extension of the test video.
+type videoContainer struct {
+	muxer     string
+	extension string
+}
+
+// videoContainers are the supported values of VideoContainer.
+var videoContainers = map[string]videoContainer{
+	"mp4": {"mp4", ".mp4"},
+	"mkv": {"matroska", ".mkv"},
+	"mov": {"mov", ".mov"},
+	"ts":  {"mpegts", ".ts"},
+}
+
+// codecContainers lists the containers each well-known video encoder can be
+// muxed into. Encoders missing from the list are not checked and left to ffmpeg.
+var codecContainers = map[string][]string{
+	"libx264":    {"mp4", "mkv", "mov", "ts"},
+	"libx265":    {"mp4", "mkv", "mov", "ts"},
+	"h264":       {"mp4", "mkv", "mov", "ts"},
+	"hevc":       {"mp4", "mkv", "mov", "ts"},
+	"mpeg2video": {"mp4", "mkv", "mov", "ts"},
+	"mpeg4":      {"mp4", "mkv", "mov", "ts"},
+	"libvpx":     {"mkv"},
+	"libvpx-vp9": {"mp4", "mkv"},
+	"libaom-av1": {"mp4", "mkv"},
+	"libsvtav1":  {"mp4", "mkv"},
+	"prores":     {"mov", "mkv"},
+	"prores_ks":  {"mov", "mkv"},
+	"ffv1":       {"mkv"},
+	"mjpeg":      {"mkv", "mov"},
+}
+
+// videoCodec returns the video encoder chosen in FFmpegExtraArgs, or "" when
+// ffmpeg picks the default encoder of the container.
+func videoCodec(config Config) string {
+	codec := ""
+	for i := 0; i+1 < len(config.FFmpegExtraArgs); i++ {
+		switch config.FFmpegExtraArgs[i] {
+		case "-c:v", "-codec:v", "-vcodec":
+			// As with ffmpeg, the last one wins.
+			codec = config.FFmpegExtraArgs[i+1]
+		}
+	}
+	return codec
+}
+
+// validateVideoContainer checks VideoContainer against the path and the codec
+// of the test video.
+func validateVideoContainer(config Config) error {
+	if config.VideoContainer == "" {
+		return nil
+	}
+	container, ok := videoContainers[config.VideoContainer]
+	if !ok {
+		return fmt.Errorf("video_container must be \"mp4\", \"mkv\", \"mov\" or \"ts\", got %q", config.VideoContainer)
+	}
+	if config.SourceVideo != "" || config.WatchDir != "" || config.SnapshotsOnly {
+		return fmt.Errorf("video_container cannot be used with source_video, watch_dir or snapshots_only, no test video is generated")
+	}
+	if ext := filepath.Ext(config.TestVideoPath); ext != "" && !strings.EqualFold(ext, container.extension) {
+		return fmt.Errorf("test_video_path '%s' does not match video_container %q, use the extension %s or none", config.TestVideoPath, config.VideoContainer, container.extension)
+	}
+	codec := videoCodec(config)
+	if containers, known := codecContainers[codec]; known && !slices.Contains(containers, config.VideoContainer) {
+		return fmt.Errorf("video codec %s cannot be written to video_container %q, use one of %s", codec, config.VideoContainer, strings.Join(containers, ", "))
+	}
+	return nil
+}
+
+// containerVideoPath returns TestVideoPath with the extension of VideoContainer
+// when it has none.
+func containerVideoPath(config Config) string {
+	if config.VideoContainer == "" || filepath.Ext(config.TestVideoPath) != "" {
+		return config.TestVideoPath
+	}
+	return config.TestVideoPath + videoContainers[config.VideoContainer].extension
+}
+
+// containerArgs returns the ffmpeg arguments selecting the muxer of
+// VideoContainer, placed right before the output file.
+func containerArgs(config Config) []string {
+	if config.VideoContainer == "" {
+		return nil
+	}
+	return []string{"-f", videoContainers[config.VideoContainer].muxer}
+}
+
+// videoMetadataKeyPattern matches the keys of VideoMetadata.
+var videoMetadataKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// videoMetadataArgs returns the ffmpeg -metadata arguments tagging the test
+// video with VideoMetadata, sorted by key. {site}, {camera}, {run_id} and
+// {config_hash} in the values are replaced by the settings of the run.
+func videoMetadataArgs(config Config) []string {
+	keys := slices.Sorted(maps.Keys(config.VideoMetadata))
+	replacer := strings.NewReplacer(
+		"{site}", config.Site,
+		"{camera}", config.Camera,
+		"{run_id}", config.runID,
+		"{config_hash}", shortHash(config),
+	)
+	var args []string
+	for _, key := range keys {
+		args = append(args, "-metadata", key+"="+replacer.Replace(config.VideoMetadata[key]))
+	}
+	return args
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+)
+
+// Destination is one upload target of a run. When Config.Destinations is set,
+// the uploads go to every destination in turn, each with its own protocol,
+// server, credentials and remote path; the same settings of Config are then
+// ignored.
+type Destination struct {
+	// Name identifies the destination in the logs.
+	Name string `json:"name"`
+	// TransferProtocol is "ftp" (the default), "sftp", "s3" or "tcp".
+	TransferProtocol string `json:"transfer_protocol"`
+	TCPAddress       string `json:"tcp_address"`
+
+	FTPHost          string `json:"ftp_host"`
+	FTPPort          int    `json:"ftp_port"`
+	FTPUser          string `json:"ftp_user"`
+	FTPPassword      string `json:"ftp_password"`
+	FTPAccount       string `json:"ftp_account"`
+	FTPTLS           string `json:"ftp_tls"`
+	TLSClientCert    string `json:"tls_client_cert"`
+	TLSClientKey     string `json:"tls_client_key"`
+	PinnedCertSHA256 string `json:"pinned_cert_sha256"`
+
+	SFTPHost       string `json:"sftp_host"`
+	SFTPPort       int    `json:"sftp_port"`
+	SFTPUser       string `json:"sftp_user"`
+	SFTPPassword   string `json:"sftp_password"`
+	SFTPPrivateKey string `json:"sftp_private_key"`
+	SFTPKnownHosts string `json:"sftp_known_hosts"`
+
+	S3Bucket          string `json:"s3_bucket"`
+	S3Region          string `json:"s3_region"`
+	S3Prefix          string `json:"s3_prefix"`
+	S3AccessKeyID     string `json:"s3_access_key_id"`
+	S3SecretAccessKey string `json:"s3_secret_access_key"`
+
+	// RemoteDirTemplate is the remote directory of the uploads, with the
+	// placeholders of Config.RemoteDirTemplate. When empty, OutputDir is used.
+	RemoteDirTemplate string `json:"remote_dir_template"`
+}
+
+// destinationConfigs returns one configuration per upload destination. Without
+// Destinations, the configuration itself is the only destination.
+func destinationConfigs(config Config) []Config {
+	if len(config.Destinations) == 0 {
+		return []Config{config}
+	}
+
+	configs := make([]Config, 0, len(config.Destinations))
+	for i, destination := range config.Destinations {
+		if destination.Name == "" {
+			destination.Name = fmt.Sprintf("destination %d", i+1)
+		}
+		configs = append(configs, destinationConfig(config, destination))
+	}
+	return configs
+}
+
+// destinationConfig returns config with the upload settings of destination.
+func destinationConfig(config Config, destination Destination) Config {
+	config.Destinations = nil
+	config.destinationName = destination.Name
+	config.TransferProtocol = destination.TransferProtocol
+	config.TCPAddress = destination.TCPAddress
+	config.FTPHost = destination.FTPHost
+	config.FTPPort = destination.FTPPort
+	config.FTPUser = destination.FTPUser
+	config.FTPPassword = destination.FTPPassword
+	config.FTPAccount = destination.FTPAccount
+	config.FTPTLS = destination.FTPTLS
+	config.TLSClientCert = destination.TLSClientCert
+	config.TLSClientKey = destination.TLSClientKey
+	config.PinnedCertSHA256 = destination.PinnedCertSHA256
+	config.SFTPHost = destination.SFTPHost
+	config.SFTPPort = destination.SFTPPort
+	config.SFTPUser = destination.SFTPUser
+	config.SFTPPassword = destination.SFTPPassword
+	config.SFTPPrivateKey = destination.SFTPPrivateKey
+	config.SFTPKnownHosts = destination.SFTPKnownHosts
+	config.S3Bucket = destination.S3Bucket
+	config.S3Region = destination.S3Region
+	config.S3Prefix = destination.S3Prefix
+	config.S3AccessKeyID = destination.S3AccessKeyID
+	config.S3SecretAccessKey = destination.S3SecretAccessKey
+	config.RemoteDirTemplate = destination.RemoteDirTemplate
+	return config
+}
+
+// validateDestinations checks the upload settings of every destination.
+func validateDestinations(config Config) error {
+	if len(config.Destinations) == 0 {
+		return nil
+	}
+	for _, destination := range destinationConfigs(config) {
+		err := validateConfig(destination)
+		if err != nil {
+			return fmt.Errorf("%s: %v", destination.destinationName, err)
+		}
+	}
+	return nil
+}
+
+// connectDestination connects to the destination of config. The returned
+// configuration holds the connected Uploader, which must be closed by the
+// caller. It is returned by pointer, as the Uploader refers to it. Connecting
+// is given up once ctx is done.
+func connectDestination(ctx context.Context, config Config) (*Config, error) {
+	var err error
+	config.Uploader, err = newUploader(ctx, &config)
+	if err != nil {
+		if config.destinationName != "" {
+			return nil, fmt.Errorf("%s: %w", config.destinationName, err)
+		}
+		return nil, err
+	}
+	// The bytes are counted, and taken from MaxUploadBytes, as sent, after
+	// encryption and per chunk.
+	if config.bench {
+		config.Uploader = benchUploader{Uploader: config.Uploader, stats: config.Stats}
+	}
+	if config.uploadBytes != nil {
+		config.Uploader = budgetUploader{Uploader: config.Uploader, budget: config.uploadBytes}
+	}
+	if config.EncryptUploads {
+		encryptor, err := newEncryptor(os.Getenv(passphraseEnv))
+		if err != nil {
+			_ = config.Uploader.Close()
+			return nil, fmt.Errorf("failed to set up encryption: %v", err)
+		}
+		config.Uploader = encryptingUploader{Uploader: config.Uploader, encryptor: encryptor}
+	}
+	if concurrencyLimit != nil {
+		config.Uploader = limitedUploader{config.Uploader}
+	}
+	if config.ChunkedUpload {
+		// Each part is a transfer of its own, encrypted and holding a slot of
+		// the concurrency limit on its own.
+		config.Uploader = chunkingUploader{Uploader: config.Uploader, config: &config}
+	}
+	if config.LogUploadProgress {
+		config.Uploader.SetProgress(newProgressLogger().log)
+	}
+	return &config, nil
+}
+
+// connectDestinations connects to every destination of config. A destination
+// that cannot be reached is logged and left out, with its error returned.
+func connectDestinations(ctx context.Context, config Config) ([]*Config, []error) {
+	var connected []*Config
+	var errs []error
+	for _, destination := range destinationConfigs(config) {
+		destination, err := connectDestination(ctx, destination)
+		if err != nil {
+			log.Printf("Failed to connect to the upload destination: %v", err)
+			errs = append(errs, err)
+			continue
+		}
+		connected = append(connected, destination)
+	}
+	return connected, errs
+}
+
+// uploadToDestination uploads the outputs of every resolution to the
+// destination connected by connectDestination.
+func uploadToDestination(ctx context.Context, config *Config) {
+	if config.destinationName != "" {
+		log.Printf("Uploading to %s...", config.destinationName)
+	}
+
+	// The per-resolution configurations are derived from config so they share
+	// its connection.
+	for _, variant := range resolutionConfigs(*config) {
+		if config.ResumeFromCheckpoint {
+			variant.checkpoint = loadCheckpoint(variant)
+		}
+		uploadOutputs(ctx, &variant)
+	}
+}
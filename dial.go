@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"golang.org/x/net/proxy"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SOCKS5Proxy is a SOCKS5 proxy the FTP connections are dialed through.
+type SOCKS5Proxy struct {
+	Address  string `json:"address"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+// unresolvedHost is what the FTP client takes as the server's address when the
+// control connection was dialed by name through the proxy, see proxiedConn.
+var unresolvedHost = net.IP(nil).String()
+
+// ftpDialer opens the connections of one FTP session. The first connection it
+// dials is the control connection, every later one is a data connection. Dialing
+// them ourselves lets the program apply its own timeouts and put a deadline on
+// each transfer, which the FTP client does not support.
+type ftpDialer struct {
+	// ctx aborts the dial of the control connection once it is done. The data
+	// connections are dialed without it, as the session may outlive it, like the
+	// sessions opened with connect_during_generation; abortTransfers breaks them
+	// off instead.
+	ctx       context.Context
+	netDialer net.Dialer
+	// socks5 is set when the connections go through a SOCKS5 proxy.
+	socks5 proxy.ContextDialer
+	// tlsConfig is set for FTPS. Data connections are always wrapped in TLS then,
+	// the control connection only for implicit FTPS; explicit FTPS upgrades it
+	// with AUTH TLS inside the FTP client.
+	tlsConfig *tls.Config
+	implicit  bool
+	// account is answered to the server's request for one, see accountConn.
+	account string
+	// active opens the data connections in active mode, see activeConn, on a
+	// local port from activePortMin to activePortMax when they are set.
+	active        bool
+	activePortMin int
+	activePortMax int
+
+	mu            sync.Mutex
+	controlDialed bool
+	controlHost   string
+	dataDeadline  time.Time
+	// control and data are the control connection and the latest data
+	// connection, which abortTransfers breaks off. Once aborted is set, the
+	// session is unusable and no further data connection is opened.
+	control net.Conn
+	data    net.Conn
+	aborted bool
+	// activeListener listens for the data connection about to be dialed in
+	// active mode.
+	activeListener *net.TCPListener
+	// controlTLS is the state of the first TLS handshake of the session, that of
+	// the control connection.
+	controlTLS *tls.ConnectionState
+	// tlsHandshakes counts the TLS handshakes of the session, tlsResumed those
+	// that resumed an earlier session.
+	tlsHandshakes int
+	tlsResumed    int
+}
+
+// ftpHost returns FTPHost without the brackets an IPv6 address may be written
+// with, such as "[::1]".
+func ftpHost(config *Config) string {
+	return strings.TrimSuffix(strings.TrimPrefix(config.FTPHost, "["), "]")
+}
+
+// ftpAddress returns the host:port address of the FTP server. IPv6 addresses
+// are bracketed, as in "[::1]:21". The data connections are dialed over the
+// address family of the control connection, with EPSV, since PASV can only
+// announce IPv4 addresses.
+func ftpAddress(config *Config) string {
+	return net.JoinHostPort(ftpHost(config), strconv.Itoa(config.FTPPort))
+}
+
+// newFTPDialer returns a dialer for a single FTP session.
+func newFTPDialer(ctx context.Context, config *Config, tlsConfig *tls.Config) (*ftpDialer, error) {
+	d := &ftpDialer{
+		ctx:       ctx,
+		netDialer: net.Dialer{Timeout: time.Duration(config.DialTimeout) * time.Second},
+		implicit:  config.FTPTLS == "implicit",
+		account:   config.FTPAccount,
+		active:    !config.FTPPassive,
+
+		activePortMin: config.FTPActivePortMin,
+		activePortMax: config.FTPActivePortMax,
+	}
+	if tlsConfig != nil {
+		// The FTP client must be given this configuration for explicit FTPS, as
+		// it performs that handshake itself.
+		d.tlsConfig = tlsConfig.Clone()
+		verify := tlsConfig.VerifyConnection
+		d.tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if verify != nil {
+				if err := verify(state); err != nil {
+					return err
+				}
+			}
+			return d.recordTLS(state)
+		}
+	}
+	if config.SOCKS5Proxy.Address != "" {
+		var auth *proxy.Auth
+		if config.SOCKS5Proxy.User != "" {
+			auth = &proxy.Auth{User: config.SOCKS5Proxy.User, Password: config.SOCKS5Proxy.Password}
+		}
+		socks5, err := proxy.SOCKS5("tcp", config.SOCKS5Proxy.Address, auth, &d.netDialer)
+		if err != nil {
+			return nil, fmt.Errorf("invalid socks5_proxy: %v", err)
+		}
+		// The SOCKS5 dialer of the proxy package dials with a context as well.
+		d.socks5 = socks5.(proxy.ContextDialer)
+	}
+	return d, nil
+}
+
+// dial implements the dial function passed to ftp.DialWithDialFunc.
+func (d *ftpDialer) dial(network string, address string) (net.Conn, error) {
+	d.mu.Lock()
+	control := !d.controlDialed
+	d.controlDialed = true
+	deadline := d.dataDeadline
+	controlHost := d.controlHost
+	d.mu.Unlock()
+
+	dialCtx := context.Background()
+	if control {
+		dialCtx = d.ctx
+	}
+	var conn net.Conn
+	var err error
+	if !control && d.active {
+		conn, err = d.acceptActive()
+	} else if d.socks5 != nil {
+		conn, err = d.dialProxy(dialCtx, network, address, control, controlHost)
+	} else {
+		conn, err = d.netDialer.DialContext(dialCtx, network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !control && !deadline.IsZero() {
+		err = conn.SetDeadline(deadline)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+
+	if d.tlsConfig != nil && (!control || d.implicit) {
+		conn = tls.Client(conn, d.tlsConfig)
+	}
+	if control && d.account != "" {
+		conn = newAccountConn(conn, d.account)
+	}
+	if control && d.active {
+		conn = newActiveConn(conn, d)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.aborted {
+		_ = conn.Close()
+		return nil, errTransferAborted
+	}
+	if control {
+		d.control = conn
+	} else {
+		d.data = conn
+	}
+	return conn, nil
+}
+
+// errTransferAborted fails the data connections of a session whose transfer was
+// aborted by abortTransfers.
+var errTransferAborted = errors.New("transfer aborted")
+
+// abortTransfers breaks off the transfer about to start on the session once ctx
+// is done, by setting a deadline in the past on the control connection and on
+// the data connection. Checking ctx between reads of the uploaded content does
+// not interrupt a transfer blocked writing to the server or waiting for its
+// reply. The returned function stops watching ctx once the transfer is over.
+func (d *ftpDialer) abortTransfers(ctx context.Context) (stop func() bool) {
+	return context.AfterFunc(ctx, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.aborted = true
+		now := time.Now()
+		if d.control != nil {
+			_ = d.control.SetDeadline(now)
+		}
+		if d.data != nil {
+			_ = d.data.SetDeadline(now)
+		}
+	})
+}
+
+// listenActive listens for the next data connection in active mode, on the
+// local address of the control connection, local.
+func (d *ftpDialer) listenActive(local net.Addr) (*net.TCPListener, error) {
+	host, _, err := net.SplitHostPort(local.String())
+	if err != nil {
+		return nil, err
+	}
+	d.closeActive()
+	listener, err := listenPortRange(host, d.activePortMin, d.activePortMax)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.activeListener = listener
+	return listener, nil
+}
+
+// closeActive stops listening for a data connection that will not be dialed.
+func (d *ftpDialer) closeActive() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.activeListener != nil {
+		_ = d.activeListener.Close()
+		d.activeListener = nil
+	}
+}
+
+// acceptActive returns the data connection the server opens to the listener of
+// listenActive, accepted on first use.
+func (d *ftpDialer) acceptActive() (net.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.activeListener == nil {
+		return nil, errors.New("no active mode data connection was requested from the server")
+	}
+	host, _, err := net.SplitHostPort(d.control.RemoteAddr().String())
+	if err != nil {
+		return nil, err
+	}
+	conn := &activeDataConn{listener: d.activeListener, serverIP: net.ParseIP(host)}
+	d.activeListener = nil
+	return conn, nil
+}
+
+// recordTLS keeps the state of the first TLS handshake of the session and
+// counts the handshakes that resumed a session. It is installed as
+// VerifyConnection, which runs on resumed handshakes too, after the check of
+// the pinned certificate, if any.
+func (d *ftpDialer) recordTLS(state tls.ConnectionState) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.controlTLS == nil {
+		d.controlTLS = &state
+	}
+	d.tlsHandshakes++
+	if state.DidResume {
+		d.tlsResumed++
+	}
+	return nil
+}
+
+// tlsResumption returns the number of TLS handshakes of the session and how
+// many of them resumed an earlier session.
+func (d *ftpDialer) tlsResumption() (handshakes int, resumed int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.tlsHandshakes, d.tlsResumed
+}
+
+// tlsState returns the negotiated TLS state of the control connection, or nil
+// for plain FTP.
+func (d *ftpDialer) tlsState() *tls.ConnectionState {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.controlTLS
+}
+
+// logTLSResumption logs at debug level how many TLS handshakes of the session
+// resumed an earlier session, for diagnosing servers that refuse resumption.
+func (d *ftpDialer) logTLSResumption() {
+	handshakes, resumed := d.tlsResumption()
+	if handshakes > 0 {
+		debugf("FTP session ended, %d of %d TLS handshakes resumed a session", resumed, handshakes)
+	}
+}
+
+// setDataDeadline sets the deadline applied to data connections dialed from now
+// on. A zero time removes the deadline.
+func (d *ftpDialer) setDataDeadline(deadline time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dataDeadline = deadline
+}
+
+// dialProxy dials address through the SOCKS5 proxy. The FTP client takes the
+// server's IP from the remote address of the control connection and dials it
+// for EPSV data connections, so the control connection reports the FTP server's
+// address rather than the proxy's. When the server was given by name, which the
+// proxy resolves, the data connections are dialed by that name as well.
+func (d *ftpDialer) dialProxy(ctx context.Context, network string, address string, control bool, controlHost string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if !control && host == unresolvedHost {
+		address = net.JoinHostPort(controlHost, port)
+	}
+
+	conn, err := d.socks5.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s through the SOCKS5 proxy: %w", address, err)
+	}
+	if !control {
+		return conn, nil
+	}
+
+	d.mu.Lock()
+	d.controlHost = host
+	d.mu.Unlock()
+	portNumber, _ := net.LookupPort(network, port)
+	return &proxiedConn{Conn: conn, remoteAddr: &net.TCPAddr{IP: net.ParseIP(host), Port: portNumber}}, nil
+}
+
+// proxiedConn is a connection dialed through the proxy that reports the address
+// it was dialed to as its remote address.
+type proxiedConn struct {
+	net.Conn
+	remoteAddr *net.TCPAddr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// ftpResponder is a minimal FTP server for the tests. It accepts one session,
+// logs in any user, opens data connections with EPSV, or connects to the
+// address of PORT or EPRT, and keeps what is stored, which may be renamed,
+// deleted and asked for its size.
+type ftpResponder struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	commands []string
+	stored   map[string]string
+	// active is the address of the last PORT or EPRT command.
+	active string
+	// renameReply, when set, is the reply to the next RNTO, which then does not
+	// rename the file.
+	renameReply string
+}
+
+// newFTPResponder starts a responder listening on the TCP network and address.
+func newFTPResponder(t *testing.T, network string, address string) (*ftpResponder, error) {
+	t.Helper()
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	r := &ftpResponder{listener: listener, stored: make(map[string]string)}
+	t.Cleanup(func() { _ = listener.Close() })
+	go r.serve(t)
+	return r, nil
+}
+
+func (r *ftpResponder) serve(t *testing.T) {
+	conn, err := r.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	reply := func(line string) { _, _ = fmt.Fprintf(conn, "%s\r\n", line) }
+
+	var data net.Listener
+	var active string
+	var renameFrom string
+	defer func() {
+		if data != nil {
+			_ = data.Close()
+		}
+	}()
+	reply("220 ready")
+	lines := bufio.NewScanner(conn)
+	for lines.Scan() {
+		command, arg, _ := strings.Cut(lines.Text(), " ")
+		command = strings.ToUpper(command)
+		r.mu.Lock()
+		r.commands = append(r.commands, command)
+		r.mu.Unlock()
+
+		switch command {
+		case "USER":
+			reply("331 password required")
+		case "PASS":
+			reply("230 logged in")
+		case "TYPE":
+			reply("200 type set")
+		case "EPSV":
+			// The data connection is offered on the address of the control
+			// connection, as a server would.
+			host, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+			data, err = net.Listen("tcp", net.JoinHostPort(host, "0"))
+			if err != nil {
+				t.Errorf("failed to listen for the data connection: %v", err)
+				reply("425 cannot open data connection")
+				continue
+			}
+			reply(fmt.Sprintf("229 Entering Extended Passive Mode (|||%d|)", data.Addr().(*net.TCPAddr).Port))
+		case "PORT":
+			var h [4]int
+			var p1, p2 int
+			_, err = fmt.Sscanf(arg, "%d,%d,%d,%d,%d,%d", &h[0], &h[1], &h[2], &h[3], &p1, &p2)
+			if err != nil {
+				reply("501 invalid PORT")
+				continue
+			}
+			active = net.JoinHostPort(fmt.Sprintf("%d.%d.%d.%d", h[0], h[1], h[2], h[3]), strconv.Itoa(p1<<8|p2))
+			r.setActive(active)
+			reply("200 PORT accepted")
+		case "EPRT":
+			fields := strings.Split(arg, "|")
+			if len(fields) != 5 {
+				reply("501 invalid EPRT")
+				continue
+			}
+			active = net.JoinHostPort(fields[2], fields[3])
+			r.setActive(active)
+			reply("200 EPRT accepted")
+		case "STOR":
+			if data == nil && active == "" {
+				reply("425 use EPSV, PORT or EPRT first")
+				continue
+			}
+			reply("150 opening data connection")
+			var dataConn net.Conn
+			if active != "" {
+				dataConn, err = net.Dial("tcp", active)
+			} else {
+				dataConn, err = data.Accept()
+			}
+			if err != nil {
+				reply("425 cannot open data connection")
+				continue
+			}
+			content, _ := io.ReadAll(dataConn)
+			_ = dataConn.Close()
+			if data != nil {
+				_ = data.Close()
+			}
+			data = nil
+			active = ""
+			r.mu.Lock()
+			r.stored[arg] = string(content)
+			r.mu.Unlock()
+			reply("226 transfer complete")
+		case "SIZE":
+			r.mu.Lock()
+			content, ok := r.stored[arg]
+			r.mu.Unlock()
+			if !ok {
+				reply("550 no such file")
+				continue
+			}
+			reply(fmt.Sprintf("213 %d", len(content)))
+		case "DELE":
+			r.mu.Lock()
+			delete(r.stored, arg)
+			r.mu.Unlock()
+			reply("250 deleted")
+		case "RNFR":
+			renameFrom = arg
+			reply("350 ready for RNTO")
+		case "RNTO":
+			r.mu.Lock()
+			if r.renameReply != "" {
+				reply(r.renameReply)
+				r.renameReply = ""
+			} else {
+				r.stored[arg] = r.stored[renameFrom]
+				delete(r.stored, renameFrom)
+				reply("250 renamed")
+			}
+			r.mu.Unlock()
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+// setActive records the address of a PORT or EPRT command.
+func (r *ftpResponder) setActive(addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.active = addr
+}
+
+// received returns the commands received so far.
+func (r *ftpResponder) received() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.commands...)
+}
+
+// TestDialFTPIPv6 connects to a server on the IPv6 loopback address, written
+// with and without brackets, and checks that the address is dialed bracketed
+// and that the data connection is opened with EPSV, as PASV only announces IPv4
+// addresses.
+func TestDialFTPIPv6(t *testing.T) {
+	for _, host := range []string{"::1", "[::1]"} {
+		t.Run(host, func(t *testing.T) {
+			server, err := newFTPResponder(t, "tcp6", "[::1]:0")
+			if err != nil {
+				t.Skipf("IPv6 is not available: %v", err)
+			}
+			port := server.listener.Addr().(*net.TCPAddr).Port
+
+			config := defaultConfig()
+			config.FTPHost = host
+			config.FTPPort = port
+			config.FTPUser = "user"
+			config.FTPPassword = "password"
+			want := "[::1]:" + strconv.Itoa(port)
+			if addr := ftpAddress(&config); addr != want {
+				t.Fatalf("ftpAddress = %q, want %q", addr, want)
+			}
+
+			err = establishFTPConnection(context.Background(), &config)
+			if err != nil {
+				t.Fatalf("establishFTPConnection: %v", err)
+			}
+			defer func() { _ = config.FTPConn.Quit() }()
+			if addr := config.ftpDialer.control.RemoteAddr().String(); addr != want {
+				t.Errorf("control connection dialed to %q, want %q", addr, want)
+			}
+			err = config.FTPConn.Stor("probe.txt", strings.NewReader("probe"))
+			if err != nil {
+				t.Fatalf("STOR: %v", err)
+			}
+
+			commands := server.received()
+			var epsv bool
+			for _, command := range commands {
+				switch command {
+				case "EPSV":
+					epsv = true
+				case "PASV":
+					t.Errorf("data connection opened with PASV, commands %v", commands)
+				}
+			}
+			if !epsv {
+				t.Errorf("data connection not opened with EPSV, commands %v", commands)
+			}
+			server.mu.Lock()
+			defer server.mu.Unlock()
+			if content := server.stored["probe.txt"]; content != "probe" {
+				t.Errorf("stored %q, want %q", content, "probe")
+			}
+		})
+	}
+}
+
+// TestDialFTPActive uploads in active mode, over IPv4 with PORT and over IPv6,
+// when available, with EPRT, and checks that the server connects back to a port
+// of ftp_active_port_min/max.
+func TestDialFTPActive(t *testing.T) {
+	for _, test := range []struct {
+		network string
+		host    string
+		command string
+	}{
+		{"tcp4", "127.0.0.1", "PORT"},
+		{"tcp6", "::1", "EPRT"},
+	} {
+		t.Run(test.command, func(t *testing.T) {
+			server, err := newFTPResponder(t, test.network, net.JoinHostPort(test.host, "0"))
+			if err != nil {
+				t.Skipf("%s is not available: %v", test.network, err)
+			}
+
+			config := defaultConfig()
+			config.FTPHost = test.host
+			config.FTPPort = server.listener.Addr().(*net.TCPAddr).Port
+			config.FTPUser = "user"
+			config.FTPPassword = "password"
+			config.FTPPassive = false
+			config.FTPActivePortMin = 50000
+			config.FTPActivePortMax = 50999
+
+			err = establishFTPConnection(context.Background(), &config)
+			if err != nil {
+				t.Fatalf("establishFTPConnection: %v", err)
+			}
+			defer func() { _ = config.FTPConn.Quit() }()
+			err = config.FTPConn.Stor("probe.txt", strings.NewReader("probe"))
+			if err != nil {
+				t.Fatalf("STOR: %v", err)
+			}
+
+			commands := server.received()
+			var sent bool
+			for _, command := range commands {
+				switch command {
+				case test.command:
+					sent = true
+				case "EPSV", "PASV":
+					t.Errorf("%s sent to the server in active mode, commands %v", command, commands)
+				}
+			}
+			if !sent {
+				t.Errorf("%s not sent, commands %v", test.command, commands)
+			}
+			server.mu.Lock()
+			defer server.mu.Unlock()
+			_, port, _ := net.SplitHostPort(server.active)
+			if p, _ := strconv.Atoi(port); p < config.FTPActivePortMin || p > config.FTPActivePortMax {
+				t.Errorf("server connected back to %s, outside ports %d-%d", server.active, config.FTPActivePortMin, config.FTPActivePortMax)
+			}
+			if content := server.stored["probe.txt"]; content != "probe" {
+				t.Errorf("stored %q, want %q", content, "probe")
+			}
+		})
+	}
+}
+
+// TestDialFTPOutlivesContext checks that a session keeps opening data
+// connections once the context it was connected with is done, as the sessions
+// connected during the generation are.
+func TestDialFTPOutlivesContext(t *testing.T) {
+	server, err := newFTPResponder(t, "tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := defaultConfig()
+	config.FTPHost = "127.0.0.1"
+	config.FTPPort = server.listener.Addr().(*net.TCPAddr).Port
+	config.FTPUser = "user"
+	config.FTPPassword = "password"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err = establishFTPConnection(ctx, &config)
+	cancel()
+	if err != nil {
+		t.Fatalf("establishFTPConnection: %v", err)
+	}
+	defer func() { _ = config.FTPConn.Quit() }()
+	err = config.FTPConn.Stor("probe.txt", strings.NewReader("probe"))
+	if err != nil {
+		t.Fatalf("STOR after the connect context is done: %v", err)
+	}
+}
+
+// TestDialerVerifiesPin checks that the dialer keeps the check of the pinned
+// certificate when it records the TLS state, on full and resumed handshakes.
+func TestDialerVerifiesPin(t *testing.T) {
+	leaf := &x509.Certificate{Raw: []byte("pinned server certificate")}
+	sum := sha256.Sum256(leaf.Raw)
+	config := Config{FTPHost: "127.0.0.1", FTPTLSSessionCache: true, PinnedCertSHA256: hex.EncodeToString(sum[:])}
+	tlsConfig, err := ftpTLSConfig(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.ClientSessionCache == tlsSessionCache {
+		t.Error("a pinned configuration shares the session cache of the CA verified ones")
+	}
+	dialer, err := newFTPDialer(context.Background(), &config, tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, resumed := range []bool{false, true} {
+		other := &x509.Certificate{Raw: []byte("other server certificate")}
+		state := tls.ConnectionState{DidResume: resumed, PeerCertificates: []*x509.Certificate{other}}
+		if err := dialer.tlsConfig.VerifyConnection(state); err == nil {
+			t.Errorf("resumed=%v: accepted a certificate that does not match the pin", resumed)
+		}
+		state.PeerCertificates = []*x509.Certificate{leaf}
+		if err := dialer.tlsConfig.VerifyConnection(state); err != nil {
+			t.Errorf("resumed=%v: rejected the pinned certificate: %v", resumed, err)
+		}
+	}
+	if handshakes, resumed := dialer.tlsResumption(); handshakes != 2 || resumed != 1 {
+		t.Errorf("recorded %d handshakes, %d resumed; want 2, 1", handshakes, resumed)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// flexDuration is a duration given in the configuration either as a Go duration
+// string such as "1500ms" or "5s", or, as in older configurations, as a number
+// of seconds.
+type flexDuration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *flexDuration) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte(`"`)) {
+		var s string
+		err := json.Unmarshal(data, &s)
+		if err != nil {
+			return err
+		}
+		parsed, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q, use a number of seconds or a duration such as \"1500ms\" or \"5s\"", s)
+		}
+		*d = flexDuration(parsed)
+		return nil
+	}
+
+	var seconds float64
+	err := json.Unmarshal(data, &seconds)
+	if err != nil {
+		return fmt.Errorf("invalid duration %s, use a number of seconds or a duration such as \"1500ms\" or \"5s\"", data)
+	}
+	*d = flexDuration(seconds * float64(time.Second))
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler, writing the duration as a string.
+func (d flexDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// String returns the duration in Go's notation, such as "1.5s".
+func (d flexDuration) String() string {
+	return time.Duration(d).String()
+}
+
+// Seconds returns the duration as a floating point number of seconds.
+func (d flexDuration) Seconds() float64 {
+	return time.Duration(d).Seconds()
+}
+
+// rate returns the frequency of one event per d as a reduced fraction of
+// integers, as ffmpeg's fps filter expects it: "2/3" for 1500ms, "1/5" for 5s.
+func (d flexDuration) rate() string {
+	num, den := int64(time.Second), int64(d)
+	for a, b := num, den; ; {
+		if b == 0 {
+			num, den = num/a, den/a
+			break
+		}
+		a, b = b, a%b
+	}
+	return fmt.Sprintf("%d/%d", num, den)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Encrypted files are written in the following format, so that they can be
+// decrypted with -decrypt or by any tool implementing it:
+//
+//	header: "FDGENC" | version (1 byte, 1) | PBKDF2 iterations (uint32) |
+//	        salt (16 bytes) | file nonce (16 bytes) | chunk size (uint32)
+//	chunks: the plaintext in chunks of chunk size bytes, each sealed with
+//	        AES-256-GCM and followed by its 16-byte tag
+//
+// Integers are big-endian. The master key is PBKDF2-HMAC-SHA256 of the
+// passphrase with the salt, and the file key HKDF-SHA256 of the master key with
+// the file nonce as salt and "FTPDataGenerator file key" as info. Chunk i is
+// sealed with the nonce i as an 11-byte big-endian counter followed by 1 for the
+// last chunk and 0 otherwise, and the header as additional data, so that
+// truncated or reordered files are rejected. An empty file has one empty chunk.
+const (
+	encryptionMagic      = "FDGENC"
+	encryptionVersion    = 1
+	encryptionIterations = 600000
+	encryptionChunkSize  = 64 * 1024
+	encryptionHeaderSize = len(encryptionMagic) + 1 + 4 + 16 + 16 + 4
+	encryptionTagSize    = 16
+	encryptionKeyInfo    = "FTPDataGenerator file key"
+
+	// passphraseEnv names the environment variable holding the passphrase.
+	passphraseEnv = "FTPDATAGENERATOR_PASSPHRASE"
+	// encryptedSuffix is appended to the remote name of encrypted files.
+	encryptedSuffix = ".enc"
+)
+
+// encryptor encrypts files with a master key derived once per run from the
+// passphrase, so that the slow key derivation is not repeated for every file.
+type encryptor struct {
+	salt   []byte
+	master []byte
+}
+
+// newEncryptor derives the master key of passphrase with a new random salt.
+func newEncryptor(passphrase string) (*encryptor, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	master, err := pbkdf2.Key(sha256.New, passphrase, salt, encryptionIterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptor{salt: salt, master: master}, nil
+}
+
+// fileCipher returns the AES-GCM cipher of the file with the given nonce.
+func fileCipher(master []byte, fileNonce []byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, master, fileNonce, encryptionKeyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the GCM nonce of chunk i.
+func chunkNonce(i uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], i)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptedSize returns the size of the encrypted form of size bytes.
+func encryptedSize(size int64) int64 {
+	chunks := max((size+encryptionChunkSize-1)/encryptionChunkSize, 1)
+	return int64(encryptionHeaderSize) + size + chunks*encryptionTagSize
+}
+
+// uploadedSize returns the size a local file of size bytes has on the server.
+func uploadedSize(config Config, size int64) int64 {
+	if config.EncryptUploads {
+		return encryptedSize(size)
+	}
+	return size
+}
+
+// reader returns a reader of the encrypted form of r.
+func (e *encryptor) reader(r io.Reader) (io.Reader, error) {
+	fileNonce := make([]byte, 16)
+	_, err := rand.Read(fileNonce)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := fileCipher(e.master, fileNonce)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, encryptionHeaderSize)
+	header = append(header, encryptionMagic...)
+	header = append(header, encryptionVersion)
+	header = binary.BigEndian.AppendUint32(header, encryptionIterations)
+	header = append(header, e.salt...)
+	header = append(header, fileNonce...)
+	header = binary.BigEndian.AppendUint32(header, encryptionChunkSize)
+
+	return &encryptReader{
+		src:     bufio.NewReaderSize(r, encryptionChunkSize+1),
+		aead:    aead,
+		header:  header,
+		pending: header,
+		chunk:   make([]byte, encryptionChunkSize),
+	}, nil
+}
+
+// encryptReader encrypts its source chunk by chunk as it is read.
+type encryptReader struct {
+	src     *bufio.Reader
+	aead    cipher.AEAD
+	header  []byte
+	pending []byte
+	chunk   []byte
+	index   uint64
+	done    bool
+}
+
+func (r *encryptReader) Read(b []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(r.src, r.chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		_, peekErr := r.src.Peek(1)
+		last := peekErr != nil
+		if last && peekErr != io.EOF {
+			return 0, peekErr
+		}
+		r.pending = r.aead.Seal(nil, chunkNonce(r.index, last), r.chunk[:n], r.header)
+		r.index++
+		r.done = last
+	}
+	n := copy(b, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// decrypt writes the plaintext of the encrypted stream r to w.
+func decrypt(w io.Writer, r io.Reader, passphrase string) error {
+	header := make([]byte, encryptionHeaderSize)
+	_, err := io.ReadFull(r, header)
+	if err != nil || !bytes.HasPrefix(header, []byte(encryptionMagic)) {
+		return errors.New("not a file encrypted by this program")
+	}
+	fields := header[len(encryptionMagic):]
+	if fields[0] != encryptionVersion {
+		return fmt.Errorf("unsupported encryption version %d", fields[0])
+	}
+	iterations := binary.BigEndian.Uint32(fields[1:5])
+	salt := fields[5:21]
+	fileNonce := fields[21:37]
+	chunkSize := binary.BigEndian.Uint32(fields[37:41])
+
+	master, err := pbkdf2.Key(sha256.New, passphrase, salt, int(iterations), 32)
+	if err != nil {
+		return err
+	}
+	aead, err := fileCipher(master, fileNonce)
+	if err != nil {
+		return err
+	}
+
+	src := bufio.NewReaderSize(r, int(chunkSize)+encryptionTagSize+1)
+	sealed := make([]byte, int(chunkSize)+encryptionTagSize)
+	for i := uint64(0); ; i++ {
+		n, err := io.ReadFull(src, sealed)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		_, peekErr := src.Peek(1)
+		last := peekErr != nil
+		plain, err := aead.Open(nil, chunkNonce(i, last), sealed[:n], header)
+		if err != nil {
+			return fmt.Errorf("chunk %d cannot be decrypted, the passphrase is wrong or the file is damaged or truncated", i)
+		}
+		_, err = w.Write(plain)
+		if err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// decryptFile writes the plaintext of the encrypted file to standard output,
+// for the -decrypt flag.
+func decryptFile(file string) error {
+	passphrase := os.Getenv(passphraseEnv)
+	if passphrase == "" {
+		return fmt.Errorf("set the passphrase in the %s environment variable", passphraseEnv)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(os.Stdout)
+	err = decrypt(w, f, passphrase)
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// encryptingUploader encrypts every file before handing it to its Uploader,
+// which stores it under the remote name with encryptedSuffix appended.
+type encryptingUploader struct {
+	Uploader
+	encryptor *encryptor
+}
+
+func (u encryptingUploader) Upload(ctx context.Context, sourceFile string, targetFile string) error {
+	f, err := os.Open(sourceFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return u.UploadReader(ctx, f, targetFile)
+}
+
+// Append uploads the whole file, as an encrypted file cannot be extended.
+func (u encryptingUploader) Append(ctx context.Context, sourceFile string, targetFile string) error {
+	return u.Upload(ctx, sourceFile, targetFile)
+}
+
+func (u encryptingUploader) UploadReader(ctx context.Context, r io.Reader, targetFile string) error {
+	encrypted, err := u.encryptor.reader(r)
+	if err != nil {
+		return fmt.Errorf("failed to set up encryption: %v", err)
+	}
+	return u.Uploader.UploadReader(ctx, encrypted, targetFile+encryptedSuffix)
+}
+
+func (u encryptingUploader) Unchanged(sourceFile string, targetFile string) bool {
+	return u.Uploader.Unchanged(sourceFile, targetFile+encryptedSuffix)
+}
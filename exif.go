@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// exifHeader starts the payload of the APP1 segment holding EXIF in a JPEG file.
+var exifHeader = []byte("Exif\x00\x00")
+
+// The EXIF tags written by EmbedExif, and the TIFF types of their values.
+const (
+	exifTagModel            = 0x0110
+	exifTagExifIFD          = 0x8769
+	exifTagGPSIFD           = 0x8825
+	exifTagDateTimeOriginal = 0x9003
+	exifTagOffsetOriginal   = 0x9011
+	exifTagGPSVersion       = 0x0000
+	exifTagGPSLatitudeRef   = 0x0001
+	exifTagGPSLatitude      = 0x0002
+	exifTagGPSLongitudeRef  = 0x0003
+	exifTagGPSLongitude     = 0x0004
+
+	exifTypeByte     = 1
+	exifTypeASCII    = 2
+	exifTypeLong     = 4
+	exifTypeRational = 5
+)
+
+// exifEntry is an entry of an image file directory: a tag and its value, in
+// big-endian byte order.
+type exifEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// exifASCII returns the entry of a NUL-terminated ASCII value.
+func exifASCII(tag uint16, s string) exifEntry {
+	return exifEntry{tag, exifTypeASCII, uint32(len(s) + 1), append([]byte(s), 0)}
+}
+
+// exifDegrees returns the entry of a GPS coordinate as degrees, minutes and
+// seconds, the seconds to a thousandth.
+func exifDegrees(tag uint16, degrees float64) exifEntry {
+	ms := uint32(math.Round(math.Abs(degrees) * 3600 * 1000))
+	value := make([]byte, 0, 24)
+	for _, rational := range [][2]uint32{{ms / 3600000, 1}, {ms / 60000 % 60, 1}, {ms % 60000, 1000}} {
+		value = binary.BigEndian.AppendUint32(value, rational[0])
+		value = binary.BigEndian.AppendUint32(value, rational[1])
+	}
+	return exifEntry{tag, exifTypeRational, 3, value}
+}
+
+// exifIFDSize returns the size of the directory of entries with the values
+// that do not fit in their entry.
+func exifIFDSize(entries []exifEntry) int {
+	size := 2 + 12*len(entries) + 4
+	for _, entry := range entries {
+		if len(entry.value) > 4 {
+			size += len(entry.value) + len(entry.value)%2
+		}
+	}
+	return size
+}
+
+// appendExifIFD appends the directory of entries, sorted by tag, written at
+// offset in the TIFF data, followed by the values that do not fit in their entry.
+func appendExifIFD(b []byte, offset int, entries []exifEntry) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(entries)))
+	var values []byte
+	valueOffset := offset + 2 + 12*len(entries) + 4
+	for _, entry := range entries {
+		b = binary.BigEndian.AppendUint16(b, entry.tag)
+		b = binary.BigEndian.AppendUint16(b, entry.typ)
+		b = binary.BigEndian.AppendUint32(b, entry.count)
+		if len(entry.value) <= 4 {
+			b = append(b, entry.value...)
+			b = append(b, make([]byte, 4-len(entry.value))...)
+			continue
+		}
+		b = binary.BigEndian.AppendUint32(b, uint32(valueOffset+len(values)))
+		values = append(values, entry.value...)
+		if len(entry.value)%2 == 1 {
+			values = append(values, 0)
+		}
+	}
+	b = binary.BigEndian.AppendUint32(b, 0)
+	return append(b, values...)
+}
+
+// exifData returns the TIFF data of the EXIF written by EmbedExif for a snapshot
+// taken at taken: the camera model, if any, and pointers to the EXIF directory
+// with the time, in UTC, and to the GPS directory with the position.
+func exifData(config Config, taken time.Time) []byte {
+	var ifd0 []exifEntry
+	if config.ExifCameraModel != "" {
+		ifd0 = append(ifd0, exifASCII(exifTagModel, config.ExifCameraModel))
+	}
+	ifd0 = append(ifd0,
+		exifEntry{exifTagExifIFD, exifTypeLong, 1, nil},
+		exifEntry{exifTagGPSIFD, exifTypeLong, 1, nil})
+	exifIFD := []exifEntry{
+		exifASCII(exifTagDateTimeOriginal, taken.UTC().Format("2006:01:02 15:04:05")),
+		exifASCII(exifTagOffsetOriginal, "+00:00"),
+	}
+	latitudeRef, longitudeRef := "N", "E"
+	if *config.Latitude < 0 {
+		latitudeRef = "S"
+	}
+	if *config.Longitude < 0 {
+		longitudeRef = "W"
+	}
+	gpsIFD := []exifEntry{
+		{exifTagGPSVersion, exifTypeByte, 4, []byte{2, 3, 0, 0}},
+		exifASCII(exifTagGPSLatitudeRef, latitudeRef),
+		exifDegrees(exifTagGPSLatitude, *config.Latitude),
+		exifASCII(exifTagGPSLongitudeRef, longitudeRef),
+		exifDegrees(exifTagGPSLongitude, *config.Longitude),
+	}
+
+	// The directories follow the 8-byte header one after the other.
+	exifOffset := 8 + exifIFDSize(ifd0)
+	gpsOffset := exifOffset + exifIFDSize(exifIFD)
+	ifd0[len(ifd0)-2].value = binary.BigEndian.AppendUint32(nil, uint32(exifOffset))
+	ifd0[len(ifd0)-1].value = binary.BigEndian.AppendUint32(nil, uint32(gpsOffset))
+
+	b := []byte{'M', 'M', 0, 42, 0, 0, 0, 8}
+	b = appendExifIFD(b, 8, ifd0)
+	b = appendExifIFD(b, exifOffset, exifIFD)
+	return appendExifIFD(b, gpsOffset, gpsIFD)
+}
+
+// insertExif returns the JPEG image data with the EXIF tiff in an APP1 segment,
+// replacing the EXIF it had. The segment follows the SOI marker, or the JFIF
+// APP0 segment when there is one, which must come first.
+func insertExif(data []byte, tiff []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, errors.New("not a JPEG file")
+	}
+	payload := append(append([]byte{}, exifHeader...), tiff...)
+	if len(payload)+2 > math.MaxUint16 {
+		return nil, fmt.Errorf("EXIF of %d bytes does not fit in a JPEG segment", len(payload))
+	}
+	exif := append([]byte{0xff, 0xe1}, binary.BigEndian.AppendUint16(nil, uint16(len(payload)+2))...)
+	exif = append(exif, payload...)
+
+	// Only the application segments at the start are looked at, which is where
+	// EXIF is stored.
+	var segments [][]byte
+	i := 2
+	for i+4 <= len(data) && data[i] == 0xff && data[i+1] >= 0xe0 && data[i+1] <= 0xef {
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		if n < 2 || i+2+n > len(data) {
+			return nil, errors.New("truncated JPEG segment")
+		}
+		segment := data[i : i+2+n]
+		i += 2 + n
+		if segment[1] == 0xe1 && bytes.HasPrefix(segment[4:], exifHeader) {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	if len(segments) > 0 && segments[0][1] == 0xe0 {
+		segments = append(segments[:1], append([][]byte{exif}, segments[1:]...)...)
+	} else {
+		segments = append([][]byte{exif}, segments...)
+	}
+
+	out := append(make([]byte, 0, len(data)+len(exif)), 0xff, 0xd8)
+	for _, segment := range segments {
+		out = append(out, segment...)
+	}
+	return append(out, data[i:]...), nil
+}
+
+// embedSnapshotExif writes the EXIF of EmbedExif into the snapshot files, with
+// the time each was written. Only JPEG files carry EXIF here; the snapshots of
+// other formats are left as they are, with a warning.
+func embedSnapshotExif(config Config, files []string) error {
+	switch strings.ToLower(filepath.Ext(snapshotTemplate(config))) {
+	case ".jpg", ".jpeg":
+	default:
+		warnf("embed_exif only applies to JPEG snapshots, the %s snapshots are left without EXIF", filepath.Ext(snapshotTemplate(config)))
+		return nil
+	}
+
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("failed to embed EXIF in '%s': %v", file, err)
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to embed EXIF in '%s': %v", file, err)
+		}
+		data, err = insertExif(data, exifData(config, info.ModTime()))
+		if err != nil {
+			return fmt.Errorf("failed to embed EXIF in '%s': %v", file, err)
+		}
+		err = os.WriteFile(file, data, info.Mode().Perm())
+		if err != nil {
+			return fmt.Errorf("failed to embed EXIF in '%s': %v", file, err)
+		}
+		// The modification time is the creation time of the metadata as well.
+		err = os.Chtimes(file, info.ModTime(), info.ModTime())
+		if err != nil {
+			return fmt.Errorf("failed to embed EXIF in '%s': %v", file, err)
+		}
+	}
+	debugf("Embedded EXIF in %d snapshots", len(files))
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ffmpegLogPrefix starts the names of the ffmpeg log files written with
+// DebugFFmpeg, followed by the name of the command: "ffmpeg-video.log",
+// "ffmpeg-snapshots.log" and so on.
+const ffmpegLogPrefix = "ffmpeg-"
+
+// ffmpegLogFile returns the local path of the log of the ffmpeg command name,
+// in OutputDir, so that every resolution keeps its own logs.
+func ffmpegLogFile(config Config, name string) string {
+	return filepath.Join(config.OutputDir, ffmpegLogPrefix+name+".log")
+}
+
+// createFFmpegLog creates the log file of the ffmpeg command name, replacing the
+// one of an earlier run, and writes the command line to it. ffmpeg's standard
+// output and error follow.
+func createFFmpegLog(config Config, name string, args []string) (*os.File, error) {
+	file, err := os.Create(ffmpegLogFile(config, name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ffmpeg log: %v", err)
+	}
+	_, err = fmt.Fprintf(file, "ffmpeg %s\n\n", strings.Join(args, " "))
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write ffmpeg log: %v", err)
+	}
+	return file, nil
+}
+
+// uploadFFmpegLogs uploads the ffmpeg logs of config next to the snapshots.
+func uploadFFmpegLogs(ctx context.Context, config *Config) {
+	logFiles, err := filepath.Glob(filepath.Join(config.OutputDir, ffmpegLogPrefix+"*.log"))
+	if err != nil {
+		log.Printf("Failed to retrieve ffmpeg logs: %v", err)
+		return
+	}
+	for _, file := range logFiles {
+		if ctx.Err() != nil {
+			log.Println("ffmpeg log upload cancelled.")
+			return
+		}
+		targetFile := filepath.Join(remoteDir(*config), remoteName(*config, filepath.Base(file), file))
+		err = config.Uploader.Upload(ctx, file, targetFile)
+		if err != nil {
+			fileLogf(file, "Failed to upload ffmpeg log '%s': %v", file, err)
+			config.Stats.countFailed(file, err)
+		} else {
+			fileLogf(file, "Uploaded ffmpeg log '%s'", file)
+			config.Stats.countUploaded()
+		}
+	}
+}
+
+// ffmpegLogLevels are the values of FFmpegLogLevel, from the quietest.
+var ffmpegLogLevels = []string{"quiet", "panic", "fatal", "error", "warning", "info", "verbose", "debug", "trace"}
+
+// ffmpegLevelPattern matches a line of ffmpeg run with "-loglevel level+...":
+// the optional "[name @ 0x...] " tags of the component that logged it, the
+// level tag and the message.
+var ffmpegLevelPattern = regexp.MustCompile(`^(?:\[[^\]]* @ [^\]]*\] )*\[(panic|fatal|error|warning|info|verbose|debug|trace)\] (.*)$`)
+
+const (
+	// maxFFmpegWarnings is the number of warnings logged per ffmpeg command;
+	// the remaining ones are only counted.
+	maxFFmpegWarnings = 10
+	// maxFFmpegErrors is the number of error lines kept for the error of a
+	// failed ffmpeg command.
+	maxFFmpegErrors = 5
+)
+
+// ffmpegOutput reads the standard error of the ffmpeg command name line by line.
+// Warnings are logged at warn level; error, fatal and panic lines fail the
+// command, see result. All other lines are ignored.
+type ffmpegOutput struct {
+	name     string
+	partial  []byte
+	warnings int
+	errors   []string
+}
+
+func (o *ffmpegOutput) Write(p []byte) (int, error) {
+	o.partial = append(o.partial, p...)
+	for {
+		// The progress line of the info level ends in a carriage return.
+		end := bytes.IndexAny(o.partial, "\r\n")
+		if end < 0 {
+			return len(p), nil
+		}
+		o.line(string(o.partial[:end]))
+		o.partial = o.partial[end+1:]
+	}
+}
+
+// line handles one line of output.
+func (o *ffmpegOutput) line(line string) {
+	match := ffmpegLevelPattern.FindStringSubmatch(line)
+	if match == nil {
+		return
+	}
+	switch level, message := match[1], match[2]; level {
+	case "warning":
+		o.warnings++
+		if o.warnings <= maxFFmpegWarnings {
+			warnf("ffmpeg %s: %s", o.name, message)
+		}
+	case "error", "fatal", "panic":
+		if len(o.errors) < maxFFmpegErrors {
+			o.errors = append(o.errors, message)
+		}
+	}
+}
+
+// result returns the outcome of the command given the error of its exit: an
+// error when it exited with a non-zero status or logged an error, carrying the
+// first error lines.
+func (o *ffmpegOutput) result(err error) error {
+	if len(o.partial) > 0 {
+		o.line(string(o.partial))
+		o.partial = nil
+	}
+	if o.warnings > maxFFmpegWarnings {
+		warnf("ffmpeg %s: %d more warnings", o.name, o.warnings-maxFFmpegWarnings)
+	}
+	switch {
+	case err != nil && len(o.errors) > 0:
+		return fmt.Errorf("%w: %s", err, strings.Join(o.errors, "; "))
+	case err != nil:
+		return err
+	case len(o.errors) > 0:
+		return fmt.Errorf("ffmpeg reported errors: %s", strings.Join(o.errors, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// createdDirs holds the absolute paths of the directories created by
+// createDirectory during this run. cleanup only ever removes one of them.
+var createdDirs = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: map[string]bool{}}
+
+// recordCreatedDir remembers that dir was created by this run.
+func recordCreatedDir(dir string) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return
+	}
+	createdDirs.Lock()
+	defer createdDirs.Unlock()
+	createdDirs.paths[abs] = true
+}
+
+// safeToRemove returns an error unless dir was created by this run and is not
+// the root directory, the home directory, the working directory or a parent of
+// one of them, so that a misconfigured path can never wipe out user data.
+func safeToRemove(dir string) error {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	abs = filepath.Clean(abs)
+
+	if abs == filepath.VolumeName(abs)+string(filepath.Separator) {
+		return fmt.Errorf("it is the root directory")
+	}
+	var protected []string
+	if home, err := os.UserHomeDir(); err == nil {
+		protected = append(protected, home)
+	}
+	if wd, err := os.Getwd(); err == nil {
+		protected = append(protected, wd)
+	}
+	for _, p := range protected {
+		p = filepath.Clean(p)
+		if p == abs || strings.HasPrefix(p, abs+string(filepath.Separator)) {
+			return fmt.Errorf("it is or contains '%s'", p)
+		}
+	}
+
+	createdDirs.Lock()
+	defer createdDirs.Unlock()
+	if !createdDirs.paths[abs] {
+		return fmt.Errorf("it was not created by this run")
+	}
+	return nil
+}
+
+// makeWorkDir creates a temporary directory for ffmpeg to write into before the
+// results are moved to finalDir. It is created under Config.TempDir when set,
+// otherwise inside finalDir so that the final rename stays on one filesystem.
+func makeWorkDir(config Config, finalDir string) (string, error) {
+	base := config.TempDir
+	if base == "" {
+		base = finalDir
+	}
+	err := createDirectory(base)
+	if err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(base, ".tmp-")
+}
+
+// removeWorkDir removes a directory created by makeWorkDir, logging failures.
+func removeWorkDir(dir string) {
+	err := os.RemoveAll(dir)
+	if err != nil {
+		log.Printf("Failed to remove temporary directory '%s': %v", dir, err)
+	}
+}
+
+// moveFile moves src to dst so that dst only ever appears complete. Across
+// filesystems, where a rename is not possible, src is copied to a temporary file
+// next to dst which is then renamed, and src is removed.
+func moveFile(src string, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	tmp, err := copyToTemp(src, filepath.Dir(dst))
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, dst)
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// copyToTemp copies src to a new temporary file in dir and returns its path.
+func copyToTemp(src string, dir string) (tmpPath string, err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		closeErr := in.Close()
+		if closeErr != nil {
+			log.Printf("Failed to close the file: %v", closeErr)
+		}
+	}()
+
+	out, err := os.CreateTemp(dir, ".tmp-"+filepath.Base(src)+"-")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(out, in)
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(out.Name())
+		return "", fmt.Errorf("failed to copy '%s': %v", src, err)
+	}
+	return out.Name(), nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+)
+
+// fixtureConfig returns the configuration of the fixture preset behind the
+// -fixture flag: a 2-second 160x120 test video, exactly 3 snapshots and their
+// metadata, all written to dir. Every setting that would make the output depend
+// on the time or the host is pinned, so that two runs with the same ffmpeg build
+// write identical bytes: the overlay shows the frame number, ffmpeg leaves out
+// its version strings and runs on one thread, and the metadata omits the file
+// times.
+func fixtureConfig(dir string) Config {
+	config := defaultConfig()
+	config.OutputDir = dir
+	config.TestVideoPath = filepath.Join(dir, "fixture.mp4")
+	config.SnapshotOutputDir = dir
+	config.CsvOutputFile = filepath.Join(dir, "metadata.csv")
+	config.Duration = 2
+	config.Resolution = "160x120"
+	config.FPS = 10
+	config.SnapshotCount = 3
+	config.StrictSnapshotCount = true
+	config.OverlayMode = "frame"
+	config.FFmpegThreads = 1
+	config.FFmpegExtraArgs = []string{"-bitexact"}
+	config.MetadataColumns = []string{"filename", "index", "size", "sha256"}
+	return config
+}
+
+// generateFixture writes the fixture preset to dir without uploading anything,
+// for the -fixture flag.
+func generateFixture(ctx context.Context, dir string) error {
+	config := fixtureConfig(dir)
+	err := validateConfig(config)
+	if err != nil {
+		return fmt.Errorf("invalid fixture configuration: %v", err)
+	}
+	config.Stats = &Stats{}
+	config.runTime, _ = time.Parse(time.RFC3339, config.OverlayBaseTime)
+
+	start := time.Now()
+	err = generateOutputs(ctx, config)
+	if err != nil {
+		return err
+	}
+	log.Printf("Fixture written to '%s' in %s", dir, time.Since(start).Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// fontCandidates are the font files probed for the timestamp overlay when no
+// font_path is configured, in order of preference. They cover the usual
+// locations of DejaVu and similar fonts on Linux, macOS and Windows.
+var fontCandidates = []string{
+	"/usr/share/fonts/truetype/dejavu/DejaVuSans-Bold.ttf",
+	"/usr/share/fonts/dejavu/DejaVuSans-Bold.ttf",
+	"/usr/share/fonts/TTF/DejaVuSans-Bold.ttf",
+	"/usr/share/fonts/dejavu-sans-fonts/DejaVuSans-Bold.ttf",
+	"/usr/share/fonts/truetype/liberation/LiberationSans-Bold.ttf",
+	"/usr/local/share/fonts/DejaVuSans-Bold.ttf",
+	"/Library/Fonts/Arial Bold.ttf",
+	"/System/Library/Fonts/Supplemental/Arial Bold.ttf",
+	"/System/Library/Fonts/Helvetica.ttc",
+	`C:\Windows\Fonts\arialbd.ttf`,
+}
+
+// findFont returns the font file of the timestamp overlay: FontPath when set,
+// otherwise the first of fontCandidates that exists. An empty result leaves the
+// choice to ffmpeg's fontconfig default.
+func findFont(config Config) string {
+	if config.FontPath != "" {
+		return config.FontPath
+	}
+	for _, candidate := range fontCandidates {
+		if fileExists(candidate) {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// fileExists reports whether path is an existing regular file.
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// escapeFilterValue prepares a value for a single-quoted ffmpeg filter option.
+// Backslashes are turned into slashes, which ffmpeg accepts on Windows as well,
+// and quotes are closed, escaped and reopened.
+func escapeFilterValue(value string) string {
+	value = strings.ReplaceAll(value, `\`, "/")
+	return strings.ReplaceAll(value, "'", `'\''`)
+}
+
+// printFonts prints the font files probed for the timestamp overlay, whether
+// each exists, and the one that would be used.
+func printFonts(config Config) {
+	if config.FontPath != "" {
+		fmt.Printf("font_path: %s (%s)\n", config.FontPath, existsLabel(config.FontPath))
+	}
+	fmt.Println("Fallback fonts, in order:")
+	for _, candidate := range fontCandidates {
+		fmt.Printf("  %s (%s)\n", candidate, existsLabel(candidate))
+	}
+
+	font := findFont(config)
+	if font == "" {
+		fmt.Println("No font found, ffmpeg's default font will be used if it was built with fontconfig.")
+		return
+	}
+	fmt.Printf("Using: %s\n", font)
+}
+
+// existsLabel describes whether path exists, for printFonts.
+func existsLabel(path string) string {
+	if fileExists(path) {
+		return "found"
+	}
+	return "missing"
+}
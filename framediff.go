@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"os"
+)
+
+// frameSignatureSize is the width and height of the grid of mean luma values
+// compared by SkipUnchangedFrames. Averaging over blocks keeps compression noise
+// and the pixel-level flicker of a static scene from counting as change.
+const frameSignatureSize = 32
+
+// frameSignature returns the mean luma, from 0 to 255, of each block of the
+// frameSignatureSize x frameSignatureSize grid over the image in file.
+func frameSignature(file string) ([]float64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode '%s': %v", file, err)
+	}
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return nil, fmt.Errorf("'%s' is an empty image", file)
+	}
+
+	sums := make([]float64, frameSignatureSize*frameSignatureSize)
+	counts := make([]int, len(sums))
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row := (y - bounds.Min.Y) * frameSignatureSize / bounds.Dy() * frameSignatureSize
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			block := row + (x-bounds.Min.X)*frameSignatureSize/bounds.Dx()
+			sums[block] += float64(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+			counts[block]++
+		}
+	}
+	for i := range sums {
+		if counts[i] > 0 {
+			sums[i] /= float64(counts[i])
+		}
+	}
+	return sums, nil
+}
+
+// frameDifference returns the root mean square difference of two signatures as
+// a percentage of the full luma range: 0 for identical frames, 100 for black
+// against white.
+func frameDifference(a []float64, b []float64) float64 {
+	var sum float64
+	for i := range a {
+		d := a[i] - b[i]
+		sum += d * d
+	}
+	return math.Sqrt(sum/float64(len(a))) / 255 * 100
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jlaffaye/ftp"
+	"io"
+	"net"
+	"net/textproto"
+)
+
+// Errors of the FTP layer. They wrap the underlying error, so callers can test
+// for the kind of failure with errors.Is and still see the server's message.
+var (
+	// ErrFTPConnect reports that the server could not be reached or dropped the
+	// connection.
+	ErrFTPConnect = errors.New("FTP connection failed")
+	// ErrFTPAuth reports that the server rejected the credentials. Retrying with
+	// the same credentials does not help.
+	ErrFTPAuth = errors.New("FTP authentication failed")
+	// ErrFTPQuota reports that the server has no space left for the upload.
+	ErrFTPQuota = errors.New("FTP storage quota exceeded")
+)
+
+// classifyFTPError wraps err in the matching FTP error, based on the server's
+// reply code or the kind of network failure. Other errors are returned as is.
+func classifyFTPError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		switch protoErr.Code {
+		case ftp.StatusNotLoggedIn, ftp.StatusInvalidCredentials:
+			return fmt.Errorf("%w: %w", ErrFTPAuth, err)
+		case ftp.StatusLoginNeedAccount, ftp.StatusStorNeedAccount:
+			return fmt.Errorf("%w: the server requires an account, check ftp_account: %w", ErrFTPAuth, err)
+		case ftp.Status452, ftp.StatusExceededStorage:
+			return fmt.Errorf("%w: %w", ErrFTPQuota, err)
+		case ftp.StatusNotAvailable, ftp.StatusCanNotOpenDataConnection, ftp.StatusHostUnavailable:
+			return fmt.Errorf("%w: %w", ErrFTPConnect, err)
+		}
+		return err
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: %w", ErrFTPConnect, err)
+	}
+	return err
+}
+
+// isFTPNotImplemented reports whether err is the server's reply that a command
+// is not recognized or not implemented.
+func isFTPNotImplemented(err error) bool {
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) {
+		return false
+	}
+	switch protoErr.Code {
+	case ftp.StatusBadCommand, ftp.StatusNotImplemented, ftp.StatusNotImplementedParameter:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// runPostRunCommand runs PostRunCommand with PostRunArgs once the uploads of the
+// run are complete, and logs its output line by line. runErr is the outcome of
+// the run so far. The command learns about the run from environment variables:
+//
+//	FTPDATAGENERATOR_STATUS          "success" or "failed"
+//	FTPDATAGENERATOR_ERROR           the error of a failed run, otherwise empty
+//	FTPDATAGENERATOR_RUN_ID          the run ID of the log lines
+//	FTPDATAGENERATOR_UPLOADED        the counters of the run summary
+//	FTPDATAGENERATOR_FAILED
+//	FTPDATAGENERATOR_SKIPPED
+//	FTPDATAGENERATOR_DISCREPANCIES
+//	FTPDATAGENERATOR_OUTPUT_DIR      the local paths of the outputs
+//	FTPDATAGENERATOR_TEST_VIDEO
+//	FTPDATAGENERATOR_SNAPSHOT_DIR
+//	FTPDATAGENERATOR_METADATA_FILE
+//	FTPDATAGENERATOR_REMOTE_DIR      the remote directory of the uploads
+//
+// A run with failed uploads counts as failed. The command is killed when ctx is
+// done, so max_runtime bounds it as well.
+func runPostRunCommand(ctx context.Context, config Config, runErr error) error {
+	s := config.Stats
+	s.mu.Lock()
+	uploaded, failed, skipped, discrepancies := s.Uploaded, s.Failed, s.Skipped, s.Discrepancies
+	s.mu.Unlock()
+
+	status, errText := "success", ""
+	if runErr != nil {
+		status, errText = "failed", runErr.Error()
+	} else if failed > 0 {
+		status = "failed"
+	}
+
+	cmd := exec.CommandContext(ctx, config.PostRunCommand, config.PostRunArgs...)
+	cmd.Env = append(os.Environ(),
+		"FTPDATAGENERATOR_STATUS="+status,
+		"FTPDATAGENERATOR_ERROR="+errText,
+		"FTPDATAGENERATOR_RUN_ID="+config.runID,
+		"FTPDATAGENERATOR_UPLOADED="+strconv.Itoa(uploaded),
+		"FTPDATAGENERATOR_FAILED="+strconv.Itoa(failed),
+		"FTPDATAGENERATOR_SKIPPED="+strconv.Itoa(skipped),
+		"FTPDATAGENERATOR_DISCREPANCIES="+strconv.Itoa(discrepancies),
+		"FTPDATAGENERATOR_OUTPUT_DIR="+config.OutputDir,
+		"FTPDATAGENERATOR_TEST_VIDEO="+config.TestVideoPath,
+		"FTPDATAGENERATOR_SNAPSHOT_DIR="+config.SnapshotOutputDir,
+		"FTPDATAGENERATOR_METADATA_FILE="+metadataFile(config),
+		"FTPDATAGENERATOR_REMOTE_DIR="+remoteDir(config),
+	)
+
+	log.Printf("Running post_run_command '%s'...", config.PostRunCommand)
+	output, err := cmd.CombinedOutput()
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		log.Printf("post_run_command: %s", scanner.Text())
+	}
+	if err != nil {
+		return fmt.Errorf("post_run_command '%s' failed: %v", config.PostRunCommand, err)
+	}
+	log.Println("post_run_command completed.")
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"runtime"
+)
+
+// ABRRung is one level of an adaptive-bitrate ladder: the test video rendered at
+// a resolution and bitrate of its own.
+type ABRRung struct {
+	// Name names the rung's local and remote subdirectory. It defaults to the
+	// resolution and bitrate, such as "1280x720_2M".
+	Name       string `json:"name"`
+	Resolution string `json:"resolution"`
+	Bitrate    string `json:"bitrate"`
+}
+
+// rungResolutionPattern matches resolutions such as "1280x720".
+var rungResolutionPattern = regexp.MustCompile(`^[0-9]+x[0-9]+$`)
+
+// rungName returns the name of rung, see ABRRung.Name.
+func rungName(rung ABRRung) string {
+	if rung.Name != "" {
+		return rung.Name
+	}
+	return rung.Resolution + "_" + rung.Bitrate
+}
+
+// rungConfig returns config rendering the test video of rung into a
+// subdirectory named after it, next to TestVideoPath.
+func rungConfig(config Config, rung ABRRung) Config {
+	config.Resolution = rung.Resolution
+	config.VideoBitrate = rung.Bitrate
+	config.VideoCRF = nil
+	config.TestVideoPath = filepath.Join(filepath.Dir(config.TestVideoPath), rungName(rung), filepath.Base(config.TestVideoPath))
+	return config
+}
+
+// generateLadder renders the test video once per rung of ABRLadder, with at most
+// ABRWorkers ffmpeg processes running at a time.
+func generateLadder(ctx context.Context, config Config) error {
+	workers := config.ABRWorkers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	log.Printf("Generating %d rungs of the bitrate ladder, %d at a time...", len(config.ABRLadder), workers)
+
+	return runLimited(workers, len(config.ABRLadder), func(i int) error {
+		rung := config.ABRLadder[i]
+		err := generateTestVideo(ctx, rungConfig(config, rung))
+		if err != nil {
+			return fmt.Errorf("rung %s: %v", rungName(rung), err)
+		}
+		return nil
+	})
+}
+
+// validateLadder checks the rungs of ABRLadder and the settings they cannot be
+// combined with.
+func validateLadder(config Config) error {
+	if len(config.ABRLadder) == 0 {
+		return nil
+	}
+	switch {
+	case config.VideoBitrate != "" || config.VideoCRF != nil:
+		return fmt.Errorf("abr_ladder sets the bitrate of every rung, video_bitrate and video_crf cannot be set with it")
+	case len(config.Resolutions) > 0:
+		return fmt.Errorf("abr_ladder and resolutions are mutually exclusive")
+	case config.SnapshotsOnly || config.SourceVideo != "" || config.WatchDir != "":
+		return fmt.Errorf("abr_ladder renders the test video, it cannot be set with snapshots_only, source_video or watch_dir")
+	}
+	if config.ABRWorkers < 0 {
+		return fmt.Errorf("abr_workers must not be negative, got %d", config.ABRWorkers)
+	}
+
+	names := make(map[string]bool, len(config.ABRLadder))
+	for _, rung := range config.ABRLadder {
+		if !rungResolutionPattern.MatchString(rung.Resolution) {
+			return fmt.Errorf("abr_ladder resolution must be WIDTHxHEIGHT, got %q", rung.Resolution)
+		}
+		if !bitratePattern.MatchString(rung.Bitrate) {
+			return fmt.Errorf("abr_ladder bitrate must be a number with an optional k, M or G suffix, got %q", rung.Bitrate)
+		}
+		name := rungName(rung)
+		if names[name] {
+			return fmt.Errorf("abr_ladder has more than one rung named '%s'", name)
+		}
+		names[name] = true
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// configFiles collects the -config flags in the order they were given.
+type configFiles []string
+
+func (f *configFiles) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *configFiles) Set(file string) error {
+	*f = append(*f, file)
+	return nil
+}
+
+// readConfigLayer reads the configuration file, or standard input for "-", as a
+// JSON object. The file is decoded on its own over the defaults as well, so that
+// unknown keys and wrong types are reported with its name.
+func readConfigLayer(file string) (map[string]any, error) {
+	var data []byte
+	var err error
+	source := fmt.Sprintf("file '%s'", file)
+	if file == "-" {
+		data, err = io.ReadAll(os.Stdin)
+		source = "from standard input"
+	} else {
+		data, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = decodeConfig(bytes.NewReader(data), source)
+	if err != nil {
+		return nil, err
+	}
+
+	var layer map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	// Numbers are kept as written, so that large integers survive the merge.
+	decoder.UseNumber()
+	err = decoder.Decode(&layer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration %s: %v", source, err)
+	}
+	return layer, nil
+}
+
+// mergeConfigLayers returns base with the keys of overlay merged in. Objects
+// present in both are merged key by key, recursively; any other value of
+// overlay, including lists, replaces the one of base.
+func mergeConfigLayers(base map[string]any, overlay map[string]any) map[string]any {
+	if base == nil {
+		base = make(map[string]any, len(overlay))
+	}
+	for key, value := range overlay {
+		baseObject, baseIsObject := base[key].(map[string]any)
+		object, isObject := value.(map[string]any)
+		if baseIsObject && isObject {
+			base[key] = mergeConfigLayers(baseObject, object)
+		} else {
+			base[key] = value
+		}
+	}
+	return base
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// jsonLogging writes the log as JSON lines through slog. It is set from
+// Config.LogFormat.
+var jsonLogging bool
+
+// newRunID returns a random identifier for one pipeline run.
+func newRunID() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// setupLogging configures the log output for format, "text" or "json", with
+// runID attached to every line when it is set. In JSON mode the standard log
+// package is routed through slog, so existing log calls become JSON lines too.
+func setupLogging(format string, runID string) {
+	jsonLogging = format == "json"
+	if jsonLogging {
+		logger := slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		if runID != "" {
+			logger = logger.With("run_id", runID)
+		}
+		slog.SetDefault(logger)
+		return
+	}
+
+	if runID != "" {
+		log.SetPrefix("run=" + runID + " ")
+		log.SetFlags(log.LstdFlags | log.Lmsgprefix)
+	} else {
+		log.SetPrefix("")
+		log.SetFlags(log.LstdFlags)
+	}
+}
+
+// fileLogf logs a message about file. In JSON mode the file is a field of its
+// own, so that all lines about one file can be found.
+func fileLogf(file string, format string, v ...interface{}) {
+	if jsonLogging {
+		slog.Info(fmt.Sprintf(format, v...), "file", file)
+		return
+	}
+	log.Printf(format, v...)
+}
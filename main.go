@@ -1,347 +1,2977 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/jlaffaye/ftp"
+	"golang.org/x/sync/errgroup"
+	"io"
 	"log"
+	"net"
+	"net/textproto"
+	"net/url"
 	"os"
-	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
+// Build information, set at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=...".
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
 type Config struct {
-	Resolution  string `json:"resolution"`
-	FPS         int    `json:"fps"`
-	Duration    int    `json:"duration"`
-	FTPUser     string `json:"ftp_user"`
-	FTPPassword string `json:"ftp_password"`
-	FTPHost     string `json:"ftp_host"`
-	FTPPort     int    `json:"ftp_port"`
-	OutputDir   string `json:"output_dir"`
-
-	TestVideoPath     string `json:"test_video_path"`
+	Resolution string `json:"resolution"`
+	// Resolutions, when set, renders the pipeline once per listed resolution
+	// instead of only Resolution, with Workers pipelines running at a time.
+	Resolutions []string `json:"resolutions"`
+	Workers     int      `json:"workers"`
+	FPS         int      `json:"fps"`
+	Duration    int      `json:"duration"`
+	FTPUser     string   `json:"ftp_user"`
+	FTPPassword string   `json:"ftp_password"`
+	// FTPAccount is sent with ACCT when the server asks for an account at
+	// login, see accountConn.
+	FTPAccount string `json:"ftp_account"`
+	FTPHost    string `json:"ftp_host"`
+	FTPPort    int    `json:"ftp_port"`
+	OutputDir  string `json:"output_dir"`
+
+	TestVideoPath string `json:"test_video_path"`
+	// SourceVideo, when set, is an existing video the snapshots are taken from
+	// instead of the generated test video.
+	SourceVideo string `json:"source_video"`
+	// WatchDir, when set, turns the program into a service processing every new
+	// file in this directory matching WatchPattern as SourceVideo. Events are
+	// debounced by WatchDebounceMs milliseconds.
+	WatchDir        string `json:"watch_dir"`
+	WatchPattern    string `json:"watch_pattern"`
+	WatchDebounceMs int    `json:"watch_debounce_ms"`
+	// SnapshotsOnly renders the snapshots directly from the test pattern, without
+	// writing the test video. TestVideoPath is not used then.
+	SnapshotsOnly     bool   `json:"snapshots_only"`
 	SnapshotOutputDir string `json:"snapshot_output_dir"`
-	VideoOutputDir    string `json:"video_output_dir"`
+	// KeyframesOnly decodes only the keyframes of the video and takes the
+	// snapshots from them, see keyframeFilter, which is much faster than
+	// decoding every frame but makes the interval approximate. The generated test
+	// video gets a keyframe at every snapshot time.
+	KeyframesOnly bool `json:"keyframes_only"`
+	// SceneChangeThreshold, when set, takes the snapshots on scene changes
+	// instead of at a fixed interval: every frame whose ffmpeg scene change
+	// score, from 0 to 1, exceeds it, see sceneFilter. The number of snapshots
+	// then depends on the video.
+	SceneChangeThreshold float64 `json:"scene_change_threshold"`
+	// SnapshotNameTemplate names the snapshot files. {idx} is replaced by the frame
+	// index and is required; {ts} by the run timestamp and {res} by the resolution.
+	SnapshotNameTemplate string `json:"snapshot_name_template"`
+	// SnapshotFormat, when set, writes lossless snapshots for image analysis:
+	// "ppm" for binary PPM files or "raw" for bare RGB pixels. It replaces the
+	// extension of SnapshotNameTemplate, see snapshotFormats.
+	SnapshotFormat string `json:"snapshot_format"`
+	// SnapshotJPEGBaseline writes JPEG snapshots that the oldest decoders can
+	// read, see baselineJPEGArgs.
+	SnapshotJPEGBaseline bool `json:"snapshot_jpeg_baseline"`
+	// TimestampArtifacts appends the run timestamp to the name of the test video
+	// and of SnapshotOutputDir, so that the local outputs of successive or
+	// overlapping runs do not overwrite each other, see stampArtifacts.
+	TimestampArtifacts bool `json:"timestamp_artifacts"`
+	// TimestampLayout is the Go time layout of the run timestamp, for
+	// TimestampArtifacts and the {ts} placeholder. It must give file-name-safe text.
+	TimestampLayout string `json:"timestamp_layout"`
+	VideoOutputDir  string `json:"video_output_dir"`
 
 	CsvOutputFile string `json:"csv_output_file"`
+	// MetadataInMemory builds the metadata CSV in memory and uploads it directly
+	// instead of writing CsvOutputFile, for read-only filesystems.
+	MetadataInMemory bool `json:"metadata_in_memory"`
+	// AppendRemote appends the metadata rows of each run to the local metadata
+	// file and uploads only the new part, with FTP APPE, to the remote one.
+	AppendRemote bool `json:"append_remote"`
+	// MetadataRequired fails the run when the metadata could not be uploaded,
+	// after MaxRetries attempts, even if the snapshots were.
+	MetadataRequired bool `json:"metadata_required"`
+	// CompressMetadata writes and uploads the metadata as gzip, adding .gz to the
+	// local and remote file names.
+	CompressMetadata bool `json:"compress_metadata"`
+	// MetadataColumns lists the metadata CSV columns in order, see metadataHeaders
+	// for the supported names. The default is filename and creation_time.
+	MetadataColumns []string `json:"metadata_columns"`
+	// ContactSheetPath, when set, is where a montage of all snapshots is written.
+	// It gets its own metadata row and is uploaded as "contact_sheet" with its
+	// extension, next to the snapshots.
+	ContactSheetPath string `json:"contact_sheet_path"`
+	// SpritePath, when set, is where the snapshots are packed into a thumbnail
+	// sprite sheet for the scrubbing previews of web players, SpriteColumns tiles
+	// of SpriteTileWidth pixels per row, with a WebVTT index next to it, see
+	// generateSprite. Both are uploaded as "sprite" with their extensions.
+	SpritePath      string `json:"sprite_path"`
+	SpriteColumns   int    `json:"sprite_columns"`
+	SpriteTileWidth int    `json:"sprite_tile_width"`
+
+	// Interval is the time between snapshots taken from the test video, a
+	// duration string or a number of seconds, defaultInterval unless set. It
+	// does not affect the pace of uploads, see UploadDelayMs.
+	Interval      flexDuration `json:"interval"`
+	MaxRetries    int          `json:"max_retries"`
+	RetryInterval int          `json:"retry_interval"`
+	// RetryBudget caps the retries of the whole run, counted across connection
+	// attempts, reconnections and upload attempts, see retryBudget. Once it is
+	// used up the run is aborted. Zero means no limit beyond MaxRetries.
+	RetryBudget int `json:"retry_budget"`
+	// MaxUploadBytes caps the bytes the uploads of the whole run send, every
+	// attempt counted, see byteBudget. Once the next transfer would exceed it the
+	// uploads stop, leaving the remaining files for the next run. Zero means no
+	// limit.
+	MaxUploadBytes int64 `json:"max_upload_bytes"`
+	// SnapshotFPS, when set, replaces Interval with a snapshot rate in frames per
+	// second, allowing more than one snapshot per second (e.g. 2 or 0.5).
+	SnapshotFPS float64 `json:"snapshot_fps"`
+	// SnapshotCount, when set, replaces Interval with a number of evenly spaced
+	// snapshots taken over Duration.
+	SnapshotCount int `json:"snapshot_count"`
+
+	// UploadVideo uploads the test video as well, to VideoRemoteDir or, when that
+	// is empty, OutputDir.
+	UploadVideo    bool   `json:"upload_video"`
+	VideoRemoteDir string `json:"video_remote_dir"`
+
+	// RemoteDirTemplate, when set, is the remote directory of the uploads instead
+	// of OutputDir. {resolution}, {fps}, {duration}, {site}, {camera}, {date},
+	// {timestamp} and {config_hash} are replaced by the settings, start time and
+	// configuration hash of the run.
+	RemoteDirTemplate string `json:"remote_dir_template"`
+
+	// RemoteNameTemplate names uploaded files within their remote directory.
+	// {site}, {camera}, {timestamp}, {config_hash} and {basename} are replaced
+	// per file; the default "{basename}" keeps the local file name.
+	RemoteNameTemplate string `json:"remote_name_template"`
+	Site               string `json:"site"`
+	Camera             string `json:"camera"`
+
+	// EmbedExif writes EXIF into the JPEG snapshots: the position of Latitude and
+	// Longitude, the time the snapshot was written and ExifCameraModel, see
+	// exifData.
+	EmbedExif bool `json:"embed_exif"`
+	// Latitude and Longitude are the position of the camera in decimal degrees,
+	// positive to the north and east.
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+	// ExifCameraModel, when set, is written as the camera model by EmbedExif.
+	ExifCameraModel string `json:"exif_camera_model"`
+
+	// VerifyRemoteListing lists the remote directory after the uploads and reports
+	// files that are missing or differ in size from the local copies.
+	VerifyRemoteListing bool `json:"verify_remote_listing"`
+
+	// VideoBitrate (ffmpeg -b:v, e.g. "2M") and VideoCRF (ffmpeg -crf) set the
+	// quality of the test video. Only one of them may be set; when neither is,
+	// ffmpeg's defaults apply. CRF is honoured by x264, x265, VP9 and AV1 encoders.
+	VideoBitrate string `json:"video_bitrate"`
+	VideoCRF     *int   `json:"video_crf"`
+	// VideoContainer, when set, is the container of the test video: "mp4",
+	// "mkv", "mov" or "ts". ffmpeg is told to write it with -f, and
+	// TestVideoPath gets its extension when it has none. Otherwise ffmpeg picks
+	// the container from the extension of TestVideoPath.
+	VideoContainer string `json:"video_container"`
+	// VideoMetadata tags the test video with these container metadata, such as
+	// "title", "comment" or "creation_time", see videoMetadataArgs.
+	VideoMetadata map[string]string `json:"video_metadata"`
+	// ColorPrimaries, ColorTRC and Colorspace, when set, tag the test video and
+	// the snapshots with these color properties (ffmpeg's -color_primaries,
+	// -color_trc and -colorspace), for example bt2020, smpte2084 and bt2020nc
+	// for HDR10. The pixels themselves are not converted.
+	ColorPrimaries string `json:"color_primaries"`
+	ColorTRC       string `json:"color_trc"`
+	Colorspace     string `json:"colorspace"`
+	// ABRLadder, when set, renders the test video once per rung instead, each
+	// with its own resolution and bitrate, at most ABRWorkers at a time (default:
+	// the number of CPUs). The snapshots are taken from the first, top rung.
+	ABRLadder  []ABRRung `json:"abr_ladder"`
+	ABRWorkers int       `json:"abr_workers"`
+
+	// OverlayMode selects the text drawn on the test pattern: "localtime" (the
+	// default, the wall-clock time), "frame" (the frame number), "fixed_time"
+	// (OverlayBaseTime plus the position of the frame, in UTC) or "elapsed" (the
+	// position of the frame, in the OverlayElapsedFormat format).
+	OverlayMode     string `json:"overlay_mode"`
+	OverlayBaseTime string `json:"overlay_base_time"`
+	// OverlayElapsedFormat is "hms" (HH:MM:SS.mmm, the default) or "seconds"
+	// (seconds with six decimals).
+	OverlayElapsedFormat string `json:"overlay_elapsed_format"`
+	// Timezone is the IANA name of the time zone of the "localtime" overlay,
+	// such as "Europe/Berlin". When empty, ffmpeg uses the host's time zone.
+	Timezone string `json:"timezone"`
+
+	// FontPath is the font file of the timestamp overlay. When empty, the first
+	// existing file of fontCandidates is used, see findFont.
+	FontPath string `json:"font_path"`
+
+	// OverwriteLocal replaces existing local outputs (the default). When false, the
+	// run stops with an error if the test video or snapshots already exist.
+	OverwriteLocal bool `json:"overwrite_local"`
+	// CleanupOutput removes OutputDir at the end of a run that completed with
+	// every file uploaded, provided the run created it, see cleanup.
+	CleanupOutput bool `json:"cleanup_output"`
+
+	// TempDir is where ffmpeg writes its output before it is moved into place.
+	// When empty, a temporary directory next to the final output is used.
+	TempDir string `json:"temp_dir"`
+
+	// FFmpegExtraArgs are passed verbatim to both ffmpeg commands, right before the
+	// output path. The user is responsible for their validity.
+	FFmpegExtraArgs []string `json:"ffmpeg_extra_args"`
+	// FFmpegLogLevel is the -loglevel of every ffmpeg command, see runFFmpeg:
+	// "warning" by default, or one of ffmpegLogLevels.
+	FFmpegLogLevel string `json:"ffmpeg_loglevel"`
+
+	// MaxConcurrency, when set, is the most ffmpeg processes and uploads running
+	// at a time across the whole run, whatever Workers, SnapshotWorkers and
+	// ABRWorkers allow. Zero means no limit.
+	MaxConcurrency int `json:"max_concurrency"`
+
+	// FFmpegThreads, when set, is passed as -threads to the video and snapshot
+	// commands to bound the CPU cores each ffmpeg process uses. Zero leaves the
+	// choice to ffmpeg, which uses all cores.
+	FFmpegThreads int `json:"ffmpeg_threads"`
+
+	// SnapshotSegments, when above 1, splits the video into this many time segments
+	// and extracts their snapshots with concurrent ffmpeg processes, at most
+	// SnapshotWorkers at a time (default: the number of CPUs).
+	SnapshotSegments int `json:"snapshot_segments"`
+	SnapshotWorkers  int `json:"snapshot_workers"`
+
+	// StrictSnapshotCount fails the run when the number of generated snapshots
+	// does not match Duration/Interval, instead of only logging a warning.
+	StrictSnapshotCount bool `json:"strict_snapshot_count"`
+
+	// GlobStableWindowMs, when set, makes snapshot listings wait this many
+	// milliseconds and list again until no new files appear, at most
+	// GlobMaxAttempts times, for slow or network filesystems.
+	GlobStableWindowMs int `json:"glob_stable_window_ms"`
+	GlobMaxAttempts    int `json:"glob_max_attempts"`
+
+	// UploadInclude selects the files of SnapshotOutputDir to upload by glob pattern
+	// on their names; by default the snapshots are uploaded. Files matching one of
+	// the UploadExclude patterns are left out.
+	UploadInclude []string `json:"upload_include"`
+	UploadExclude []string `json:"upload_exclude"`
+	// UploadOrder is the order in which the snapshot files are uploaded:
+	// "lexical" by name, "numeric" by name with the frame numbers compared as
+	// numbers, or "mtime" by modification time, see sortUploadFiles.
+	UploadOrder string `json:"upload_order"`
+
+	// UploadDelayMs is the pause in milliseconds between two snapshot uploads.
+	UploadDelayMs int `json:"upload_delay_ms"`
+	// MaxConsecutiveFailures aborts the snapshot upload of a batch once this many
+	// snapshots in a row failed, and fails the run. Zero means no limit.
+	MaxConsecutiveFailures int `json:"max_consecutive_failures"`
+
+	ResumeUploads bool `json:"resume_uploads"`
+	SkipExisting  bool `json:"skip_existing"`
+
+	// AtomicRemoteUpload uploads every file under a hidden temporary name and
+	// renames it once complete, so that receivers never pick up a partial file,
+	// see atomicTempName. Leftovers of crashed runs are deleted before the
+	// uploads, or resumed with ResumeUploads.
+	AtomicRemoteUpload bool `json:"atomic_remote_upload"`
+
+	// ChunkedUpload uploads files larger than ChunkSize bytes as parts with a
+	// checksum manifest, each part retried on its own, see chunked.go.
+	ChunkedUpload bool  `json:"chunked_upload"`
+	ChunkSize     int64 `json:"chunk_size"`
+
+	// SkipUnchangedFrames skips the upload of snapshots that differ from the last
+	// uploaded one by less than UnchangedFrameThreshold, the root mean square
+	// difference of their luma in percent of the full range, see frameDifference.
+	SkipUnchangedFrames     bool    `json:"skip_unchanged_frames"`
+	UnchangedFrameThreshold float64 `json:"unchanged_frame_threshold"`
+	// ResumeFromCheckpoint records every uploaded snapshot in a checkpoint file in
+	// OutputDir, so that a run restarted after a crash skips them.
+	ResumeFromCheckpoint bool `json:"resume_from_checkpoint"`
+
+	// FTPKeepaliveInterval is the number of seconds between NOOP commands sent
+	// while the FTP connection is idle. Zero disables the keepalive.
+	FTPKeepaliveInterval int `json:"ftp_keepalive_interval"`
+	// ConnectDuringGeneration connects to the upload destinations while the
+	// outputs are generated instead of after, keeping the FTP connections alive
+	// with a NOOP every FTPKeepaliveInterval seconds, or
+	// generationKeepaliveInterval when that is unset.
+	ConnectDuringGeneration bool `json:"connect_during_generation"`
+	// FTPPassive selects passive mode for data connections. Passive mode is
+	// usually correct for clients behind NAT. In active mode the server connects
+	// back to the address of the control connection, see activeConn.
+	FTPPassive bool `json:"ftp_passive"`
+	// FTPActivePortMin and FTPActivePortMax bound the local ports used for data
+	// connections in active mode, so they can be opened in a firewall.
+	FTPActivePortMin int `json:"ftp_active_port_min"`
+	FTPActivePortMax int `json:"ftp_active_port_max"`
+
+	// DialTimeout is the number of seconds allowed to open a connection to the FTP
+	// server (default 5). TransferTimeout is the number of seconds a single upload
+	// may take before it is aborted (default 300); zero disables the limit.
+	DialTimeout     int `json:"dial_timeout"`
+	TransferTimeout int `json:"transfer_timeout"`
+	// AssumedMinBps, when set, replaces TransferTimeout with a limit per upload
+	// derived from its size: BaseTimeout seconds plus the time the upload takes
+	// at AssumedMinBps bytes per second, see transferTimeout.
+	AssumedMinBps int64 `json:"assumed_min_bps"`
+	BaseTimeout   int   `json:"base_timeout"`
+
+	// FTPTransferTypes maps file extensions, such as ".csv", to the FTP transfer
+	// type of the files uploaded with them: "binary" (TYPE I) or "ascii" (TYPE A).
+	// Other files are sent as binary. The type is set before every upload.
+	FTPTransferTypes map[string]string `json:"ftp_transfer_types"`
+
+	// FTPTLS enables FTPS: "explicit" (AUTH TLS on the regular port) or
+	// "implicit" (TLS from the start). Empty means plain FTP.
+	FTPTLS string `json:"ftp_tls"`
+	// FTPTLSSessionCache lets FTPS connections resume earlier TLS sessions
+	// (the default); turn it off for servers that mishandle resumption.
+	FTPTLSSessionCache bool `json:"ftp_tls_session_cache"`
+	// TLSClientCert and TLSClientKey are PEM files of a client certificate
+	// presented to FTPS servers that require mutual TLS.
+	TLSClientCert string `json:"tls_client_cert"`
+	TLSClientKey  string `json:"tls_client_key"`
+	// PinnedCertSHA256 is the SHA-256 fingerprint of the FTPS server certificate.
+	// When set, only a server presenting exactly this certificate is accepted.
+	PinnedCertSHA256 string `json:"pinned_cert_sha256"`
+	// EncryptUploads encrypts every file with AES-256-GCM before it is uploaded,
+	// with a key derived from the passphrase in FTPDATAGENERATOR_PASSPHRASE, and
+	// adds ".enc" to the remote names. See encrypt.go for the format.
+	EncryptUploads bool `json:"encrypt_uploads"`
+	// SOCKS5Proxy, when its address is set, is the proxy the FTP control and data
+	// connections are dialed through.
+	SOCKS5Proxy SOCKS5Proxy `json:"socks5_proxy"`
+
+	// LogUploadProgress logs the progress of each upload in 10% steps.
+	LogUploadProgress bool `json:"log_upload_progress"`
+
+	// TransferProtocol selects the upload destination: "ftp" (the default),
+	// "sftp", "s3" or "tcp".
+	TransferProtocol string `json:"transfer_protocol"`
 
-	Interval      int `json:"interval"`
-	MaxRetries    int `json:"max_retries"`
-	RetryInterval int `json:"retry_interval"`
-	FTPConn       *ftp.ServerConn
+	// TCPAddress is the host:port of the ingest endpoint used when
+	// TransferProtocol is "tcp", see tcp.go for the wire format.
+	TCPAddress string `json:"tcp_address"`
+
+	// S3 destination, used when TransferProtocol is "s3". Without static keys the
+	// ambient AWS credentials (environment, shared config, IAM role) are used.
+	S3Bucket          string `json:"s3_bucket"`
+	S3Region          string `json:"s3_region"`
+	S3Prefix          string `json:"s3_prefix"`
+	S3AccessKeyID     string `json:"s3_access_key_id"`
+	S3SecretAccessKey string `json:"s3_secret_access_key"`
+
+	// SFTP destination, used when TransferProtocol is "sftp". The server must
+	// present a host key listed for it in the known_hosts file SFTPKnownHosts.
+	// The login uses SFTPPassword, the unencrypted private key file
+	// SFTPPrivateKey, or both. SFTPPort defaults to 22.
+	SFTPHost       string `json:"sftp_host"`
+	SFTPPort       int    `json:"sftp_port"`
+	SFTPUser       string `json:"sftp_user"`
+	SFTPPassword   string `json:"sftp_password"`
+	SFTPPrivateKey string `json:"sftp_private_key"`
+	SFTPKnownHosts string `json:"sftp_known_hosts"`
+
+	// MaxRuntime caps the duration of the whole run, as a Go duration such as
+	// "45m". When it is exceeded all work is cancelled and the program exits with
+	// an error.
+	MaxRuntime string `json:"max_runtime"`
+
+	// Destinations, when set, replaces the upload settings above with a list of
+	// destinations that all receive the outputs.
+	Destinations []Destination `json:"destinations"`
+	// Profiles are named blocks of server and credential settings, for example
+	// one per environment; Profile selects the one applied, see selectProfile.
+	Profiles map[string]Profile `json:"profiles"`
+	Profile  string             `json:"profile"`
+
+	// StatusAddr, when set, is the address of an HTTP server exposing /healthz and
+	// /status, e.g. ":8080".
+	StatusAddr string `json:"status_addr"`
+
+	// ReportWebhookURL, when set, receives a JSON report of the run as a POST
+	// request when the run ends.
+	ReportWebhookURL string `json:"report_webhook_url"`
+
+	// PostRunCommand, when set, is run with PostRunArgs once the uploads are
+	// complete, see runPostRunCommand. Its failure only fails the run when
+	// PostRunRequired is set.
+	PostRunCommand  string   `json:"post_run_command"`
+	PostRunArgs     []string `json:"post_run_args"`
+	PostRunRequired bool     `json:"post_run_required"`
+
+	Debug bool `json:"debug"`
+	// DebugFFmpeg writes the command line and the output of every ffmpeg command
+	// of the run to a log file of its own in OutputDir, see ffmpegLogFile.
+	// UploadFFmpegLogs uploads them with the snapshots.
+	DebugFFmpeg      bool `json:"debug_ffmpeg"`
+	UploadFFmpegLogs bool `json:"upload_ffmpeg_logs"`
+	// LogFormat is "text" (the default) or "json" for one JSON object per line.
+	// Either way every line of a run carries its run ID.
+	LogFormat string `json:"log_format"`
+
+	FTPConn *ftp.ServerConn `json:"-"`
+	// FTPLock serializes the use of FTPConn, which is not safe for concurrent use.
+	FTPLock *sync.Mutex `json:"-"`
+	runTime time.Time
+	// runID identifies the run in the log, the summary and the report.
+	runID         string
+	stopKeepalive func()
+	// destinationName names the entry of Destinations this configuration uploads to.
+	destinationName string
+	ftpDialer       *ftpDialer
+	// ftpReconnectFailed is set once reconnecting a dropped connection failed.
+	ftpReconnectFailed bool
+	// ftpDisableMLSD is set once the server rejected an MLSD listing.
+	ftpDisableMLSD bool
+	// checkpoint is set with ResumeFromCheckpoint while uploading.
+	checkpoint *uploadCheckpoint
+	// retries is the RetryBudget of the run, shared by all its configurations.
+	retries *retryBudget
+	// uploadBytes is the MaxUploadBytes budget of the run, shared by all its
+	// configurations.
+	uploadBytes *byteBudget
+	// unchangedFrames holds the remote names of the snapshots skipped by
+	// SkipUnchangedFrames, so that verifyRemote does not expect them.
+	unchangedFrames map[string]bool
+	// hash is the configHash of the run, computed once it starts.
+	hash string
+	// sceneTimes holds the times of the snapshots taken on scene changes while
+	// the metadata is prepared, see readSceneTimes.
+	sceneTimes []string
+	// bench is set by -bench to print the time of each stage at the end of the
+	// run, and benchUpload by -bench-upload to include the uploads.
+	bench       bool
+	benchUpload bool
+	progress    ProgressFunc
+	Uploader    Uploader `json:"-"`
+	Stats       *Stats   `json:"-"`
 }
 
-// main is the primary entry point for the program. It handles the program's primary logic,
-// including reading the configuration, creating the necessary directories, establishing
-// FTPS connections, managing goroutines to create a test video and its snapshots, and
-// generating metadata. It also coordinates the upload of the snapshots and metadata to
-// the FTPS server. The function is designed to clean up resources and exit when all tasks
-// have completed or upon encountering a fatal error.
+// main is the primary entry point for the program. It handles the command-line flags,
+// reads and validates the configuration and runs the pipeline with Run, stopping it on
+// SIGINT or SIGTERM. A failed run exits with a non-zero status.
 func main() {
+	// The context is cancelled on SIGINT or SIGTERM so that uploads stop promptly.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	checkMode := flag.Bool("check", false, "validate the configuration, ffmpeg and FTP connectivity, then exit")
+	versionMode := flag.Bool("version", false, "print version information and exit")
+	var configFile configFiles
+	flag.Var(&configFile, "config", "the configuration file to read, or - for standard input (default configuration.json); repeat it to layer files, later ones overriding earlier ones")
+	listFonts := flag.Bool("list-fonts", false, "print the font files probed for the timestamp overlay and exit")
+	validateFile := flag.String("validate", "", "check the given configuration file against the schema and exit")
+	decryptPath := flag.String("decrypt", "", "decrypt the given file uploaded with encrypt_uploads to standard output and exit")
+	printConfigMode := flag.Bool("print-config", false, "print the effective configuration, after defaults, the file and the profile, as JSON with the secrets redacted and exit")
+	testLoginMode := flag.Bool("test-login", false, "log in to the FTP server and quit at once, reporting the TLS status, without writing anything, then exit")
+	fixtureDir := flag.String("fixture", "", "write the small deterministic fixture dataset to the given directory without uploading and exit")
+	profile := flag.String("profile", "", "the entry of profiles to apply, overriding "+profileEnv+" and the profile key")
+	benchMode := flag.Bool("bench", false, "run the pipeline without uploading and print the time of each stage")
+	benchUpload := flag.Bool("bench-upload", false, "with -bench, upload the files as well and report the throughput")
+	flag.Parse()
+	if len(configFile) == 0 {
+		configFile = configFiles{"configuration.json"}
+	}
+
+	if *versionMode {
+		fmt.Println(versionString())
+		return
+	}
+	if *validateFile != "" {
+		violations, err := validateConfigFile(*validateFile)
+		if err != nil {
+			log.Fatalf("Failed to validate configuration: %v", err)
+		}
+		for _, violation := range violations {
+			fmt.Println(violation)
+		}
+		if len(violations) > 0 {
+			os.Exit(1)
+		}
+		fmt.Printf("%s is valid\n", *validateFile)
+		return
+	}
+	if *decryptPath != "" {
+		err := decryptFile(*decryptPath)
+		if err != nil {
+			log.Fatalf("Failed to decrypt '%s': %v", *decryptPath, err)
+		}
+		return
+	}
+	if *fixtureDir != "" {
+		err := generateFixture(ctx, *fixtureDir)
+		if err != nil {
+			log.Fatalf("Failed to generate fixture: %v", err)
+		}
+		return
+	}
+	if *listFonts {
+		// The configuration is only needed for font_path, so a missing or invalid
+		// file does not prevent listing the fallback fonts.
+		config, err := readConfig(configFile)
+		if err != nil {
+			log.Printf("Configuration not read, ignoring font_path: %v", err)
+			config = defaultConfig()
+		}
+		printFonts(config)
+		return
+	}
+	log.Println(versionString())
+
 	// Read configuration from the JSON file
-	config, err := readConfig("configuration.json")
+	config, err := readConfig(configFile)
+	if err != nil {
+		log.Fatalf("Failed to read configuration: %v", err)
+	}
+	config, err = selectProfile(config, *profile)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if *printConfigMode {
+		// The configuration is printed before it is validated, so that an
+		// invalid one can be inspected as well.
+		err = printConfig(config)
+		if err != nil {
+			log.Fatalf("Failed to print configuration: %v", err)
+		}
+		return
+	}
+	err = validateConfig(config)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	debugLogging = config.Debug
+	setupLogging(config.LogFormat, "")
+
+	if *testLoginMode {
+		err = runTestLogin(config)
+		if err != nil {
+			log.Fatalf("Login test failed: %v", err)
+		}
+		return
+	}
+	if *checkMode {
+		config.Stats = &Stats{}
+		config.runTime = time.Now()
+		err = runCheck(config)
+		if err != nil {
+			log.Fatalf("Self-test failed: %v", err)
+		}
+		log.Println("Self-test passed")
+		return
+	}
+
+	if config.StatusAddr != "" {
+		go serveStatus(ctx, config.StatusAddr)
+	}
+
+	if *benchUpload && !*benchMode {
+		log.Fatalf("-bench-upload only applies with -bench")
+	}
+	if *benchMode {
+		if config.WatchDir != "" {
+			log.Fatalf("-bench cannot be used with watch_dir")
+		}
+		config.bench, config.benchUpload = true, *benchUpload
+	}
+
+	if config.WatchDir != "" {
+		err = runWatch(ctx, config)
+		if err != nil {
+			log.Fatalf("Watching failed: %v", err)
+		}
+		return
+	}
+
+	err = Run(ctx, config)
 	if err != nil {
-		log.Fatalf("Failed to create output directory line 50: %v", err)
+		log.Fatalf("Run failed: %v", err)
 	}
+	log.Println("Program complete and exiting")
+}
+
+// Run runs the whole pipeline for config: it generates the test video, snapshots
+// and metadata of every resolution, uploads them and waits for the configured
+// duration, or until ctx is done. The summary is logged and the run report sent
+// in every case. Failed uploads are counted in config.Stats, not returned; the
+// returned error reports a run that could not complete.
+//
+// Run is not safe to call concurrently: it sets process-wide state for the
+// duration of the run, namely debugLogging, jsonLogging, concurrencyLimit, the
+// prefix and flags of the standard logger and the status served on
+// StatusAddr. Runs must follow one another, as those of watch_dir do.
+func Run(ctx context.Context, config Config) (err error) {
+	err = validateConfig(config)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+	debugLogging = config.Debug
+	setMaxConcurrency(config.MaxConcurrency)
+	// Every log line of the run carries its ID, so that the lines of concurrent
+	// goroutines and of consecutive runs can be told apart.
+	config.runID = newRunID()
+	setupLogging(config.LogFormat, config.runID)
+	defer setupLogging(config.LogFormat, "")
+	if config.Stats == nil {
+		config.Stats = &Stats{}
+	}
+	config.runTime = time.Now()
+	if config.SourceVideo != "" {
+		config.TestVideoPath = config.SourceVideo
+	}
+	config.TestVideoPath = containerVideoPath(config)
+	if config.TimestampArtifacts {
+		config = stampArtifacts(config)
+	}
+	config.hash = configHash(config)
+
+	// MaxRuntime puts a deadline on everything that follows; ffmpeg is killed and
+	// the uploads stop when it passes.
+	if config.MaxRuntime != "" {
+		maxRuntime, _ := time.ParseDuration(config.MaxRuntime)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, maxRuntime)
+		defer cancel()
+	}
+	// Exhausting RetryBudget cancels everything that follows in the same way.
+	ctx, abort := context.WithCancelCause(ctx)
+	defer abort(nil)
+	config.retries = newRetryBudget(config.RetryBudget, abort)
+	config.uploadBytes = newByteBudget(config.MaxUploadBytes)
+	// A connection idle through the whole render would otherwise be dropped.
+	if config.ConnectDuringGeneration && config.FTPKeepaliveInterval == 0 {
+		config.FTPKeepaliveInterval = generationKeepaliveInterval
+	}
+
+	status.runStarted()
+	defer func() {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("max_runtime of %s exceeded: %v", config.MaxRuntime, ctx.Err())
+		} else if cause := context.Cause(ctx); errors.Is(cause, ErrRetryBudget) {
+			err = cause
+		}
+		if err != nil {
+			config.Stats.recordError(err)
+		}
+		config.Stats.logSummary(config.runID, config.hash)
+		if config.bench {
+			config.Stats.printBench(config.runID)
+		}
+		status.runFinished(err, config.Stats)
+		sendReport(config)
+	}()
 
-	// Schedule cleanup to run when main function returns.
-	//defer cleanup(config)
+	// Schedule cleanup to run when the run returns, after the destinations are
+	// closed.
+	if config.CleanupOutput {
+		defer func() {
+			if err != nil || config.Stats.notUploaded() > 0 {
+				log.Printf("Keeping output directory '%s', as the run did not upload every file", config.OutputDir)
+				return
+			}
+			cleanup(config)
+		}()
+	}
 
 	// Create output directory if it doesn't exist.
 	fmt.Println("Output Directory:", config.OutputDir)
 
 	err = createDirectory(config.OutputDir)
 	if err != nil {
-		// If the output directory cannot be created, the program logs the error and exits.
-		log.Fatalf("Failed to create output directory line 60: %v", err)
+		return fmt.Errorf("failed to create output directory: %v", err)
+	}
+
+	var destinations []*Config
+	var connectErrs []error
+	defer func() {
+		for _, destination := range destinations {
+			closeErr := destination.Uploader.Close()
+			if closeErr != nil {
+				log.Printf("Failed to close the upload destination: %v", closeErr)
+			}
+		}
+	}()
+	upload := !config.bench || config.benchUpload
+
+	// Generate the test video, snapshots and metadata for every resolution, running
+	// at most config.Workers pipelines at a time. With ConnectDuringGeneration the
+	// upload destinations are connected meanwhile; when none can be reached the
+	// generation is cancelled, and a failed generation does not wait for the
+	// connections to be given up.
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.Go(func() error {
+		generateStart := time.Now()
+		err := generateAll(groupCtx, resolutionConfigs(config), config.Workers)
+		config.Stats.recordDuration("generate", time.Since(generateStart))
+		if err != nil {
+			return fmt.Errorf("failed to generate outputs: %v", err)
+		}
+		return nil
+	})
+	if upload && config.ConnectDuringGeneration {
+		group.Go(func() error {
+			destinations, connectErrs = connectDestinations(groupCtx, config)
+			if len(destinations) == 0 {
+				return fmt.Errorf("failed to connect to the upload destination: %w", errors.Join(connectErrs...))
+			}
+			return nil
+		})
+	}
+	err = group.Wait()
+	if err != nil {
+		return err
+	}
+	if !upload {
+		log.Println("Benchmark complete, uploads skipped without -bench-upload.")
+		return nil
+	}
+
+	// Otherwise connect to each upload destination only once the generated files
+	// are ready and the previous destination is done, so the sessions are fresh
+	// when the uploads start instead of sitting idle through the whole render. A
+	// destination that cannot be reached does not keep the others from receiving
+	// the files.
+	uploadStart := time.Now()
+	if config.ConnectDuringGeneration {
+		for _, destination := range destinations {
+			uploadToDestination(ctx, destination)
+		}
+	} else {
+		for _, destination := range destinationConfigs(config) {
+			connected, err := connectDestination(ctx, destination)
+			if err != nil {
+				log.Printf("Failed to connect to the upload destination: %v", err)
+				connectErrs = append(connectErrs, err)
+				continue
+			}
+			destinations = append(destinations, connected)
+			uploadToDestination(ctx, connected)
+		}
+	}
+	config.Stats.recordDuration("upload", time.Since(uploadStart))
+	if len(destinations) == 0 {
+		return fmt.Errorf("failed to connect to the upload destination: %w", errors.Join(connectErrs...))
+	}
+
+	if cause := context.Cause(ctx); errors.Is(cause, ErrRetryBudget) {
+		return cause
+	}
+
+	if len(connectErrs) > 0 {
+		err = fmt.Errorf("failed to connect to the upload destination: %w", errors.Join(connectErrs...))
+	} else if abortErr := config.Stats.abortError(); abortErr != nil {
+		err = abortErr
+	} else if config.MetadataRequired && config.Stats.metadataFailures() > 0 {
+		err = fmt.Errorf("%d metadata uploads failed and metadata_required is set", config.Stats.metadataFailures())
+	}
+	// The uploads are complete, so downstream can be told about them.
+	if config.PostRunCommand != "" {
+		hookErr := runPostRunCommand(ctx, config, err)
+		if hookErr != nil {
+			log.Printf("Warning: %v", hookErr)
+			if config.PostRunRequired && err == nil {
+				err = hookErr
+			}
+		}
+	}
+
+	// Wait for the specified duration before stopping the generator, unless the
+	// program is being shut down. A run on a source video, or a benchmark, ends
+	// with its uploads.
+	if config.SourceVideo == "" && !config.bench {
+		select {
+		case <-ctx.Done():
+			if !errors.Is(ctx.Err(), context.DeadlineExceeded) && !errors.Is(context.Cause(ctx), ErrRetryBudget) {
+				log.Println("Shutdown requested, stopping.")
+			}
+		case <-time.After(time.Second * time.Duration(config.Duration)):
+		}
+	}
+	return err
+}
+
+// resolutionConfigs returns one configuration per entry in config.Resolutions, each
+// writing its local and remote outputs to a subdirectory named after the resolution.
+// When no list is configured the single config.Resolution is used unchanged.
+func resolutionConfigs(config Config) []Config {
+	if len(config.Resolutions) == 0 {
+		return []Config{config}
+	}
+
+	variants := make([]Config, 0, len(config.Resolutions))
+	for _, resolution := range config.Resolutions {
+		variant := config
+		variant.Resolution = resolution
+		variant.OutputDir = filepath.Join(config.OutputDir, resolution)
+		if config.RemoteDirTemplate != "" && !strings.Contains(config.RemoteDirTemplate, "{resolution}") {
+			variant.RemoteDirTemplate = filepath.Join(config.RemoteDirTemplate, resolution)
+		}
+		if config.VideoRemoteDir != "" {
+			variant.VideoRemoteDir = filepath.Join(config.VideoRemoteDir, resolution)
+		}
+		variant.TestVideoPath = filepath.Join(filepath.Dir(config.TestVideoPath), resolution, filepath.Base(config.TestVideoPath))
+		variant.SnapshotOutputDir = filepath.Join(config.SnapshotOutputDir, resolution)
+		variant.CsvOutputFile = filepath.Join(filepath.Dir(config.CsvOutputFile), resolution, filepath.Base(config.CsvOutputFile))
+		if config.ContactSheetPath != "" {
+			variant.ContactSheetPath = filepath.Join(filepath.Dir(config.ContactSheetPath), resolution, filepath.Base(config.ContactSheetPath))
+		}
+		if config.SpritePath != "" {
+			variant.SpritePath = filepath.Join(filepath.Dir(config.SpritePath), resolution, filepath.Base(config.SpritePath))
+		}
+		variants = append(variants, variant)
+	}
+	return variants
+}
+
+// generateAll runs the generation pipeline for each configuration, with at most
+// workers pipelines running concurrently, and returns once all have finished,
+// with the error of the first configuration that failed.
+func generateAll(ctx context.Context, variants []Config, workers int) error {
+	return runLimited(workers, len(variants), func(i int) error {
+		return generateOutputs(ctx, variants[i])
+	})
+}
+
+// generateOutputs generates the test video, its snapshots and the metadata for a
+// single resolution. Each step needs the output of the previous one.
+func generateOutputs(ctx context.Context, config Config) error {
+	log.Printf("Generating outputs for resolution %s...", config.Resolution)
+
+	generateVideo := !config.SnapshotsOnly && config.SourceVideo == ""
+	dirs := []string{config.OutputDir, filepath.Dir(config.CsvOutputFile)}
+	if generateVideo {
+		dirs = append(dirs, filepath.Dir(config.TestVideoPath))
+	}
+	for _, dir := range dirs {
+		err := createDirectory(dir)
+		if err != nil {
+			return fmt.Errorf("failed to create directory '%s': %v", dir, err)
+		}
+	}
+
+	stopTimer := config.Stats.timeStage("video")
+	if generateVideo && len(config.ABRLadder) > 0 {
+		err := generateLadder(ctx, config)
+		if err != nil {
+			return err
+		}
+		config.TestVideoPath = rungConfig(config, config.ABRLadder[0]).TestVideoPath
+	} else if generateVideo {
+		err := generateTestVideo(ctx, config)
+		if err != nil {
+			return err
+		}
+	}
+	stopTimer()
+	stopTimer = config.Stats.timeStage("snapshots")
+	err := generateSnapshots(ctx, config)
+	if err != nil {
+		return err
+	}
+	// The length of a source video is not known, and the number of scene changes
+	// depends on the video, so their snapshots are not counted.
+	if config.SourceVideo == "" && config.SceneChangeThreshold == 0 {
+		err = checkSnapshotCount(config)
+		if err != nil {
+			return err
+		}
+	}
+	stopTimer()
+	if config.ContactSheetPath != "" {
+		stopTimer = config.Stats.timeStage("contact_sheet")
+		err = generateContactSheet(ctx, config)
+		if err != nil {
+			return err
+		}
+		stopTimer()
+	}
+	if config.SpritePath != "" {
+		stopTimer = config.Stats.timeStage("sprite")
+		err = generateSprite(ctx, config)
+		if err != nil {
+			return err
+		}
+		stopTimer()
 	}
+	stopTimer = config.Stats.timeStage("metadata")
+	generateMetadata(config)
+	stopTimer()
+	return nil
+}
 
-	// Establish FTPS connection.
-	err = establishFTPConnection(&config)
+// checkSnapshotCount compares the number of generated snapshots with the number
+// expected from Duration and Interval. ffmpeg's fps filter may emit one extra frame
+// at the end of the video, so one snapshot more than expected is accepted. A
+// mismatch is logged as a warning, or returned as an error when
+// StrictSnapshotCount is set.
+func checkSnapshotCount(config Config) error {
+	expected := expectedSnapshotCount(config)
+
+	snapshotFiles, err := filepath.Glob(snapshotGlob(config))
 	if err != nil {
-		// If the FTPS connection cannot be established, the program logs the error and decides.
-		// whether to terminate or continue based on your logic.
-		log.Printf("Failed to establish FTPS connection: %v", err)
-		os.Exit(1)
+		return fmt.Errorf("failed to retrieve snapshot files: %v", err)
+	}
+	actual := len(snapshotFiles)
+	if actual == expected || actual == expected+1 {
+		return nil
+	}
 
+	err = fmt.Errorf("expected %d snapshots for resolution %s, found %d", expected, config.Resolution, actual)
+	if config.StrictSnapshotCount {
+		return err
+	}
+	log.Printf("Warning: %v", err)
+	return nil
+}
+
+// uploadOutputs uploads the snapshots, metadata and, optionally, the test video
+// of a single resolution.
+func uploadOutputs(ctx context.Context, config *Config) {
+	err := config.Uploader.MakeDir(remoteDir(*config))
+	if err != nil {
+		log.Printf("Failed to create remote directory '%s': %v", remoteDir(*config), err)
 	}
-	// Create channels to communicate between goroutines.
-	testVideoDone := make(chan bool)
-	snapshotsDone := make(chan bool)
-	//metadataDone := make(chan bool)
 
-	// Generate a test video with timestamp concurrently.
+	// A WaitGroup waits for a collection of goroutines to finish.
+	var wg sync.WaitGroup
+
+	// Upload snapshots and metadata concurrently
+	wg.Add(2)
 	go func() {
-		generateTestVideo(config)
-		testVideoDone <- true
+		defer wg.Done()
+		uploadSnapshots(ctx, config)
 	}()
 
 	go func() {
-		// Wait for test video to complete before generating snapshots.
-		<-testVideoDone
-		generateSnapshots(config)
-		snapshotsDone <- true
+		defer wg.Done()
+		uploadMetadata(ctx, config)
 	}()
 
-	go func() {
-		// Wait for snapshots to be generated before generating metadata
-		<-snapshotsDone
-		generateMetadata(config)
-	}()
+	if config.UploadVideo {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			uploadVideo(ctx, config)
+		}()
+	}
+
+	if config.ContactSheetPath != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			uploadContactSheet(ctx, config)
+		}()
+	}
+
+	if config.SpritePath != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			uploadSprite(ctx, config)
+		}()
+	}
+
+	if config.DebugFFmpeg && config.UploadFFmpegLogs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			uploadFFmpegLogs(ctx, config)
+		}()
+	}
+
+	wg.Wait() // Wait for all uploads to complete
+
+	if config.VerifyRemoteListing {
+		verifyRemote(config)
+	}
+}
+
+// remoteName expands RemoteNameTemplate for a file uploaded under basename.
+// {site} and {camera} come from the configuration, {basename} is the file's own
+// name and {timestamp} the Unix time of its last modification, or of the run
+// start for files that only exist in memory.
+func remoteName(config Config, basename string, localFile string) string {
+	timestamp := config.runTime
+	if info, err := os.Stat(localFile); err == nil {
+		timestamp = info.ModTime()
+	}
+	return strings.NewReplacer(
+		"{site}", config.Site,
+		"{camera}", config.Camera,
+		"{timestamp}", strconv.FormatInt(timestamp.Unix(), 10),
+		"{config_hash}", shortHash(config),
+		"{basename}", basename,
+	).Replace(config.RemoteNameTemplate)
+}
+
+// remoteDir returns the remote directory of the snapshots and metadata:
+// RemoteDirTemplate expanded with the settings of the run, or OutputDir when no
+// template is set. Empty settings expand to "unset", and separators within a
+// value are replaced, so that every placeholder yields exactly one path element.
+func remoteDir(config Config) string {
+	if config.RemoteDirTemplate == "" {
+		return config.OutputDir
+	}
+	value := func(v string) string {
+		v = strings.NewReplacer("/", "_", `\`, "_").Replace(v)
+		if v == "" || v == "." || v == ".." {
+			return "unset"
+		}
+		return v
+	}
+	number := func(n int) string {
+		if n == 0 {
+			return "unset"
+		}
+		return strconv.Itoa(n)
+	}
+	return filepath.Clean(strings.NewReplacer(
+		"{resolution}", value(config.Resolution),
+		"{fps}", number(config.FPS),
+		"{duration}", number(config.Duration),
+		"{site}", value(config.Site),
+		"{camera}", value(config.Camera),
+		"{date}", config.runTime.Format("2006-01-02"),
+		"{timestamp}", strconv.FormatInt(config.runTime.Unix(), 10),
+		"{config_hash}", value(shortHash(config)),
+	).Replace(config.RemoteDirTemplate))
+}
+
+// shortHash returns the first shortHashLength digits of the configuration hash
+// of the run.
+func shortHash(config Config) string {
+	return config.hash[:min(len(config.hash), shortHashLength)]
+}
+
+// videoRemoteDir returns the remote directory the test video is uploaded to.
+func videoRemoteDir(config Config) string {
+	if config.VideoRemoteDir != "" {
+		return config.VideoRemoteDir
+	}
+	return remoteDir(config)
+}
+
+// expectedRemoteFiles maps the remote path of every file uploaded for config to
+// its local path.
+func expectedRemoteFiles(config Config) (map[string]string, error) {
+	localFiles, err := uploadFiles(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve snapshot files: %v", err)
+	}
+	expected := make(map[string]string, len(localFiles)+2)
+	for _, file := range localFiles {
+		expected[filepath.Join(remoteDir(config), remoteName(config, filepath.Base(file), file))] = file
+	}
+	if !config.MetadataInMemory {
+		expected[filepath.Join(remoteDir(config), remoteName(config, metadataRemoteName(config), metadataFile(config)))] = metadataFile(config)
+	}
+	if config.UploadVideo && len(config.ABRLadder) > 0 {
+		for _, rung := range config.ABRLadder {
+			video := rungConfig(config, rung).TestVideoPath
+			expected[filepath.Join(videoRemoteDir(config), rungName(rung), remoteName(config, filepath.Base(video), video))] = video
+		}
+	} else if config.UploadVideo {
+		expected[filepath.Join(videoRemoteDir(config), remoteName(config, filepath.Base(config.TestVideoPath), config.TestVideoPath))] = config.TestVideoPath
+	}
+	if config.ContactSheetPath != "" {
+		expected[filepath.Join(remoteDir(config), remoteName(config, contactSheetRemoteName(config), config.ContactSheetPath))] = config.ContactSheetPath
+	}
+	if config.SpritePath != "" {
+		expected[filepath.Join(remoteDir(config), remoteName(config, spriteRemoteName(config), config.SpritePath))] = config.SpritePath
+		expected[filepath.Join(remoteDir(config), remoteName(config, spriteVTTRemoteName, spriteVTTPath(config)))] = spriteVTTPath(config)
+	}
+	if config.EncryptUploads {
+		encrypted := make(map[string]string, len(expected))
+		for remoteFile, file := range expected {
+			encrypted[remoteFile+encryptedSuffix] = file
+		}
+		return encrypted, nil
+	}
+	return expected, nil
+}
+
+// verifyRemote lists the remote directories and compares them with the local
+// files that were uploaded, logging every file that is missing on the server or
+// has a different size there. Discrepancies are counted in the run summary.
+func verifyRemote(config *Config) {
+	log.Printf("Verifying remote directory '%s'...", remoteDir(*config))
+
+	expected, err := expectedRemoteFiles(*config)
+	if err != nil {
+		log.Printf("Failed to prepare remote verification: %v", err)
+		return
+	}
+
+	listings := make(map[string]map[string]int64)
+	for remoteFile, file := range expected {
+		if config.unchangedFrames[remoteFile] {
+			continue
+		}
+		dir := filepath.Dir(remoteFile)
+		remoteFiles, ok := listings[dir]
+		if !ok {
+			remoteFiles, err = config.Uploader.List(dir)
+			if err != nil {
+				log.Printf("Failed to list remote directory '%s': %v", dir, err)
+				remoteFiles = nil
+			}
+			listings[dir] = remoteFiles
+		}
+		if remoteFiles == nil {
+			continue
+		}
+
+		info, err := os.Stat(file)
+		if err != nil {
+			log.Printf("Failed to retrieve file info for '%s': %v", file, err)
+			continue
+		}
+		// A file uploaded in parts is checked part by part.
+		sizes := map[string]int64{remoteFile: uploadedSize(*config, info.Size())}
+		if chunkedFile(*config, info.Size()) {
+			sizes = remoteParts(*config, remoteFile, info.Size())
+		}
+		for name, size := range sizes {
+			remoteSize, ok := remoteFiles[filepath.Base(name)]
+			switch {
+			case !ok:
+				log.Printf("Verification: '%s' is missing on the server", name)
+				config.Stats.countDiscrepancy()
+			case remoteSize != size:
+				log.Printf("Verification: '%s' is %d bytes on the server but %d bytes expected from the local file", name, remoteSize, size)
+				config.Stats.countDiscrepancy()
+			}
+		}
+	}
+
+	log.Println("Remote verification completed.")
+}
+
+// versionString describes the running build.
+func versionString() string {
+	return fmt.Sprintf("FTPDataGenerator %s (commit %s, built %s)", version, commit, buildDate)
+}
+
+// readConfig reads the configuration from the provided JSON files, or from
+// standard input for "-". Later files override the keys of earlier ones, see
+// mergeConfigLayers.
+func readConfig(files []string) (Config, error) {
+	var merged map[string]any
+	for _, file := range files {
+		layer, err := readConfigLayer(file)
+		if err != nil {
+			return Config{}, err
+		}
+		merged = mergeConfigLayers(merged, layer)
+	}
+
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return Config{}, err
+	}
+	return decodeConfig(bytes.NewReader(data), fmt.Sprintf("merged from %s", strings.Join(files, ", ")))
+}
+
+// decodeConfig decodes a JSON configuration from r over the default values. source
+// names r in error messages.
+func decodeConfig(r io.Reader, source string) (Config, error) {
+	config := defaultConfig()
+	decoder := json.NewDecoder(r)
+	// Reject unknown keys, so a misspelled or renamed field is reported instead of
+	// silently leaving the real field at its default.
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&config)
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid configuration %s: %v", source, err)
+	}
+
+	return config, nil
+}
+
+// defaultConfig returns the configuration values used for keys missing from the file.
+func defaultConfig() Config {
+	return Config{
+		Interval:                defaultInterval,
+		FTPPassive:              true,
+		FTPTLSSessionCache:      true,
+		OverwriteLocal:          true,
+		WatchPattern:            "*.mp4",
+		OverlayMode:             "localtime",
+		OverlayElapsedFormat:    "hms",
+		SpriteColumns:           10,
+		FFmpegLogLevel:          "warning",
+		SpriteTileWidth:         160,
+		LogFormat:               "text",
+		OverlayBaseTime:         "2000-01-01T00:00:00Z",
+		WatchDebounceMs:         2000,
+		Workers:                 1,
+		SnapshotNameTemplate:    defaultSnapshotNameTemplate,
+		GlobMaxAttempts:         5,
+		UploadOrder:             "lexical",
+		RemoteNameTemplate:      "{basename}",
+		DialTimeout:             5,
+		BaseTimeout:             10,
+		TransferTimeout:         300,
+		UnchangedFrameThreshold: 1,
+		TimestampLayout:         "20060102T150405",
+		ChunkSize:               8 << 20,
+	}
+}
+
+// The IANA dynamic (ephemeral) port range, used to validate the active-mode port range.
+const (
+	ephemeralPortMin = 49152
+	ephemeralPortMax = 65535
+)
+
+// bitratePattern matches ffmpeg bitrates such as "800k", "2M" or "1.5M".
+var bitratePattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?[kKmMgG]?$`)
+
+// validateConfig checks the configuration for values that cannot work, so the
+// program fails at startup instead of part way through a run.
+func validateConfig(config Config) error {
+	if config.VideoBitrate != "" && config.VideoCRF != nil {
+		return fmt.Errorf("video_bitrate and video_crf are mutually exclusive, set only one")
+	}
+	if config.VideoBitrate != "" && !bitratePattern.MatchString(config.VideoBitrate) {
+		return fmt.Errorf("video_bitrate must be a number with an optional k, M or G suffix, got %q", config.VideoBitrate)
+	}
+	if config.VideoCRF != nil && (*config.VideoCRF < 0 || *config.VideoCRF > 63) {
+		return fmt.Errorf("video_crf must be between 0 and 63, got %d", *config.VideoCRF)
+	}
+	if err := validateVideoContainer(config); err != nil {
+		return err
+	}
+	for key, value := range config.VideoMetadata {
+		if !videoMetadataKeyPattern.MatchString(key) {
+			return fmt.Errorf("video_metadata keys must be letters, digits, '_' or '-', got %q", key)
+		}
+		if strings.ContainsAny(value, "\x00\r\n") {
+			return fmt.Errorf("video_metadata value of %q must be a single line", key)
+		}
+	}
+	if config.SnapshotFPS < 0 {
+		return fmt.Errorf("snapshot_fps must be positive, got %v", config.SnapshotFPS)
+	}
+	if config.SnapshotCount < 0 {
+		return fmt.Errorf("snapshot_count must be positive, got %d", config.SnapshotCount)
+	}
+	if config.SnapshotCount > 0 {
+		// The default interval gives way, so that snapshot_count can be set alone.
+		if (config.Interval != 0 && config.Interval != defaultInterval) || config.SnapshotFPS != 0 {
+			return fmt.Errorf("only one of interval, snapshot_fps and snapshot_count may be set")
+		}
+		if config.Duration <= 0 {
+			return fmt.Errorf("snapshot_count needs a positive duration, got %d", config.Duration)
+		}
+	} else if config.SnapshotFPS == 0 && config.Interval <= 0 {
+		return fmt.Errorf("interval must be positive, got %s", config.Interval)
+	} else if config.SnapshotFPS == 0 && config.FPS > 0 && config.Interval.Seconds() < 1/float64(config.FPS) {
+		log.Printf("Warning: interval %s is shorter than one frame at %d fps, frames will be duplicated", config.Interval, config.FPS)
+	}
+	if config.SnapshotFPS > float64(config.FPS) {
+		log.Printf("Warning: snapshot_fps %v exceeds the video frame rate %d, frames will be duplicated", config.SnapshotFPS, config.FPS)
+	}
+	if strings.Count(config.SnapshotNameTemplate, "{idx}") != 1 {
+		return fmt.Errorf("snapshot_name_template must contain {idx} exactly once, got %q", config.SnapshotNameTemplate)
+	}
+	if strings.ContainsAny(config.SnapshotNameTemplate, `/\`) {
+		return fmt.Errorf("snapshot_name_template must be a file name, got %q", config.SnapshotNameTemplate)
+	}
+	if stamp := time.Now().Format(config.TimestampLayout); stamp == "" || strings.ContainsAny(stamp, unsafeFileNameChars) {
+		return fmt.Errorf("timestamp_layout must format to a non-empty file name without spaces or any of %s, got %q", strings.TrimSpace(unsafeFileNameChars), stamp)
+	}
+	switch config.TransferProtocol {
+	case "", "ftp":
+	case "s3":
+		if config.S3Bucket == "" {
+			return fmt.Errorf("s3_bucket must be set when transfer_protocol is \"s3\"")
+		}
+	case "sftp":
+		if config.SFTPHost == "" || config.SFTPUser == "" {
+			return fmt.Errorf("sftp_host and sftp_user must be set when transfer_protocol is \"sftp\"")
+		}
+		if config.SFTPPort < 0 || config.SFTPPort > 65535 {
+			return fmt.Errorf("sftp_port must be between 1 and 65535, got %d", config.SFTPPort)
+		}
+		if config.SFTPKnownHosts == "" {
+			return fmt.Errorf("sftp_known_hosts must be set when transfer_protocol is \"sftp\", the host key of the server is checked against it")
+		}
+		if config.SFTPPassword == "" && config.SFTPPrivateKey == "" {
+			return fmt.Errorf("sftp_password or sftp_private_key must be set when transfer_protocol is \"sftp\"")
+		}
+	case "tcp":
+		if _, _, err := net.SplitHostPort(config.TCPAddress); err != nil {
+			return fmt.Errorf("tcp_address must be host:port when transfer_protocol is \"tcp\", got %q", config.TCPAddress)
+		}
+		if config.VerifyRemoteListing {
+			return fmt.Errorf("verify_remote_listing cannot be used with transfer_protocol \"tcp\", which has no listing")
+		}
+	default:
+		return fmt.Errorf("unsupported transfer_protocol %q", config.TransferProtocol)
+	}
+	if config.AtomicRemoteUpload && config.TransferProtocol != "" && config.TransferProtocol != "ftp" {
+		return fmt.Errorf("atomic_remote_upload only applies to transfer_protocol \"ftp\", not %q", config.TransferProtocol)
+	}
+	if config.GlobStableWindowMs < 0 || config.GlobMaxAttempts < 1 {
+		return fmt.Errorf("glob_stable_window_ms must not be negative and glob_max_attempts must be at least 1")
+	}
+	if config.RemoteNameTemplate == "" || strings.ContainsAny(config.RemoteNameTemplate, `/\`) {
+		return fmt.Errorf("remote_name_template must be a non-empty file name, got %q", config.RemoteNameTemplate)
+	}
+	switch config.FTPTLS {
+	case "", "explicit", "implicit":
+	default:
+		return fmt.Errorf("ftp_tls must be \"explicit\" or \"implicit\", got %q", config.FTPTLS)
+	}
+	if config.FTPAccount != "" && config.FTPTLS == "explicit" {
+		return fmt.Errorf("ftp_account cannot be used with explicit FTPS, use implicit FTPS or plain FTP")
+	}
+	if strings.ContainsAny(config.FTPAccount, "\r\n") {
+		return fmt.Errorf("ftp_account must be a single line")
+	}
+	if (config.TLSClientCert == "") != (config.TLSClientKey == "") {
+		return fmt.Errorf("tls_client_cert and tls_client_key must be set together")
+	}
+	if config.PinnedCertSHA256 != "" {
+		if config.FTPTLS == "" {
+			return fmt.Errorf("pinned_cert_sha256 requires FTPS, set ftp_tls")
+		}
+		if _, err := parseCertFingerprint(config.PinnedCertSHA256); err != nil {
+			return err
+		}
+	}
+	if config.SOCKS5Proxy.Address != "" {
+		if _, _, err := net.SplitHostPort(config.SOCKS5Proxy.Address); err != nil {
+			return fmt.Errorf("socks5_proxy address must be host:port, got '%s'", config.SOCKS5Proxy.Address)
+		}
+	}
+	if config.SOCKS5Proxy.Password != "" && config.SOCKS5Proxy.User == "" {
+		return fmt.Errorf("socks5_proxy password requires a user")
+	}
+	if config.TLSClientCert != "" && config.FTPTLS == "" {
+		return fmt.Errorf("tls_client_cert requires FTPS, set ftp_tls")
+	}
+	if !config.FTPPassive && config.FTPTLS == "explicit" {
+		return fmt.Errorf("ftp_passive false cannot be used with explicit FTPS, use implicit FTPS or plain FTP")
+	}
+	if !config.FTPPassive && config.SOCKS5Proxy.Address != "" {
+		return fmt.Errorf("ftp_passive false cannot be used with socks5_proxy, the server cannot connect back through the proxy")
+	}
+	if !slices.Contains(ffmpegLogLevels, config.FFmpegLogLevel) {
+		return fmt.Errorf("ffmpeg_loglevel must be one of %s, got %q", strings.Join(ffmpegLogLevels, ", "), config.FFmpegLogLevel)
+	}
+	if config.UploadFFmpegLogs && !config.DebugFFmpeg {
+		return fmt.Errorf("upload_ffmpeg_logs requires debug_ffmpeg")
+	}
+	if config.RetryBudget < 0 {
+		return fmt.Errorf("retry_budget must not be negative")
+	}
+	if config.MaxUploadBytes < 0 {
+		return fmt.Errorf("max_upload_bytes must not be negative")
+	}
+	if config.MaxConsecutiveFailures < 0 {
+		return fmt.Errorf("max_consecutive_failures must not be negative")
+	}
+	if config.DialTimeout < 1 || config.TransferTimeout < 0 {
+		return fmt.Errorf("dial_timeout must be at least 1 and transfer_timeout must not be negative")
+	}
+	if config.AssumedMinBps < 0 {
+		return fmt.Errorf("assumed_min_bps must not be negative, got %d", config.AssumedMinBps)
+	}
+	if config.AssumedMinBps > 0 && config.BaseTimeout < 1 {
+		return fmt.Errorf("base_timeout must be at least 1 with assumed_min_bps, got %d", config.BaseTimeout)
+	}
+	for ext, transferType := range config.FTPTransferTypes {
+		if !strings.HasPrefix(ext, ".") || strings.ContainsAny(ext, `/\`) {
+			return fmt.Errorf("ftp_transfer_types keys must be file extensions such as \".csv\", got %q", ext)
+		}
+		if transferType != "binary" && transferType != "ascii" {
+			return fmt.Errorf("ftp_transfer_types values must be \"binary\" or \"ascii\", got %q for %q", transferType, ext)
+		}
+	}
+	if config.SourceVideo != "" || config.WatchDir != "" {
+		if config.SnapshotsOnly || len(config.Resolutions) > 0 || config.SnapshotSegments > 1 {
+			return fmt.Errorf("source_video and watch_dir cannot be used with snapshots_only, resolutions or snapshot_segments")
+		}
+	}
+	if config.SourceVideo != "" && !fileExists(config.SourceVideo) {
+		return fmt.Errorf("source_video '%s' does not exist", config.SourceVideo)
+	}
+	if config.WatchDir != "" {
+		if info, err := os.Stat(config.WatchDir); err != nil || !info.IsDir() {
+			return fmt.Errorf("watch_dir '%s' is not a directory", config.WatchDir)
+		}
+		if _, err := filepath.Match(config.WatchPattern, ""); err != nil || config.WatchPattern == "" {
+			return fmt.Errorf("watch_pattern must be a file name pattern, got '%s'", config.WatchPattern)
+		}
+		if config.WatchDebounceMs < 0 {
+			return fmt.Errorf("watch_debounce_ms must not be negative, got %d", config.WatchDebounceMs)
+		}
+	}
+	if config.AppendRemote && config.MetadataInMemory {
+		return fmt.Errorf("append_remote needs the local metadata file, it cannot be used with metadata_in_memory")
+	}
+	if config.SnapshotsOnly && config.UploadVideo {
+		return fmt.Errorf("upload_video cannot be used with snapshots_only, no test video is generated")
+	}
+	if config.SnapshotsOnly && config.KeyframesOnly {
+		return fmt.Errorf("keyframes_only cannot be used with snapshots_only, which decodes no video")
+	}
+	if config.SceneChangeThreshold < 0 || config.SceneChangeThreshold >= 1 {
+		return fmt.Errorf("scene_change_threshold must be between 0 and 1, got %v", config.SceneChangeThreshold)
+	}
+	if config.SceneChangeThreshold > 0 {
+		if config.KeyframesOnly || config.SnapshotFPS != 0 || config.SnapshotCount != 0 {
+			return fmt.Errorf("scene_change_threshold is a sampling mode of its own, it cannot be used with keyframes_only, snapshot_fps or snapshot_count")
+		}
+		if config.SnapshotSegments > 1 || config.SpritePath != "" {
+			return fmt.Errorf("scene_change_threshold cannot be used with snapshot_segments or sprite_path, which need snapshots at regular times")
+		}
+	}
+	if config.MaxRuntime != "" {
+		maxRuntime, err := time.ParseDuration(config.MaxRuntime)
+		if err != nil || maxRuntime <= 0 {
+			return fmt.Errorf("max_runtime must be a positive duration such as \"30m\", got '%s'", config.MaxRuntime)
+		}
+	}
+	if config.ReportWebhookURL != "" {
+		u, err := url.Parse(config.ReportWebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("report_webhook_url must be an http or https URL, got '%s'", config.ReportWebhookURL)
+		}
+	}
+	for _, pattern := range append(append([]string{}, config.UploadInclude...), config.UploadExclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil || strings.ContainsAny(pattern, `/\`) {
+			return fmt.Errorf("upload_include and upload_exclude must be file name patterns, got '%s'", pattern)
+		}
+	}
+	if !slices.Contains(uploadOrders, config.UploadOrder) {
+		return fmt.Errorf("upload_order must be \"lexical\", \"numeric\" or \"mtime\", got %q", config.UploadOrder)
+	}
+	switch config.OverlayMode {
+	case "", "localtime", "frame", "fixed_time", "elapsed":
+	default:
+		return fmt.Errorf("overlay_mode must be \"localtime\", \"frame\", \"fixed_time\" or \"elapsed\", got %q", config.OverlayMode)
+	}
+	if _, ok := elapsedFormats[config.OverlayElapsedFormat]; !ok {
+		return fmt.Errorf("overlay_elapsed_format must be \"hms\" or \"seconds\", got %q", config.OverlayElapsedFormat)
+	}
+	if config.Timezone != "" {
+		if _, err := time.LoadLocation(config.Timezone); err != nil {
+			return fmt.Errorf("timezone must be an IANA time zone name such as \"Europe/Berlin\", got %q: %v", config.Timezone, err)
+		}
+	}
+	if _, err := time.Parse(time.RFC3339, config.OverlayBaseTime); err != nil && config.OverlayMode == "fixed_time" {
+		return fmt.Errorf("overlay_base_time must be an RFC 3339 time such as \"2000-01-01T00:00:00Z\", got %q", config.OverlayBaseTime)
+	}
+	if config.FontPath != "" && !fileExists(config.FontPath) {
+		return fmt.Errorf("font_path '%s' does not exist, run with -list-fonts to find one", config.FontPath)
+	}
+	for _, column := range config.MetadataColumns {
+		if _, ok := metadataHeaders[column]; !ok {
+			return fmt.Errorf("unknown metadata column '%s', supported are filename, creation_time, size, sha256, width, height, index, type, content_type, keyframe, config_hash and source_time", column)
+		}
+		if column == "keyframe" && !config.KeyframesOnly {
+			return fmt.Errorf("metadata column 'keyframe' requires keyframes_only")
+		}
+		if column == "source_time" && config.SceneChangeThreshold == 0 {
+			return fmt.Errorf("metadata column 'source_time' requires scene_change_threshold")
+		}
+	}
+	if err := validateSnapshotFormat(config); err != nil {
+		return err
+	}
+	if (config.Latitude == nil) != (config.Longitude == nil) {
+		return fmt.Errorf("latitude and longitude must be set together")
+	}
+	if config.Latitude != nil && (*config.Latitude < -90 || *config.Latitude > 90 || *config.Longitude < -180 || *config.Longitude > 180) {
+		return fmt.Errorf("latitude must be between -90 and 90 and longitude between -180 and 180, got %g and %g", *config.Latitude, *config.Longitude)
+	}
+	if config.EmbedExif && config.Latitude == nil {
+		return fmt.Errorf("embed_exif requires latitude and longitude")
+	}
+	for _, r := range config.ExifCameraModel {
+		if r < ' ' || r > '~' {
+			return fmt.Errorf("exif_camera_model must be printable ASCII, got %q", config.ExifCameraModel)
+		}
+	}
+	if config.ContactSheetPath != "" {
+		switch strings.ToLower(filepath.Ext(config.ContactSheetPath)) {
+		case ".jpg", ".jpeg", ".png":
+		default:
+			return fmt.Errorf("contact_sheet_path must end in .jpg, .jpeg or .png, got '%s'", config.ContactSheetPath)
+		}
+	}
+	if config.SpritePath != "" {
+		switch strings.ToLower(filepath.Ext(config.SpritePath)) {
+		case ".jpg", ".jpeg", ".png":
+		default:
+			return fmt.Errorf("sprite_path must end in .jpg, .jpeg or .png, got '%s'", config.SpritePath)
+		}
+		if config.SpriteColumns < 1 || config.SpriteTileWidth < 1 {
+			return fmt.Errorf("sprite_columns and sprite_tile_width must be at least 1")
+		}
+		if config.KeyframesOnly {
+			return fmt.Errorf("sprite_path needs snapshots at regular times, it cannot be used with keyframes_only")
+		}
+	}
+	if config.SnapshotSegments < 0 || config.SnapshotWorkers < 0 {
+		return fmt.Errorf("snapshot_segments and snapshot_workers must not be negative")
+	}
+	if config.UploadDelayMs < 0 {
+		return fmt.Errorf("upload_delay_ms must not be negative, got %d", config.UploadDelayMs)
+	}
+	if config.EncryptUploads && os.Getenv(passphraseEnv) == "" {
+		return fmt.Errorf("encrypt_uploads needs a passphrase in the %s environment variable", passphraseEnv)
+	}
+	if config.MaxConcurrency < 0 {
+		return fmt.Errorf("max_concurrency must not be negative, got %d", config.MaxConcurrency)
+	}
+	if config.UnchangedFrameThreshold < 0 || config.UnchangedFrameThreshold > 100 {
+		return fmt.Errorf("unchanged_frame_threshold must be between 0 and 100, got %v", config.UnchangedFrameThreshold)
+	}
+	if config.ChunkedUpload && config.ChunkSize < 1 {
+		return fmt.Errorf("chunk_size must be at least 1 byte, got %d", config.ChunkSize)
+	}
+	if config.PostRunCommand == "" && (len(config.PostRunArgs) > 0 || config.PostRunRequired) {
+		return fmt.Errorf("post_run_args and post_run_required need post_run_command")
+	}
+	if config.FFmpegThreads < 0 {
+		return fmt.Errorf("ffmpeg_threads must not be negative, got %d", config.FFmpegThreads)
+	}
+	if config.Workers < 1 {
+		return fmt.Errorf("workers must be at least 1, got %d", config.Workers)
+	}
+	if config.FTPActivePortMin != 0 || config.FTPActivePortMax != 0 {
+		if config.FTPActivePortMin > config.FTPActivePortMax {
+			return fmt.Errorf("ftp_active_port_min (%d) must not be greater than ftp_active_port_max (%d)",
+				config.FTPActivePortMin, config.FTPActivePortMax)
+		}
+		if config.FTPActivePortMin < ephemeralPortMin || config.FTPActivePortMax > ephemeralPortMax {
+			return fmt.Errorf("ftp active port range %d-%d must be within the ephemeral range %d-%d",
+				config.FTPActivePortMin, config.FTPActivePortMax, ephemeralPortMin, ephemeralPortMax)
+		}
+	}
+	switch config.LogFormat {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf("log_format must be \"text\" or \"json\", got %q", config.LogFormat)
+	}
+	err := validateLadder(config)
+	if err != nil {
+		return err
+	}
+	err = validateColor(config)
+	if err != nil {
+		return err
+	}
+	if _, ok := config.Profiles[config.Profile]; config.Profile != "" && !ok {
+		return fmt.Errorf("unknown profile '%s', defined are: %s", config.Profile, profileNames(config))
+	}
+	return validateDestinations(config)
+}
+
+// createDirectory checks if the directory exists and creates it if it doesn't.
+func createDirectory(dir string) error {
+	_, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		err = os.MkdirAll(dir, os.ModePerm)
+		if err != nil {
+			return fmt.Errorf("failed to create directory: %v", err)
+		}
+		recordCreatedDir(dir)
+	}
+	return nil
+}
+
+// cleanup removes the output directory, but only when this run created it and it
+// is not a suspiciously broad path, see safeToRemove.
+func cleanup(config Config) {
+	log.Println("Performing cleanup...")
+	err := safeToRemove(config.OutputDir)
+	if err != nil {
+		log.Printf("REFUSING to clean up output directory '%s': %v", config.OutputDir, err)
+		return
+	}
+	err = os.RemoveAll(config.OutputDir)
+	if err != nil {
+		log.Printf("Failed to clean up output directory: %v", err)
+	}
+	log.Println("Cleanup complete.")
+}
+
+// generateTestVideo generates a test video with timestamp. ffmpeg can exit
+// successfully without writing the video, for example when the drawtext font is
+// missing, so the output file is checked as well. The video is rendered in a
+// temporary directory and only moved to TestVideoPath once complete.
+func generateTestVideo(ctx context.Context, config Config) error {
+	log.Println("Generating test video...")
+	if !config.OverwriteLocal && fileExists(config.TestVideoPath) {
+		return fmt.Errorf("test video '%s' already exists and overwrite_local is false", config.TestVideoPath)
+	}
+	workDir, err := makeWorkDir(config, filepath.Dir(config.TestVideoPath))
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %v", err)
+	}
+	defer removeWorkDir(workDir)
+	workFile := filepath.Join(workDir, filepath.Base(config.TestVideoPath))
+
+	args := append([]string{ffmpegOverwriteFlag(config)}, testSourceArgs(config)...)
+	args = append(args, "-vf", overlayFilter(config))
+	if config.KeyframesOnly {
+		args = append(args, "-force_key_frames", "expr:gte(t,n_forced*"+formatSeconds(snapshotPeriod(config))+")")
+	}
+	if config.VideoBitrate != "" {
+		args = append(args, "-b:v", config.VideoBitrate)
+	}
+	if config.VideoCRF != nil {
+		args = append(args, "-crf", strconv.Itoa(*config.VideoCRF))
+	}
+	args = append(args, threadArgs(config)...)
+	args = append(args, colorArgs(config)...)
+	args = append(args, videoMetadataArgs(config)...)
+	args = append(args, config.FFmpegExtraArgs...)
+	args = append(args, containerArgs(config)...)
+	args = append(args, workFile)
+
+	// The rungs of a ladder share OutputDir, so each log is named after its rung.
+	logName := "video"
+	if len(config.ABRLadder) > 0 {
+		logName += "-" + filepath.Base(filepath.Dir(config.TestVideoPath))
+	}
+	err = runFFmpeg(ctx, config, logName, args)
+	if err != nil {
+		return fmt.Errorf("failed to generate test video: %v", err)
+	}
+	err = checkOutputFile(workFile)
+	if err != nil {
+		return fmt.Errorf("ffmpeg did not produce the test video: %v", err)
+	}
+	err = moveFile(workFile, config.TestVideoPath)
+	if err != nil {
+		return fmt.Errorf("failed to move test video to '%s': %v", config.TestVideoPath, err)
+	}
+	log.Println("Test video generation completed.")
+	return nil
+}
+
+// overlayFilter draws the overlay text selected by OverlayMode at the bottom of
+// the test pattern, with the font chosen by findFont.
+func overlayFilter(config Config) string {
+	font := ""
+	if fontFile := findFont(config); fontFile != "" {
+		font = "fontfile='" + escapeFilterValue(fontFile) + "':"
+	}
+	return "drawtext=" + font + "text='" + overlayText(config) + "':x=(w-tw)/2:y=h-(2*lh):fontcolor=white:fontsize=12:box=1:boxcolor=black@0.5"
+}
+
+// elapsedFormats maps the values of OverlayElapsedFormat to the drawtext pts
+// formats.
+var elapsedFormats = map[string]string{
+	"hms":     "hms",
+	"seconds": "flt",
+}
+
+// overlayText returns the drawtext expansion of OverlayMode. The "frame",
+// "fixed_time" and "elapsed" modes only depend on the frame, so that identical
+// configurations render identical frames.
+func overlayText(config Config) string {
+	switch config.OverlayMode {
+	case "frame":
+		return "%{n}"
+	case "fixed_time":
+		base, _ := time.Parse(time.RFC3339, config.OverlayBaseTime)
+		return fmt.Sprintf(`%%{pts\:gmtime\:%d}`, base.Unix())
+	case "elapsed":
+		return `%{pts\:` + elapsedFormats[config.OverlayElapsedFormat] + `}`
+	default:
+		return "%{localtime}"
+	}
+}
+
+// ffmpegOverwriteFlag returns the ffmpeg option matching OverwriteLocal, so that
+// ffmpeg never stops to ask whether to overwrite a file.
+func ffmpegOverwriteFlag(config Config) string {
+	if config.OverwriteLocal {
+		return "-y"
+	}
+	return "-n"
+}
+
+// testSourceArgs returns the ffmpeg input arguments of the generated test pattern.
+func testSourceArgs(config Config) []string {
+	return []string{"-f", "lavfi", "-i",
+		fmt.Sprintf("testsrc=duration=%d:size=%s:rate=%d", config.Duration, config.Resolution, config.FPS)}
+}
+
+// checkOutputFile returns an error when file is missing or empty.
+func checkOutputFile(file string) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return fmt.Errorf("'%s' is empty", file)
+	}
+	return nil
+}
+
+// generateSnapshots generates snapshots from the test video at regular intervals,
+// or straight from the test pattern when SnapshotsOnly is set. Like
+// generateTestVideo, it checks that ffmpeg actually wrote non-empty files, and
+// the snapshots are written to a temporary directory before being moved into
+// SnapshotOutputDir.
+func generateSnapshots(ctx context.Context, config Config) error {
+	log.Println("Generating snapshots...")
+	if config.SnapshotFormat != "" {
+		warnSnapshotSize(config)
+	}
+
+	// Before we start generating snapshots, we want to make sure that the directory
+	// where we're going to save the snapshots exists. The os.MkdirAll function
+	// creates a directory named by the path 'snapshotOutputDir', along with any necessary parents,
+	// and returns nil if successful. The permission bits perm (before umask) are set for
+	// all directories that MkdirAll creates. If the directory already exists, MkdirAll does nothing
+	// and returns nil. In this case, we're setting the permissions to 0777, which means
+	// everyone can read, write, and execute.
+	// and later we can set the permissions 0755 (which means the owner can read,
+	// write, and execute, while others can read and execute
+
+	err := os.MkdirAll(config.SnapshotOutputDir, 0777)
+	if err != nil {
+		// If an error occurred while trying to create the directory, we return the
+		// error and exit the function.
+		return fmt.Errorf("failed to create directory '%s': %v", config.SnapshotOutputDir, err)
+	}
+
+	if !config.OverwriteLocal {
+		existing, err := filepath.Glob(snapshotGlob(config))
+		if err != nil {
+			return fmt.Errorf("failed to retrieve snapshot files: %v", err)
+		}
+		if len(existing) > 0 {
+			return fmt.Errorf("%d snapshots already exist in '%s' and overwrite_local is false", len(existing), config.SnapshotOutputDir)
+		}
+	}
+
+	// ffmpeg writes into a temporary work directory, so that readers of
+	// 'snapshotOutputDir' never see a partially written snapshot.
+	workDir, err := makeWorkDir(config, config.SnapshotOutputDir)
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %v", err)
+	}
+	defer removeWorkDir(workDir)
+	work := config
+	work.SnapshotOutputDir = workDir
+
+	// We're using the ffmpeg tool to generate snapshots from the test video.
+	// The snapshots are saved in the work directory, with the filename
+	// built from the snapshot name template, "snapshot%03d.jpg" by default.
+
+	// Any extra ffmpeg arguments from the configuration go right before the output.
+	// With SnapshotSegments, several ffmpeg processes share the work instead.
+	if config.SnapshotSegments > 1 {
+		err = generateSnapshotSegments(ctx, config, work)
+	} else {
+		args := append([]string{ffmpegOverwriteFlag(config)}, snapshotArgs(config)...)
+		if config.SnapshotCount > 0 {
+			// The fps filter may emit one frame more at the end of the video.
+			args = append(args, "-frames:v", strconv.Itoa(config.SnapshotCount))
+		}
+		args = append(args, threadArgs(config)...)
+		args = append(args, colorArgs(config)...)
+		args = append(args, snapshotFormatArgs(config)...)
+		args = append(args, config.FFmpegExtraArgs...)
+		args = append(args, snapshotPattern(work))
+
+		// Run the ffmpeg command and wait for it to finish.
+		err = runFFmpeg(ctx, config, "snapshots", args)
+	}
+	if err != nil {
+		// If an error occurred while running the ffmpeg command, we return the error.
+		return fmt.Errorf("failed to generate snapshots: %v", err)
+	}
+
+	// Make sure ffmpeg wrote at least one snapshot and none of them is empty.
+	snapshotFiles, err := filepath.Glob(snapshotGlob(work))
+	if err != nil {
+		return fmt.Errorf("failed to retrieve snapshot files: %v", err)
+	}
+	if len(snapshotFiles) == 0 {
+		return fmt.Errorf("ffmpeg produced no snapshots in '%s'", workDir)
+	}
+	for _, file := range snapshotFiles {
+		err = checkOutputFile(file)
+		if err != nil {
+			return fmt.Errorf("ffmpeg did not produce a valid snapshot: %v", err)
+		}
+	}
+	if config.EmbedExif {
+		err = embedSnapshotExif(config, snapshotFiles)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Move the complete snapshots to their final location.
+	for _, file := range snapshotFiles {
+		target := filepath.Join(config.SnapshotOutputDir, filepath.Base(file))
+		err = moveFile(file, target)
+		if err != nil {
+			return fmt.Errorf("failed to move snapshot to '%s': %v", target, err)
+		}
+	}
+
+	// Finally, we log that the snapshot generation has completed.
+	log.Println("Snapshot generation completed.")
+	return nil
+}
+
+// snapshotArgs returns the ffmpeg input and filter arguments producing the
+// snapshots: the test video, or the test pattern itself with SnapshotsOnly.
+// With KeyframesOnly the decoder skips all other frames.
+func snapshotArgs(config Config) []string {
+	var args []string
+	switch {
+	case config.SnapshotsOnly:
+		args = append(testSourceArgs(config), "-vf", overlayFilter(config)+","+snapshotFilter(config))
+	case config.KeyframesOnly:
+		return []string{"-skip_frame", "nokey", "-i", config.TestVideoPath, "-vf", keyframeFilter(config), "-fps_mode", "vfr"}
+	default:
+		args = []string{"-i", config.TestVideoPath, "-vf", snapshotFilter(config)}
+	}
+	if config.SceneChangeThreshold > 0 {
+		// Without it ffmpeg would repeat the frames taken to keep the frame rate.
+		args = append(args, "-fps_mode", "vfr")
+	}
+	return args
+}
+
+// keyframeFilter returns the ffmpeg select filter thinning out the keyframes of
+// the video for KeyframesOnly: the first keyframe is taken, then each keyframe at
+// least 90% of the snapshot period after the last one taken. The margin keeps
+// keyframes forced at the snapshot times, which land on the next frame, from
+// being dropped for falling a frame short of the period.
+func keyframeFilter(config Config) string {
+	return "select='isnan(prev_selected_t)+gte(t-prev_selected_t," + formatSeconds(0.9*snapshotPeriod(config)) + ")'"
+}
+
+// snapshotFilter returns the ffmpeg filter sampling the video: the frames of
+// scene changes with SceneChangeThreshold, otherwise an fps filter taking
+// SnapshotFPS frames per second when set, or one frame every Interval.
+func snapshotFilter(config Config) string {
+	if config.SceneChangeThreshold > 0 {
+		return sceneFilter(config)
+	}
+	if config.SnapshotCount > 0 {
+		return fmt.Sprintf("fps=%d/%d", config.SnapshotCount, config.Duration)
+	}
+	if config.SnapshotFPS > 0 {
+		return "fps=" + strconv.FormatFloat(config.SnapshotFPS, 'f', -1, 64)
+	}
+	return "fps=" + config.Interval.rate()
+}
+
+// expectedSnapshotCount returns the number of snapshots the fps filter should
+// produce for the video duration.
+func expectedSnapshotCount(config Config) int {
+	if config.SnapshotCount > 0 {
+		return config.SnapshotCount
+	}
+	if config.SnapshotFPS > 0 {
+		return int(float64(config.Duration) * config.SnapshotFPS)
+	}
+	return int(int64(config.Duration) * int64(time.Second) / int64(config.Interval))
+}
+
+// defaultInterval is the Interval of a configuration that does not set one.
+const defaultInterval = flexDuration(time.Second)
+
+// defaultSnapshotNameTemplate names snapshots snapshot001.jpg, snapshot002.jpg, ...
+const defaultSnapshotNameTemplate = "snapshot{idx}.jpg"
+
+// unsafeFileNameChars are the characters TimestampLayout must not produce, as
+// they are invalid or awkward in file names on some systems.
+const unsafeFileNameChars = ` /\:*?"<>|`
+
+// runStamp returns the run timestamp formatted with TimestampLayout.
+func runStamp(config Config) string {
+	return config.runTime.Format(config.TimestampLayout)
+}
+
+// stampArtifacts returns config with the run timestamp appended to the name of
+// the test video, before its extension, and of SnapshotOutputDir, so that
+// "test.mp4" becomes "test-20240131T120000.mp4". Every later path, per
+// resolution, rung or upload, derives from these two, so they all agree. A
+// source video is not renamed.
+func stampArtifacts(config Config) Config {
+	stamp := runStamp(config)
+	if config.SourceVideo == "" {
+		ext := filepath.Ext(config.TestVideoPath)
+		config.TestVideoPath = strings.TrimSuffix(config.TestVideoPath, ext) + "-" + stamp + ext
+	}
+	config.SnapshotOutputDir = filepath.Clean(config.SnapshotOutputDir) + "-" + stamp
+	return config
+}
+
+// snapshotName expands the snapshot name template. {ts} and {res} are replaced by
+// the run timestamp and the resolution, escaped with escape, and {idx} by index.
+func snapshotName(config Config, index string, escape func(string) string) string {
+	replacer := strings.NewReplacer("{ts}", runStamp(config), "{res}", config.Resolution)
+	parts := strings.Split(snapshotTemplate(config), "{idx}")
+	for i, part := range parts {
+		parts[i] = escape(replacer.Replace(part))
+	}
+	return strings.Join(parts, index)
+}
+
+// snapshotPattern returns the ffmpeg output pattern for the snapshot files.
+func snapshotPattern(config Config) string {
+	escapePercent := func(s string) string { return strings.ReplaceAll(s, "%", "%%") }
+	return filepath.Join(config.SnapshotOutputDir, snapshotName(config, "%03d", escapePercent))
+}
+
+// snapshotGlob returns the glob pattern matching the files written to snapshotPattern.
+func snapshotGlob(config Config) string {
+	escapeMeta := func(s string) string {
+		var b strings.Builder
+		for _, r := range s {
+			if strings.ContainsRune(`*?[\`, r) {
+				b.WriteRune('\\')
+			}
+			b.WriteRune(r)
+		}
+		return b.String()
+	}
+	return filepath.Join(escapeMeta(config.SnapshotOutputDir), snapshotName(config, "*", escapeMeta))
+}
+
+// globSnapshots returns the snapshot files. On network filesystems files may show
+// up with a delay, so when GlobStableWindowMs is set the directory is globbed again
+// after each window until the number of files stops changing, up to
+// GlobMaxAttempts times.
+func globSnapshots(config Config) ([]string, error) {
+	return listStable(config, func() ([]string, error) {
+		return filepath.Glob(snapshotGlob(config))
+	})
+}
+
+// globUploadFiles returns the files of SnapshotOutputDir to upload, waiting for
+// the listing to settle like globSnapshots.
+func globUploadFiles(config Config) ([]string, error) {
+	return listStable(config, func() ([]string, error) {
+		return uploadFiles(config)
+	})
+}
+
+// listStable calls list until the number of files it returns stops changing, as
+// described for globSnapshots.
+func listStable(config Config, list func() ([]string, error)) ([]string, error) {
+	files, err := list()
+	if err != nil || config.GlobStableWindowMs <= 0 {
+		return files, err
+	}
+
+	for attempt := 1; attempt < config.GlobMaxAttempts; attempt++ {
+		time.Sleep(time.Millisecond * time.Duration(config.GlobStableWindowMs))
+		again, err := list()
+		if err != nil {
+			return nil, err
+		}
+		if len(again) == len(files) {
+			return again, nil
+		}
+		debugf("Snapshot count changed from %d to %d, waiting for it to settle", len(files), len(again))
+		files = again
+	}
+	log.Printf("Warning: snapshot files in '%s' still changing after %d attempts", config.SnapshotOutputDir, config.GlobMaxAttempts)
+	return files, nil
+}
+
+// uploadFiles returns the files of SnapshotOutputDir whose names match one of the
+// UploadInclude patterns and none of the UploadExclude patterns. Without include
+// patterns the snapshots are selected, as named by SnapshotNameTemplate.
+func uploadFiles(config Config) ([]string, error) {
+	if len(config.UploadInclude) == 0 {
+		files, err := filepath.Glob(snapshotGlob(config))
+		if err != nil {
+			return nil, err
+		}
+		return excludeFiles(config, files), nil
+	}
+
+	entries, err := os.ReadDir(config.SnapshotOutputDir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !matchAny(config.UploadInclude, entry.Name()) {
+			continue
+		}
+		files = append(files, filepath.Join(config.SnapshotOutputDir, entry.Name()))
+	}
+	return excludeFiles(config, files), nil
+}
+
+// excludeFiles drops the files whose names match one of the UploadExclude patterns.
+func excludeFiles(config Config, files []string) []string {
+	if len(config.UploadExclude) == 0 {
+		return files
+	}
+	kept := files[:0]
+	for _, file := range files {
+		if !matchAny(config.UploadExclude, filepath.Base(file)) {
+			kept = append(kept, file)
+		}
+	}
+	return kept
+}
+
+// matchAny reports whether name matches one of the glob patterns. The patterns
+// are checked by validateConfig, so match errors cannot occur.
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// generateMetadata generates a metadata.csv file with the names and creation times of the snapshot files.
+func generateMetadata(config Config) {
+	if config.MetadataInMemory {
+		log.Println("Metadata is built in memory at upload time, not writing a metadata file.")
+		return
+	}
+
+	log.Println("Generating metadata...")
+
+	records, err := metadataRecords(config)
+	if err != nil {
+		log.Printf("Failed to prepare metadata: %v", err)
+		return
+	}
+	if records == nil {
+		log.Println("Warning: No snapshot files found.")
+		return // Don't proceed with generating metadata if there are no snapshots
+	}
+
+	// Create and write to metadata.csv. With AppendRemote the rows are appended to
+	// the existing file instead, and the header is only written to a new one.
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if config.AppendRemote {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		if fileSize(metadataFile(config)) > 0 {
+			records = records[1:]
+		}
+	}
+	file, err := os.OpenFile(metadataFile(config), flags, 0666)
+	if err != nil {
+		log.Printf("Failed to create metadata file: %v", err)
+		return
+	}
+	defer func(file *os.File) {
+		err := file.Close()
+		if err != nil {
+			log.Printf("Failed to close metadata file: %v", err)
+		}
+	}(file)
+
+	err = writeMetadata(config, file, records)
+	if err != nil {
+		log.Printf("Failed to write to metadata file: %v", err)
+		return
+	}
+
+	log.Println("Metadata generation completed.")
+}
+
+// metadataRecords prepares the metadata CSV records, header first, for the snapshot
+// files. It returns nil records when there are no snapshots.
+func metadataRecords(config Config) ([][]string, error) {
+	// Retrieve snapshot files.
+	snapshotFiles, err := globSnapshots(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve snapshot files: %v", err)
+	}
+
+	if len(snapshotFiles) == 0 {
+		return nil, nil
+	}
+
+	if config.SceneChangeThreshold > 0 {
+		config.sceneTimes, err = readSceneTimes(config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Prepare metadata records, with the configured columns in their order.
+	columns := metadataColumnsOf(config)
+	header := make([]string, len(columns))
+	for i, column := range columns {
+		header[i] = metadataHeaders[column]
+	}
+	records := [][]string{header}
+	for i, file := range snapshotFiles {
+		fileInfo, err := os.Stat(file)
+		if err != nil {
+			log.Printf("Failed to retrieve file info for '%s': %v", file, err)
+			continue
+		}
+		row, err := metadataRow(config, columns, file, fileInfo, i+1, "snapshot")
+		if err != nil {
+			log.Printf("Failed to prepare metadata for '%s': %v", file, err)
+			continue
+		}
+		records = append(records, row)
+	}
+
+	// The contact sheet, when there is one, is listed after the snapshots.
+	if config.ContactSheetPath != "" {
+		fileInfo, err := os.Stat(config.ContactSheetPath)
+		if err != nil {
+			log.Printf("Failed to retrieve file info for '%s': %v", config.ContactSheetPath, err)
+			return records, nil
+		}
+		row, err := metadataRow(config, columns, config.ContactSheetPath, fileInfo, 0, "contact_sheet")
+		if err != nil {
+			log.Printf("Failed to prepare metadata for '%s': %v", config.ContactSheetPath, err)
+			return records, nil
+		}
+		records = append(records, row)
+	}
+	return records, nil
+}
+
+// writeMetadata writes the metadata records as CSV to w, streamed through gzip
+// when CompressMetadata is set.
+func writeMetadata(config Config, w io.Writer, records [][]string) error {
+	if !config.CompressMetadata {
+		writer := csv.NewWriter(w)
+		return writer.WriteAll(records) // Write all records and flush
+	}
+
+	gz := gzip.NewWriter(w)
+	err := csv.NewWriter(gz).WriteAll(records)
+	if err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// metadataFile returns the local path of the metadata file, CsvOutputFile with a
+// .gz extension added when CompressMetadata is set.
+func metadataFile(config Config) string {
+	if config.CompressMetadata {
+		return config.CsvOutputFile + ".gz"
+	}
+	return config.CsvOutputFile
+}
+
+// metadataRemoteName returns the remote base name of the metadata file.
+func metadataRemoteName(config Config) string {
+	if config.CompressMetadata {
+		return "metadata.csv.gz"
+	}
+	return "metadata.csv"
+}
+
+func uploadFile(ctx context.Context, config *Config, sourceFile string, targetFile string) (err error) {
+	config.FTPLock.Lock()
+	defer config.FTPLock.Unlock()
+
+	file, err := os.Open(sourceFile)
+	if err != nil {
+		return err
+	}
+	// defer closure that checks the returned error from file.Close()
+	defer func() {
+		closeErr := file.Close()
+		if closeErr != nil {
+			// If there was an error during the file upload and closing the file, we want to keep the original error.
+			if err == nil {
+				err = closeErr
+			} else {
+				log.Printf("Failed to close the file: %v", closeErr)
+			}
+		}
+	}()
+
+	err = storFile(ctx, config, file, targetFile)
+	// Once the connection dropped every later transfer would fail as well, so
+	// reconnect and send the file once more.
+	if errors.Is(err, ErrFTPConnect) && ctx.Err() == nil && reconnectFTP(ctx, config) {
+		if _, err = file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err = config.uploadBytes.spendAgain(file); err != nil {
+			return err
+		}
+		err = storFile(ctx, config, file, targetFile)
+	}
+	return err
+}
+
+// storFile uploads file to targetFile over the current connection. The caller
+// holds FTPLock.
+func storFile(ctx context.Context, config *Config, file *os.File, targetFile string) error {
+	defer startTransfer(ctx, config, readerSize(file))()
+	transferType := ftpTransferType(*config, targetFile)
+	if err := config.FTPConn.Type(transferType); err != nil {
+		return classifyFTPError(err)
+	}
+	name := storName(config, targetFile)
+	// ASCII transfers may change the line endings, so their remote size does not
+	// tell whether they are complete either.
+	size := readerSize(file)
+	if transferType == ftp.TransferTypeASCII {
+		size = -1
+	}
+
+	// If resuming is enabled and the server already holds a shorter copy of the
+	// file, continue from the last byte it received instead of starting over.
+	// ASCII transfers may change the line endings, so their remote size does not
+	// tell where to resume.
+	if config.ResumeUploads && transferType == ftp.TransferTypeBinary {
+		if offset, ok := partialUploadOffset(config, file, name); ok {
+			err := resumeUpload(ctx, config, file, name, offset)
+			if err == nil {
+				return finishAtomicUpload(config, name, targetFile, size)
+			}
+			log.Printf("Failed to resume upload of '%s' at byte %d, re-uploading: %v", file.Name(), offset, err)
+			if _, err = file.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			if err = config.uploadBytes.spendAgain(file); err != nil {
+				return err
+			}
+		}
+	}
+
+	err := config.FTPConn.Stor(name, withContext(ctx, withProgress(file, targetFile, 0, config.progress)))
+	if err != nil {
+		return classifyFTPError(err)
+	}
+	return finishAtomicUpload(config, name, targetFile, size)
+}
+
+// startTransfer limits the data connections of the upload about to start, of
+// size bytes, to its transferTimeout, so a stalled transfer fails instead of
+// hanging, and aborts the upload as soon as ctx is done. The returned function
+// clears the deadline again and stops watching ctx.
+func startTransfer(ctx context.Context, config *Config, size int64) func() {
+	dialer := config.ftpDialer
+	stopAbort := dialer.abortTransfers(ctx)
+	timeout := transferTimeout(*config, size)
+	if timeout <= 0 {
+		return func() { stopAbort() }
+	}
+	dialer.setDataDeadline(time.Now().Add(timeout))
+	return func() {
+		stopAbort()
+		dialer.setDataDeadline(time.Time{})
+	}
+}
 
-	// A WaitGroup waits for a collection of goroutines to finish.
-	var wg sync.WaitGroup
+// transferTimeout returns the time allowed for an upload of size bytes, or zero
+// for no limit. With AssumedMinBps it is BaseTimeout plus the time the upload
+// takes at that rate, so small files fail fast and large ones get the time they
+// need; uploads of unknown size, size -1, and runs without AssumedMinBps get
+// TransferTimeout.
+func transferTimeout(config Config, size int64) time.Duration {
+	if config.AssumedMinBps > 0 && size >= 0 {
+		return time.Duration(config.BaseTimeout)*time.Second + time.Duration(float64(size)/float64(config.AssumedMinBps)*float64(time.Second))
+	}
+	return time.Duration(config.TransferTimeout) * time.Second
+}
 
-	// Upload snapshots and metadata to FTPS concurrently
-	wg.Add(2)
-	go func() {
-		defer wg.Done()
-		uploadSnapshots(&config)
-	}()
+// ftpTransferType returns the FTP transfer type of targetFile selected by the
+// extension of its name in FTPTransferTypes.
+func ftpTransferType(config Config, targetFile string) ftp.TransferType {
+	if config.FTPTransferTypes[strings.ToLower(path.Ext(targetFile))] == "ascii" {
+		return ftp.TransferTypeASCII
+	}
+	return ftp.TransferTypeBinary
+}
 
-	go func() {
-		defer wg.Done()
-		uploadMetadata(&config)
-	}()
+// uploadReader uploads the content of r to targetFile. When r can seek, the upload
+// is repeated over a new connection if the current one dropped.
+func uploadReader(ctx context.Context, config *Config, r io.Reader, targetFile string) error {
+	config.FTPLock.Lock()
+	defer config.FTPLock.Unlock()
 
-	wg.Wait() // Wait for all uploads to complete
+	err := storReader(ctx, config, r, targetFile)
+	if seeker, ok := r.(io.Seeker); ok && errors.Is(err, ErrFTPConnect) && ctx.Err() == nil && reconnectFTP(ctx, config) {
+		if _, err = seeker.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err = config.uploadBytes.spendAgain(r); err != nil {
+			return err
+		}
+		err = storReader(ctx, config, r, targetFile)
+	}
+	return err
+}
 
-	// Wait for the specified duration before stopping the generator
-	time.Sleep(time.Second * time.Duration(config.Duration))
+// storReader uploads the content of r to targetFile over the current connection.
+// The caller holds FTPLock.
+func storReader(ctx context.Context, config *Config, r io.Reader, targetFile string) error {
+	defer startTransfer(ctx, config, readerSize(r))()
+	transferType := ftpTransferType(*config, targetFile)
+	if err := config.FTPConn.Type(transferType); err != nil {
+		return classifyFTPError(err)
+	}
+	name := storName(config, targetFile)
+	size := readerSize(r)
+	if transferType == ftp.TransferTypeASCII {
+		size = -1
+	}
 
-	// Program complete, print message and exit
-	log.Println("Program complete and exiting")
+	err := config.FTPConn.Stor(name, withContext(ctx, withProgress(r, targetFile, 0, config.progress)))
+	if err != nil {
+		return classifyFTPError(err)
+	}
+	return finishAtomicUpload(config, name, targetFile, size)
 }
 
-// readConfig reads the configuration from the provided JSON file.
-func readConfig(file string) (Config, error) {
-	configFile, err := os.Open(file)
+// appendFile uploads the part of sourceFile beyond the size of targetFile on the
+// server with APPE, so a growing file is not sent in full every time. When the
+// remote file is missing or larger than the local one, or the server does not
+// support APPE, the whole file is uploaded instead.
+func appendFile(ctx context.Context, config *Config, sourceFile string, targetFile string) error {
+	config.FTPLock.Lock()
+	defer config.FTPLock.Unlock()
+
+	file, err := os.Open(sourceFile)
 	if err != nil {
-		return Config{}, err
+		return err
 	}
-	//defer configFile.Close()
+	defer file.Close()
 
-	var config Config
-	decoder := json.NewDecoder(configFile)
-	err = decoder.Decode(&config)
+	info, err := file.Stat()
 	if err != nil {
-		return Config{}, err
+		return err
+	}
+	if ftpTransferType(*config, targetFile) == ftp.TransferTypeASCII {
+		// The remote size of an ASCII transfer does not match the local one.
+		return storFile(ctx, config, file, targetFile)
+	}
+	if config.AtomicRemoteUpload {
+		// An appended file would be visible while it grows, so it is replaced
+		// as a whole instead.
+		return storFile(ctx, config, file, targetFile)
+	}
+	remoteSize, err := config.FTPConn.FileSize(targetFile)
+	if err != nil || remoteSize > info.Size() {
+		return storFile(ctx, config, file, targetFile)
+	}
+	if remoteSize == info.Size() {
+		debugf("Nothing to append to '%s'", targetFile)
+		return nil
 	}
 
-	return config, nil
+	if _, err = file.Seek(remoteSize, io.SeekStart); err != nil {
+		return err
+	}
+	debugf("Appending %d bytes to '%s'", info.Size()-remoteSize, targetFile)
+	err = appendFrom(ctx, config, file, targetFile, remoteSize)
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) && (protoErr.Code == ftp.StatusNotImplemented || protoErr.Code == ftp.StatusBadCommand) {
+		log.Printf("Server does not support APPE, uploading '%s' in full", sourceFile)
+		if _, err = file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return storFile(ctx, config, file, targetFile)
+	}
+	return classifyFTPError(err)
 }
 
-// createDirectory checks if the directory exists and creates it if it doesn't.
-func createDirectory(dir string) error {
-	_, err := os.Stat(dir)
-	if os.IsNotExist(err) {
-		err = os.MkdirAll(dir, os.ModePerm)
-		if err != nil {
-			return fmt.Errorf("failed to create directory: %v", err)
-		}
+// appendFrom sends the rest of file, which starts at offset, to targetFile with APPE.
+func appendFrom(ctx context.Context, config *Config, file *os.File, targetFile string, offset int64) error {
+	size := readerSize(file)
+	if size >= 0 {
+		size -= offset
 	}
-	return nil
+	defer startTransfer(ctx, config, size)()
+	if err := config.FTPConn.Type(ftp.TransferTypeBinary); err != nil {
+		return err
+	}
+	return config.FTPConn.Append(targetFile, withContext(ctx, withProgress(file, targetFile, offset, config.progress)))
 }
 
-func cleanup(config Config) {
-	log.Println("Performing cleanup...")
-	err := os.RemoveAll(config.OutputDir)
+// partialUploadOffset reports the number of bytes of targetFile already present on
+// the server when it is a strict prefix-length of the local file. Servers that do
+// not support SIZE, or a missing remote file, simply report no partial upload.
+func partialUploadOffset(config *Config, file *os.File, targetFile string) (int64, bool) {
+	info, err := file.Stat()
 	if err != nil {
-		log.Printf("Failed to clean up output directory: %v", err)
+		return 0, false
 	}
-	log.Println("Cleanup complete.")
+	remoteSize, err := config.FTPConn.FileSize(targetFile)
+	if err != nil {
+		return 0, false
+	}
+	if remoteSize <= 0 || remoteSize >= info.Size() {
+		return 0, false
+	}
+	return remoteSize, true
 }
 
-// generateTestVideo generates a test video with timestamp.
-func generateTestVideo(config Config) {
-	log.Println("Generating test video...")
-	var videoCmd = exec.Command("ffmpeg", "-f", "lavfi", "-i",
-		fmt.Sprintf("testsrc=duration=%d:size=%s:rate=%d", config.Duration, config.Resolution, config.FPS),
-		"-vf", fmt.Sprintf("drawtext=fontfile='/usr/share/fonts/truetype/dejavu/DejaVuSans-Bold.ttf':text='%%{localtime}':x=(w-tw)/2:y=h-(2*lh):fontcolor=white:fontsize=12:box=1:boxcolor=black@0.5"), config.TestVideoPath)
-	err := videoCmd.Run()
+// remoteFileUnchanged reports whether targetFile already exists on the server with
+// the same size as sourceFile and, when the server supports MDTM, was modified no
+// earlier than the local copy.
+func remoteFileUnchanged(config *Config, sourceFile string, targetFile string) bool {
+	config.FTPLock.Lock()
+	defer config.FTPLock.Unlock()
+
+	info, err := os.Stat(sourceFile)
 	if err != nil {
-		log.Printf("Failed to generate test video: %v", err)
+		return false
 	}
-	log.Println("Test video generation completed.")
+	remoteSize, err := config.FTPConn.FileSize(targetFile)
+	if err != nil || remoteSize != uploadedSize(*config, info.Size()) {
+		return false
+	}
+	if config.FTPConn.IsGetTimeSupported() {
+		remoteTime, err := config.FTPConn.GetTime(targetFile)
+		if err == nil && remoteTime.Before(info.ModTime().Truncate(time.Second)) {
+			return false
+		}
+	}
+	return true
 }
 
-// generateSnapshots generates snapshots from the test video at regular intervals.
-func generateSnapshots(config Config) {
-	log.Println("Generating snapshots...")
-
-	// Before we start generating snapshots, we want to make sure that the directory
-	// where we're going to save the snapshots exists. The os.MkdirAll function
-	// creates a directory named by the path 'snapshotOutputDir', along with any necessary parents,
-	// and returns nil if successful. The permission bits perm (before umask) are set for
-	// all directories that MkdirAll creates. If the directory already exists, MkdirAll does nothing
-	// and returns nil. In this case, we're setting the permissions to 0777, which means
-	// everyone can read, write, and execute.
-	// and later we can set the permissions 0755 (which means the owner can read,
-	// write, and execute, while others can read and execute
+// resumeUpload continues an interrupted upload at offset using REST + STOR.
+func resumeUpload(ctx context.Context, config *Config, file *os.File, targetFile string, offset int64) error {
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	log.Printf("Resuming upload of '%s' from byte %d", targetFile, offset)
+	return config.FTPConn.StorFrom(targetFile, withContext(ctx, withProgress(file, targetFile, offset, config.progress)), uint64(offset))
+}
 
-	err := os.MkdirAll(config.SnapshotOutputDir, 0777)
+// establishFTPConnection establishes a connection to the FTP server, giving up
+// once ctx is done.
+func establishFTPConnection(ctx context.Context, config *Config) error {
+	c, dialer, err := dialFTP(ctx, config)
 	if err != nil {
-		// If an error occurred while trying to create the directory, we log the error
-		// and exit the function.
-		log.Printf("Failed to create directory '%s': %v", config.SnapshotOutputDir, err)
-
-		return
+		return err
 	}
 
-	// We're using the ffmpeg tool to generate snapshots from the test video.
-	// The snapshots are saved in the 'snapshotOutputDir' directory, with the filename
-	// formatted as "snapshot%03d.jpg".
+	config.FTPConn = c
+	config.ftpDialer = dialer
+	config.FTPLock = &sync.Mutex{}
+	if config.FTPKeepaliveInterval > 0 {
+		config.stopKeepalive = startKeepalive(config)
+	}
+	return nil
+}
 
-	// The ffmpeg command is executed using the exec.Command function, which creates
-	snapshotCmd := exec.Command("ffmpeg", "-i", config.TestVideoPath, "-vf", fmt.Sprintf("fps=1/%d", config.Interval), filepath.Join(config.SnapshotOutputDir, "snapshot%03d.jpg"))
+// reconnectFTP replaces a dropped FTP connection with a new one, trying up to
+// MaxRetries times, and reports whether it succeeded. The caller holds FTPLock.
+// After a failed reconnection no further attempts are made, so the remaining
+// uploads fail quickly instead of each waiting for the retries again.
+func reconnectFTP(ctx context.Context, config *Config) bool {
+	if config.ftpReconnectFailed {
+		return false
+	}
+	if err := config.retries.spend(); err != nil {
+		log.Printf("Not reconnecting to the FTP server: %v", err)
+		return false
+	}
 
-	// Run the command and wait for it to finish.
-	err = snapshotCmd.Run()
+	log.Println("FTP connection lost, reconnecting...")
+	err := redialFTP(ctx, config)
 	if err != nil {
-		// If an error occurred while running the ffmpeg command, we log the error.
-		log.Printf("Failed to generate snapshots: %v", err)
+		log.Printf("Failed to reconnect to the FTP server, giving up on the connection: %v", err)
+		config.ftpReconnectFailed = true
+		return false
 	}
-	// Finally, we log that the snapshot generation has completed.
-	log.Println("Snapshot generation completed.")
-}
 
-// generateMetadata generates a metadata.csv file with the names and creation times of the snapshot files.
-func generateMetadata(config Config) {
-	log.Println("Generating metadata...")
+	config.Stats.countReconnect()
+	if state := config.ftpDialer.tlsState(); state != nil && state.DidResume {
+		log.Println("Reconnected to the FTP server, resuming the TLS session.")
+	} else {
+		log.Println("Reconnected to the FTP server.")
+	}
+	return true
+}
 
-	// Retrieve snapshot files.
-	snapshotFiles, err := filepath.Glob(filepath.Join(config.SnapshotOutputDir, "snapshot*.jpg"))
+// redialFTP replaces the FTP connection of config with a new one. The caller
+// holds FTPLock.
+func redialFTP(ctx context.Context, config *Config) error {
+	_ = config.FTPConn.Quit()
+	config.ftpDialer.logTLSResumption()
+	c, dialer, err := dialFTP(ctx, config)
 	if err != nil {
-		log.Printf("Failed to retrieve snapshot files: %v", err)
-		return
+		return err
 	}
+	config.FTPConn = c
+	config.ftpDialer = dialer
+	return nil
+}
 
-	if len(snapshotFiles) == 0 {
-		log.Println("Warning: No snapshot files found.")
-		return // Don't proceed with generating metadata if there are no snapshots
+// dialFTP connects and logs in to the FTP server, trying up to MaxRetries times.
+// It gives up, without waiting out the retry interval, once ctx is done.
+func dialFTP(ctx context.Context, config *Config) (*ftp.ServerConn, *ftpDialer, error) {
+	addr := ftpAddress(config)
+
+	security := "plain FTP"
+	if config.FTPTLS != "" {
+		security = config.FTPTLS + " FTPS"
+	}
+	mode := "passive mode"
+	if !config.FTPPassive {
+		mode = "active mode"
+	}
+	if config.SOCKS5Proxy.Address != "" {
+		log.Printf("Connecting to FTP server %s (%s, %s) through SOCKS5 proxy %s", addr, security, mode, config.SOCKS5Proxy.Address)
+	} else {
+		log.Printf("Connecting to FTP server %s (%s, %s)", addr, security, mode)
 	}
 
-	// Prepare metadata records.
-	var records [][]string
-	records = append(records, []string{"Filename", "Creation Time"}) // CSV header
-	for _, file := range snapshotFiles {
-		fileInfo, err := os.Stat(file)
+	var tlsConfig *tls.Config
+	if config.FTPTLS != "" {
+		var err error
+		tlsConfig, err = ftpTLSConfig(config)
 		if err != nil {
-			log.Printf("Failed to retrieve file info for '%s': %v", file, err)
-			continue
+			return nil, nil, err
 		}
-		records = append(records, []string{filepath.Base(file), fileInfo.ModTime().String()})
 	}
 
-	// Create and write to metadata.csv
-	file, err := os.Create(config.CsvOutputFile)
-	if err != nil {
-		log.Printf("Failed to create metadata file: %v", err)
-		return
-	}
-	defer func(file *os.File) {
-		err := file.Close()
+	// The connection is attempted at least once, even when max_retries is unset.
+	attempts := max(config.MaxRetries, 1)
+	var lastErr error
+	for i := 0; i < attempts; i++ {
+		dialer, err := newFTPDialer(ctx, config, tlsConfig)
 		if err != nil {
-			log.Printf("Failed to close metadata file: %v", err)
+			return nil, nil, err
+		}
+		options := []ftp.DialOption{ftp.DialWithDialFunc(dialer.dial), ftp.DialWithDisabledMLSD(config.ftpDisableMLSD)}
+		if config.FTPTLS == "explicit" {
+			options = append(options, ftp.DialWithExplicitTLS(dialer.tlsConfig))
+		} else if config.FTPTLS == "implicit" {
+			// The dialer already speaks TLS; this only makes the client protect
+			// the data connections with PBSZ/PROT after login.
+			options = append(options, ftp.DialWithTLS(dialer.tlsConfig))
+		}
+		if config.TransferTimeout > 0 {
+			// Bound the wait for the server's reply once a transfer has been sent.
+			options = append(options, ftp.DialWithShutTimeout(time.Duration(config.TransferTimeout)*time.Second))
 		}
-	}(file)
 
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
+		if i > 0 {
+			if err := config.retries.spend(); err != nil {
+				return nil, nil, fmt.Errorf("%w, after %d connection attempts: %w", err, i, lastErr)
+			}
+			select {
+			case <-ctx.Done():
+				return nil, nil, fmt.Errorf("%w, after %d connection attempts: %w", context.Cause(ctx), i, lastErr)
+			case <-time.After(time.Duration(config.RetryInterval) * time.Second):
+			}
+		}
 
-	err = writer.WriteAll(records) // Write all records to the CSV file
-	if err != nil {
-		log.Printf("Failed to write to metadata file: %v", err)
-		return
+		c, err := ftp.Dial(addr, options...)
+		if err != nil {
+			lastErr = fmt.Errorf("%w: %w", ErrFTPConnect, err)
+			log.Printf("Failed to establish FTP connection, attempt %d/%d: %v", i+1, attempts, err)
+			continue
+		}
+
+		err = c.Login(config.FTPUser, config.FTPPassword)
+		if err != nil {
+			_ = c.Quit()
+			lastErr = classifyFTPError(err)
+			// Rejected credentials will be rejected again, so don't retry them.
+			if errors.Is(lastErr, ErrFTPAuth) {
+				return nil, nil, lastErr
+			}
+			log.Printf("Failed to authenticate, attempt %d/%d: %v", i+1, attempts, err)
+			continue
+		}
+
+		if state := dialer.tlsState(); state != nil {
+			if state.DidResume {
+				debugf("Resumed the TLS session of the FTP control connection")
+			} else {
+				debugf("Full TLS handshake for the FTP control connection")
+			}
+		}
+		return c, dialer, nil
 	}
 
-	log.Println("Metadata generation completed.")
+	return nil, nil, fmt.Errorf("failed to establish FTP connection after %d attempts: %w", attempts, lastErr)
 }
 
-func uploadFile(config *Config, sourceFile string, targetFile string) (err error) {
-	file, err := os.Open(sourceFile)
-	if err != nil {
-		return err
-	}
-	// defer closure that checks the returned error from file.Close()
-	defer func() {
-		closeErr := file.Close()
-		if closeErr != nil {
-			// If there was an error during the file upload and closing the file, we want to keep the original error.
-			if err == nil {
-				err = closeErr
-			} else {
-				log.Printf("Failed to close the file: %v", closeErr)
+// generationKeepaliveInterval is the FTPKeepaliveInterval, in seconds, of the
+// connections made with ConnectDuringGeneration when none is configured.
+const generationKeepaliveInterval = 30
+
+// startKeepalive sends a NOOP every FTPKeepaliveInterval seconds so the server does
+// not drop the control connection while the program is busy rendering. A tick is
+// skipped when a transfer currently holds the connection. The returned function
+// stops the keepalive and waits for it to exit.
+func startKeepalive(config *Config) func() {
+	interval := time.Duration(config.FTPKeepaliveInterval) * time.Second
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if !config.FTPLock.TryLock() {
+					continue
+				}
+				err := config.FTPConn.NoOp()
+				config.FTPLock.Unlock()
+				if err != nil {
+					log.Printf("FTP keepalive failed: %v", err)
+				} else {
+					debugf("Sent FTP keepalive")
+				}
 			}
 		}
 	}()
 
-	err = config.FTPConn.Stor(targetFile, file)
-	if err != nil {
-		return err
+	return func() {
+		close(stop)
+		<-done
 	}
-	return nil
 }
 
-// establishFTPConnection establishes a connection to the FTP server.
-func establishFTPConnection(config *Config) error {
-	addr := fmt.Sprintf("%s:%d", config.FTPHost, config.FTPPort)
+// makeRemoteDir creates dir on the FTP server. The directory usually exists already,
+// so a failure is only logged at debug level; a real problem surfaces on upload.
+func makeRemoteDir(config *Config, dir string) {
+	config.FTPLock.Lock()
+	defer config.FTPLock.Unlock()
 
-	for i := 0; i < config.MaxRetries; i++ {
-		c, err := ftp.Dial(addr, ftp.DialWithTimeout(5*time.Second))
-		if err != nil {
-			log.Printf("Failed to establish FTP connection, attempt %d/%d: %v", i+1, config.MaxRetries, err)
-			time.Sleep(time.Duration(config.RetryInterval))
-			continue
+	// MKD creates a single level, so the parents are created first. Levels that
+	// already exist fail, which is expected and only logged in debug mode.
+	for i, c := range dir {
+		if c == '/' && i > 0 {
+			_ = config.FTPConn.MakeDir(dir[:i])
 		}
+	}
+	err := config.FTPConn.MakeDir(dir)
+	if err != nil {
+		debugf("Failed to create remote directory '%s': %v", dir, err)
+	}
+}
 
-		err = c.Login(config.FTPUser, config.FTPPassword)
+// listRemoteDir lists the files in dir on the FTP server, mapping each name to its size.
+func listRemoteDir(config *Config, dir string) (map[string]int64, error) {
+	config.FTPLock.Lock()
+	defer config.FTPLock.Unlock()
+
+	// The client lists with MLSD when the server advertises it, which gives exact
+	// sizes in a fixed format, and parses LIST output otherwise. Some servers
+	// advertise MLSD but reject it; they are listed with LIST from then on.
+	mlsd := config.FTPConn.IsTimePreciseInList()
+	entries, err := config.FTPConn.List(dir)
+	if err != nil && mlsd && isFTPNotImplemented(err) {
+		log.Printf("The FTP server rejected MLSD, listing with LIST instead: %v", err)
+		config.ftpDisableMLSD = true
+		err = redialFTP(context.Background(), config)
 		if err != nil {
-			log.Printf("Failed to authenticate, attempt %d/%d: %v", i+1, config.MaxRetries, err)
-			time.Sleep(time.Duration(config.RetryInterval))
-			continue
+			return nil, err
+		}
+		mlsd = false
+		entries, err = config.FTPConn.List(dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if mlsd {
+		debugf("Listed remote directory '%s' with MLSD", dir)
+	} else {
+		debugf("Listed remote directory '%s' with LIST", dir)
+	}
+	files := make(map[string]int64, len(entries))
+	for _, entry := range entries {
+		if entry.Type == ftp.EntryTypeFile {
+			files[entry.Name] = int64(entry.Size)
 		}
-
-		config.FTPConn = c
-		return nil
 	}
+	return files, nil
+}
 
-	return fmt.Errorf("failed to establish FTP connection after %d attempts", config.MaxRetries)
+// closeFTPConnection stops the keepalive, if any, and closes the FTP connection.
+func closeFTPConnection(config *Config) {
+	if config.FTPConn == nil {
+		return
+	}
+	if config.stopKeepalive != nil {
+		config.stopKeepalive()
+	}
+	err := config.FTPConn.Quit()
+	if err != nil {
+		log.Printf("Failed to close FTP connection: %v", err)
+	}
+	config.ftpDialer.logTLSResumption()
 }
 
-func uploadSnapshots(config *Config) {
-	log.Println("Uploading snapshots to FTPS...")
-	snapshotFiles, err := filepath.Glob(filepath.Join(config.SnapshotOutputDir, "snapshot*.jpg"))
+// uploadSnapshots uploads the snapshot files one by one, stopping early when ctx
+// is cancelled.
+func uploadSnapshots(ctx context.Context, config *Config) {
+	log.Printf("Uploading snapshots to %s...", transferProtocolName(*config))
+	snapshotFiles, err := globUploadFiles(*config)
 	if err != nil {
 		log.Printf("Failed to retrieve snapshot files: %v", err)
 		return
 	}
+	sortUploadFiles(*config, snapshotFiles)
 
-	for _, file := range snapshotFiles {
-		err = uploadFile(config, file, filepath.Join(config.OutputDir, filepath.Base(file)))
+	failed := false
+	// consecutiveFailures counts the failed uploads since the last successful one.
+	consecutiveFailures := 0
+	// previous is the signature of the last snapshot not skipped as unchanged.
+	var previous []float64
+	if config.SkipUnchangedFrames {
+		config.unchangedFrames = make(map[string]bool)
+	}
+	for i, file := range snapshotFiles {
+		if ctx.Err() != nil {
+			log.Printf("Snapshot upload cancelled, %d of %d files not uploaded.", len(snapshotFiles)-i, len(snapshotFiles))
+			return
+		}
+
+		targetFile := filepath.Join(remoteDir(*config), remoteName(*config, filepath.Base(file), file))
+		if config.SkipUnchangedFrames {
+			signature, err := frameSignature(file)
+			if err != nil {
+				log.Printf("Failed to compare snapshot file '%s' with the previous one, uploading it: %v", file, err)
+			} else if previous != nil && frameDifference(previous, signature) < config.UnchangedFrameThreshold {
+				fileLogf(file, "Skipping snapshot file '%s', unchanged from the previous one (difference %.2f%%)", file, frameDifference(previous, signature))
+				config.Stats.countUnchangedFrame()
+				config.unchangedFrames[targetFile] = true
+				continue
+			} else {
+				previous = signature
+			}
+		}
+		if config.checkpoint != nil && config.checkpoint.done(targetFile) {
+			debugf("Skipping snapshot file '%s', uploaded before the restart", file)
+			config.Stats.countSkipped()
+			continue
+		}
+		if config.SkipExisting && config.Uploader.Unchanged(file, targetFile) {
+			debugf("Skipping snapshot file '%s', already on the server", file)
+			config.Stats.countSkipped()
+			continue
+		}
+
+		err = config.Uploader.Upload(ctx, file, targetFile)
 		if err != nil {
-			log.Printf("Failed to upload snapshot file '%s': %v", file, err)
+			fileLogf(file, "Failed to upload snapshot file '%s': %v", file, err)
+			config.Stats.countFailed(file, err)
+			failed = true
+			// Once the server is out of space the remaining snapshots cannot be
+			// stored either.
+			if errors.Is(err, ErrFTPQuota) {
+				log.Println("Stopping snapshot upload, the server has no space left.")
+				return
+			}
+			// The files left over are uploaded by the next run, resuming from the
+			// checkpoint if there is one.
+			if errors.Is(err, ErrByteBudget) {
+				remaining := len(snapshotFiles) - i - 1
+				log.Printf("Stopping snapshot upload, byte budget exhausted, %d of %d files not uploaded.", remaining+1, len(snapshotFiles))
+				config.Stats.countOverBudget(remaining)
+				return
+			}
+			// A server rejecting every file would otherwise be sent, and log, the
+			// whole batch.
+			consecutiveFailures++
+			if config.MaxConsecutiveFailures > 0 && consecutiveFailures >= config.MaxConsecutiveFailures {
+				remaining := len(snapshotFiles) - i - 1
+				log.Printf("Aborting snapshot upload after %d consecutive failures, %d of %d files not uploaded.", consecutiveFailures, remaining, len(snapshotFiles))
+				config.Stats.countAborted(remaining, fmt.Errorf("snapshot upload to '%s' aborted after %d consecutive failures, %d files not uploaded: %w", remoteDir(*config), consecutiveFailures, remaining, err))
+				return
+			}
 		} else {
-			log.Printf("Uploaded snapshot file '%s'", file)
+			fileLogf(file, "Uploaded snapshot file '%s'", file)
+			config.Stats.countUploaded()
+			consecutiveFailures = 0
+			if config.checkpoint != nil {
+				config.checkpoint.record(targetFile)
+			}
 		}
 
-		time.Sleep(time.Millisecond * time.Duration(config.Interval))
+		if config.UploadDelayMs > 0 {
+			select {
+			case <-ctx.Done():
+				log.Printf("Snapshot upload cancelled, %d of %d files not uploaded.", len(snapshotFiles)-i-1, len(snapshotFiles))
+				return
+			case <-time.After(time.Millisecond * time.Duration(config.UploadDelayMs)):
+			}
+		}
 	}
 
+	// The batch is complete, so a later run starts afresh.
+	if config.checkpoint != nil && !failed {
+		config.checkpoint.remove()
+	}
 	log.Println("Snapshot upload completed.")
 }
 
-// uploadMetadata uploads metadata to the FTPS.
-func uploadMetadata(config *Config) {
-	log.Println("Uploading metadata to FTPS...")
-	err := uploadFile(config, config.CsvOutputFile, filepath.Join(config.OutputDir, "metadata.csv"))
+// uploadVideo uploads the test video, or with ABRLadder the video of every rung
+// into a remote subdirectory named after the rung.
+func uploadVideo(ctx context.Context, config *Config) {
+	if len(config.ABRLadder) == 0 {
+		uploadVideoFile(ctx, config, config.TestVideoPath, videoRemoteDir(*config))
+		return
+	}
+	for _, rung := range config.ABRLadder {
+		uploadVideoFile(ctx, config, rungConfig(*config, rung).TestVideoPath, filepath.Join(videoRemoteDir(*config), rungName(rung)))
+	}
+}
+
+// uploadVideoFile uploads the video file to the remote directory dir.
+func uploadVideoFile(ctx context.Context, config *Config, file string, dir string) {
+	if ctx.Err() != nil {
+		log.Println("Video upload cancelled.")
+		return
+	}
+
+	log.Printf("Uploading test video '%s'...", file)
+	if dir != remoteDir(*config) {
+		err := config.Uploader.MakeDir(dir)
+		if err != nil {
+			log.Printf("Failed to create remote directory '%s': %v", dir, err)
+		}
+	}
+
+	targetFile := filepath.Join(dir, remoteName(*config, filepath.Base(file), file))
+	if config.SkipExisting && config.Uploader.Unchanged(file, targetFile) {
+		debugf("Skipping test video '%s', already on the server", file)
+		config.Stats.countSkipped()
+		return
+	}
+
+	err := config.Uploader.Upload(ctx, file, targetFile)
+	if err != nil {
+		fileLogf(file, "Failed to upload test video '%s': %v", file, err)
+		config.Stats.countFailed(file, err)
+	} else {
+		fileLogf(file, "Uploaded test video '%s'", file)
+		config.Stats.countUploaded()
+	}
+}
+
+// uploadMetadata uploads metadata to the destination of config.
+func uploadMetadata(ctx context.Context, config *Config) {
+	if ctx.Err() != nil {
+		log.Println("Metadata upload cancelled.")
+		return
+	}
+
+	log.Printf("Uploading metadata to %s...", transferProtocolName(*config))
+	localFile := metadataFile(*config)
+	targetFile := filepath.Join(remoteDir(*config), remoteName(*config, metadataRemoteName(*config), localFile))
+
+	if !config.MetadataInMemory && config.SkipExisting && config.Uploader.Unchanged(localFile, targetFile) {
+		debugf("Skipping metadata file '%s', already on the server", localFile)
+		config.Stats.countSkipped()
+		return
+	}
+
+	// Without the metadata the uploaded snapshots are not indexed downstream, so
+	// a failed upload is retried.
+	err := retryUpload(ctx, config, "metadata", func() error {
+		if config.MetadataInMemory {
+			return uploadMetadataFromMemory(ctx, config, targetFile)
+		}
+		if config.AppendRemote {
+			return config.Uploader.Append(ctx, localFile, targetFile)
+		}
+		return config.Uploader.Upload(ctx, localFile, targetFile)
+	})
 	if err != nil {
-		log.Printf("Failed to upload metadata: %v", err)
+		fileLogf(localFile, "Failed to upload metadata: %v", err)
+		config.Stats.countFailed(targetFile, err)
+		config.Stats.countMetadataFailure()
 	} else {
-		log.Println("Metadata upload completed.")
+		fileLogf(localFile, "Metadata upload completed.")
+		config.Stats.countUploaded()
+	}
+}
+
+// maxRetryDelay caps the growing delay between two attempts of retryUpload.
+const maxRetryDelay = time.Minute
+
+// retryUpload runs upload up to MaxRetries times, at least once, waiting
+// RetryInterval seconds (at least one) before the second attempt and twice as
+// long before each further one. It gives up early when ctx is done, on errors
+// that another attempt cannot fix, such as an exhausted MaxUploadBytes, and
+// once the RetryBudget is exhausted.
+func retryUpload(ctx context.Context, config *Config, what string, upload func() error) error {
+	attempts := max(config.MaxRetries, 1)
+	delay := time.Duration(max(config.RetryInterval, 1)) * time.Second
+	var err error
+	for i := 1; ; i++ {
+		err = upload()
+		if err == nil || i == attempts || ctx.Err() != nil || errors.Is(err, ErrFTPAuth) || errors.Is(err, ErrFTPQuota) || errors.Is(err, ErrByteBudget) {
+			return err
+		}
+		if budgetErr := config.retries.spend(); budgetErr != nil {
+			return fmt.Errorf("%w, after %d attempts: %w", budgetErr, i, err)
+		}
+		log.Printf("Failed to upload %s, attempt %d/%d, retrying in %s: %v", what, i, attempts, delay, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, maxRetryDelay)
+	}
+}
+
+// uploadMetadataFromMemory builds the metadata CSV in a buffer and uploads it
+// directly, without writing it to the local disk.
+func uploadMetadataFromMemory(ctx context.Context, config *Config, targetFile string) error {
+	records, err := metadataRecords(*config)
+	if err != nil {
+		return err
+	}
+	if records == nil {
+		return fmt.Errorf("no snapshot files found")
+	}
+
+	var buf bytes.Buffer
+	err = writeMetadata(*config, &buf, records)
+	if err != nil {
+		return err
 	}
+	return config.Uploader.UploadReader(ctx, bytes.NewReader(buf.Bytes()), targetFile)
 }
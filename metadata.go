@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// defaultMetadataColumns are the metadata columns written when MetadataColumns
+// is not set.
+var defaultMetadataColumns = []string{"filename", "creation_time"}
+
+// metadataHeaders maps each supported metadata column to its CSV header.
+var metadataHeaders = map[string]string{
+	"filename":      "Filename",
+	"creation_time": "Creation Time",
+	"size":          "Size",
+	"sha256":        "SHA256",
+	"width":         "Width",
+	"height":        "Height",
+	"index":         "Index",
+	"type":          "Type",
+	"content_type":  "Content Type",
+	"keyframe":      "Keyframe",
+	"config_hash":   "Config Hash",
+	"source_time":   "Source Time",
+}
+
+// metadataColumnsOf returns the metadata columns configured for config. With a
+// contact sheet the default columns also identify each row's type and its
+// dimensions, so that the overview image can be told apart from the snapshots.
+// With KeyframesOnly they note that the snapshots are keyframes, with
+// SceneChangeThreshold the time of each snapshot in the video.
+func metadataColumnsOf(config Config) []string {
+	if len(config.MetadataColumns) > 0 {
+		return config.MetadataColumns
+	}
+	columns := defaultMetadataColumns
+	if config.ContactSheetPath != "" {
+		columns = append(append([]string{}, columns...), "type", "width", "height")
+	}
+	if config.KeyframesOnly {
+		columns = append(append([]string{}, columns...), "keyframe")
+	}
+	if config.SceneChangeThreshold > 0 {
+		columns = append(append([]string{}, columns...), "source_time")
+	}
+	return columns
+}
+
+// metadataRow returns the values of the metadata columns for a file of the given
+// type, "snapshot" or "contact_sheet". index is the 1-based index of a snapshot
+// and 0 for the contact sheet, which leaves the index column empty.
+func metadataRow(config Config, columns []string, file string, info os.FileInfo, index int, kind string) ([]string, error) {
+	var width, height string
+	row := make([]string, 0, len(columns))
+	for _, column := range columns {
+		switch column {
+		case "filename":
+			row = append(row, filepath.Base(file))
+		case "creation_time":
+			row = append(row, info.ModTime().String())
+		case "size":
+			row = append(row, strconv.FormatInt(info.Size(), 10))
+		case "sha256":
+			sum, err := fileSHA256(file)
+			if err != nil {
+				return nil, err
+			}
+			row = append(row, sum)
+		case "width", "height":
+			if width == "" {
+				w, h, err := imageSize(file)
+				if err != nil {
+					return nil, err
+				}
+				width, height = strconv.Itoa(w), strconv.Itoa(h)
+			}
+			if column == "width" {
+				row = append(row, width)
+			} else {
+				row = append(row, height)
+			}
+		case "index":
+			if index > 0 {
+				row = append(row, strconv.Itoa(index))
+			} else {
+				row = append(row, "")
+			}
+		case "type":
+			row = append(row, kind)
+		case "keyframe":
+			// The column requires KeyframesOnly, so every snapshot is a keyframe.
+			if kind == "snapshot" {
+				row = append(row, "true")
+			} else {
+				row = append(row, "")
+			}
+		case "config_hash":
+			row = append(row, config.hash)
+		case "source_time":
+			// The column requires SceneChangeThreshold, which lists the time of
+			// every snapshot in order.
+			if kind == "snapshot" && index <= len(config.sceneTimes) {
+				row = append(row, config.sceneTimes[index-1])
+			} else {
+				row = append(row, "")
+			}
+		case "content_type":
+			contentType, err := fileContentType(file)
+			if err != nil {
+				return nil, err
+			}
+			row = append(row, contentType)
+		}
+	}
+	return row, nil
+}
+
+// fileSHA256 returns the SHA-256 of the content of file in hex.
+func fileSHA256(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// fileContentType returns the MIME type of file, sniffed from its first 512 bytes
+// and otherwise taken from its extension. Unknown types are
+// application/octet-stream.
+func fileContentType(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	const unknown = "application/octet-stream"
+	contentType := http.DetectContentType(head[:n])
+	if contentType == unknown {
+		if byExtension := mime.TypeByExtension(filepath.Ext(file)); byExtension != "" {
+			return byExtension, nil
+		}
+		// Not every system's MIME table knows the lossless snapshot formats.
+		if strings.EqualFold(filepath.Ext(file), ".ppm") {
+			return "image/x-portable-pixmap", nil
+		}
+	}
+	return contentType, nil
+}
+
+// imageSize returns the dimensions of an image file, reading only its header.
+func imageSize(file string) (int, int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read image size of '%s': %v", file, err)
+	}
+	return cfg.Width, cfg.Height, nil
+}
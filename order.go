@@ -0,0 +1,75 @@
+package main
+
+import (
+	"cmp"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// uploadOrders are the values of UploadOrder.
+var uploadOrders = []string{"lexical", "numeric", "mtime"}
+
+// sortUploadFiles sorts the snapshot files in the order of UploadOrder:
+// "lexical" by name, "numeric" by name with runs of digits compared as numbers,
+// so that "snapshot2" comes before "snapshot10", and "mtime" by modification
+// time, oldest first. Ties are broken by name, so the order is the same on
+// every run.
+func sortUploadFiles(config Config, files []string) {
+	byName := func(a, b string) int {
+		return strings.Compare(filepath.Base(a), filepath.Base(b))
+	}
+	switch config.UploadOrder {
+	case "numeric":
+		slices.SortFunc(files, func(a, b string) int {
+			return cmp.Or(compareNatural(filepath.Base(a), filepath.Base(b)), byName(a, b))
+		})
+	case "mtime":
+		// A file that cannot be read sorts first; its upload reports the error.
+		modTimes := make(map[string]time.Time, len(files))
+		for _, file := range files {
+			if info, err := os.Stat(file); err == nil {
+				modTimes[file] = info.ModTime()
+			}
+		}
+		slices.SortFunc(files, func(a, b string) int {
+			return cmp.Or(modTimes[a].Compare(modTimes[b]), byName(a, b))
+		})
+	default:
+		slices.SortFunc(files, byName)
+	}
+}
+
+// compareNatural compares a and b like strings.Compare, except that runs of
+// digits are compared by their numeric value. Leading zeros are ignored, so
+// "snapshot007" and "snapshot7" compare equal.
+func compareNatural(a, b string) int {
+	for a != "" && b != "" {
+		digitsA, digitsB := leadingDigits(a), leadingDigits(b)
+		if digitsA == "" || digitsB == "" {
+			if c := cmp.Compare(a[0], b[0]); c != 0 {
+				return c
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+		a, b = a[len(digitsA):], b[len(digitsB):]
+		digitsA, digitsB = strings.TrimLeft(digitsA, "0"), strings.TrimLeft(digitsB, "0")
+		// Without leading zeros the longer number is the larger one.
+		if c := cmp.Or(cmp.Compare(len(digitsA), len(digitsB)), strings.Compare(digitsA, digitsB)); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(a), len(b))
+}
+
+// leadingDigits returns the run of ASCII digits at the start of s.
+func leadingDigits(s string) string {
+	end := 0
+	for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+		end++
+	}
+	return s[:end]
+}
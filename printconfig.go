@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// redacted replaces secrets in the output of -print-config.
+const redacted = "[redacted]"
+
+// printConfig writes the effective configuration as JSON to standard output,
+// for the -print-config flag, with the secrets redacted.
+func printConfig(config Config) error {
+	data, err := json.MarshalIndent(redactConfig(config), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// redactConfig returns config with every password and secret key that is set
+// replaced by a placeholder, so that it can be shown or logged.
+func redactConfig(config Config) Config {
+	redact := func(secret *string) {
+		if *secret != "" {
+			*secret = redacted
+		}
+	}
+	redact(&config.FTPPassword)
+	redact(&config.SFTPPassword)
+	redact(&config.S3SecretAccessKey)
+	redact(&config.SOCKS5Proxy.Password)
+
+	config.Destinations = slices.Clone(config.Destinations)
+	for i := range config.Destinations {
+		redact(&config.Destinations[i].FTPPassword)
+		redact(&config.Destinations[i].SFTPPassword)
+		redact(&config.Destinations[i].S3SecretAccessKey)
+	}
+	config.Profiles = maps.Clone(config.Profiles)
+	for name, profile := range config.Profiles {
+		redact(&profile.FTPPassword)
+		redact(&profile.SFTPPassword)
+		redact(&profile.S3SecretAccessKey)
+		config.Profiles[name] = profile
+	}
+	return config
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// profileEnv names the environment variable selecting a profile when the
+// -profile flag is not given.
+const profileEnv = "FTPDATAGENERATOR_PROFILE"
+
+// Profile is a named block of server and credential settings, such as one per
+// environment. The settings a selected profile sets replace the top-level ones;
+// those it leaves empty keep their top-level value.
+type Profile struct {
+	TransferProtocol string `json:"transfer_protocol"`
+	TCPAddress       string `json:"tcp_address"`
+
+	FTPHost          string `json:"ftp_host"`
+	FTPPort          int    `json:"ftp_port"`
+	FTPUser          string `json:"ftp_user"`
+	FTPPassword      string `json:"ftp_password"`
+	FTPAccount       string `json:"ftp_account"`
+	FTPTLS           string `json:"ftp_tls"`
+	TLSClientCert    string `json:"tls_client_cert"`
+	TLSClientKey     string `json:"tls_client_key"`
+	PinnedCertSHA256 string `json:"pinned_cert_sha256"`
+
+	SFTPHost       string `json:"sftp_host"`
+	SFTPPort       int    `json:"sftp_port"`
+	SFTPUser       string `json:"sftp_user"`
+	SFTPPassword   string `json:"sftp_password"`
+	SFTPPrivateKey string `json:"sftp_private_key"`
+	SFTPKnownHosts string `json:"sftp_known_hosts"`
+
+	S3Bucket          string `json:"s3_bucket"`
+	S3Region          string `json:"s3_region"`
+	S3Prefix          string `json:"s3_prefix"`
+	S3AccessKeyID     string `json:"s3_access_key_id"`
+	S3SecretAccessKey string `json:"s3_secret_access_key"`
+}
+
+// selectProfile applies the profile named by the -profile flag, the
+// FTPDATAGENERATOR_PROFILE environment variable or the profile key, in that
+// order of precedence. Without any of them config is returned unchanged.
+func selectProfile(config Config, flagProfile string) (Config, error) {
+	name := flagProfile
+	if name == "" {
+		name = os.Getenv(profileEnv)
+	}
+	if name == "" {
+		name = config.Profile
+	}
+	if name == "" {
+		return config, nil
+	}
+
+	profile, ok := config.Profiles[name]
+	if !ok {
+		return Config{}, fmt.Errorf("unknown profile '%s', defined are: %s", name, profileNames(config))
+	}
+	config.Profile = name
+	return applyProfile(config, profile), nil
+}
+
+// applyProfile returns config with the settings profile sets.
+func applyProfile(config Config, profile Profile) Config {
+	set := func(field *string, value string) {
+		if value != "" {
+			*field = value
+		}
+	}
+	set(&config.TransferProtocol, profile.TransferProtocol)
+	set(&config.TCPAddress, profile.TCPAddress)
+	set(&config.FTPHost, profile.FTPHost)
+	if profile.FTPPort != 0 {
+		config.FTPPort = profile.FTPPort
+	}
+	set(&config.FTPUser, profile.FTPUser)
+	set(&config.FTPPassword, profile.FTPPassword)
+	set(&config.FTPAccount, profile.FTPAccount)
+	set(&config.FTPTLS, profile.FTPTLS)
+	set(&config.TLSClientCert, profile.TLSClientCert)
+	set(&config.TLSClientKey, profile.TLSClientKey)
+	set(&config.PinnedCertSHA256, profile.PinnedCertSHA256)
+	set(&config.SFTPHost, profile.SFTPHost)
+	if profile.SFTPPort != 0 {
+		config.SFTPPort = profile.SFTPPort
+	}
+	set(&config.SFTPUser, profile.SFTPUser)
+	set(&config.SFTPPassword, profile.SFTPPassword)
+	set(&config.SFTPPrivateKey, profile.SFTPPrivateKey)
+	set(&config.SFTPKnownHosts, profile.SFTPKnownHosts)
+	set(&config.S3Bucket, profile.S3Bucket)
+	set(&config.S3Region, profile.S3Region)
+	set(&config.S3Prefix, profile.S3Prefix)
+	set(&config.S3AccessKeyID, profile.S3AccessKeyID)
+	set(&config.S3SecretAccessKey, profile.S3SecretAccessKey)
+	return config
+}
+
+// profileNames lists the defined profiles for error messages.
+func profileNames(config Config) string {
+	if len(config.Profiles) == 0 {
+		return "none"
+	}
+	names := make([]string, 0, len(config.Profiles))
+	for name := range config.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
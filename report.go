@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	reportTimeout       = 10 * time.Second
+	reportAttempts      = 3
+	reportRetryInterval = 2 * time.Second
+)
+
+// runReport is the JSON document posted to Config.ReportWebhookURL.
+type runReport struct {
+	Version         string             `json:"version"`
+	RunID           string             `json:"run_id"`
+	ConfigHash      string             `json:"config_hash"`
+	Started         time.Time          `json:"started"`
+	Finished        time.Time          `json:"finished"`
+	Seconds         float64            `json:"seconds"`
+	PhaseSeconds    map[string]float64 `json:"phase_seconds"`
+	Uploaded        int                `json:"uploaded"`
+	Failed          int                `json:"failed"`
+	Skipped         int                `json:"skipped"`
+	UnchangedFrames int                `json:"unchanged_frames"`
+	AbortedFiles    int                `json:"aborted_files"`
+	OverBudgetFiles int                `json:"over_budget_files"`
+	Discrepancies   int                `json:"discrepancies"`
+	Reconnects      int                `json:"reconnects"`
+	Errors          []string           `json:"errors"`
+}
+
+// newRunReport builds the report of the run from the counters in config.Stats.
+func newRunReport(config Config) runReport {
+	s := config.Stats
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	finished := time.Now()
+	report := runReport{
+		Version:         version,
+		RunID:           config.runID,
+		ConfigHash:      config.hash,
+		Started:         config.runTime,
+		Finished:        finished,
+		Seconds:         finished.Sub(config.runTime).Seconds(),
+		PhaseSeconds:    map[string]float64{},
+		Uploaded:        s.Uploaded,
+		Failed:          s.Failed,
+		Skipped:         s.Skipped,
+		UnchangedFrames: s.UnchangedFrames,
+		AbortedFiles:    s.AbortedFiles,
+		OverBudgetFiles: s.OverBudgetFiles,
+		Discrepancies:   s.Discrepancies,
+		Reconnects:      s.Reconnects,
+		Errors:          append([]string{}, s.Errors...),
+	}
+	for phase, d := range s.Durations {
+		report.PhaseSeconds[phase] = d.Seconds()
+	}
+	return report
+}
+
+// shortHashLength is the number of hex digits of the configuration hash used by
+// the {config_hash} placeholder of the remote templates.
+const shortHashLength = 12
+
+// configHash returns the SHA-256 of the configuration as JSON, with the secrets
+// redacted and the run timestamp of TimestampArtifacts left out, so that runs
+// with identical settings can be recognized. The hash covers the decoded
+// configuration, defaults included, not the files it was read from: the order
+// of their keys and how they were layered does not change it, as the fields
+// are encoded in declaration order and map keys sorted. Only the profile
+// applied counts, through the settings it set.
+func configHash(config Config) string {
+	if config.TimestampArtifacts {
+		stamp := "-" + runStamp(config)
+		config.TestVideoPath = strings.Replace(config.TestVideoPath, stamp, "", 1)
+		config.SnapshotOutputDir = strings.Replace(config.SnapshotOutputDir, stamp, "", 1)
+	}
+	config = redactConfig(config)
+	config.Profiles = nil
+	data, err := json.Marshal(config)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// sendReport posts the run report to the configured webhook, retrying a few
+// times. Failures are only logged; they never change the outcome of the run.
+func sendReport(config Config) {
+	if config.ReportWebhookURL == "" {
+		return
+	}
+
+	body, err := json.Marshal(newRunReport(config))
+	if err != nil {
+		log.Printf("Failed to encode run report: %v", err)
+		return
+	}
+
+	client := &http.Client{Timeout: reportTimeout}
+	for i := 0; i < reportAttempts; i++ {
+		if i > 0 {
+			time.Sleep(reportRetryInterval)
+		}
+		err = postReport(client, config.ReportWebhookURL, body)
+		if err == nil {
+			debugf("Run report sent to %s", config.ReportWebhookURL)
+			return
+		}
+		log.Printf("Failed to send run report, attempt %d/%d: %v", i+1, reportAttempts, err)
+	}
+}
+
+// postReport sends a single report request.
+func postReport(client *http.Client, url string, body []byte) error {
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// s3Uploader uploads to an S3 bucket, storing each file under S3Prefix.
+type s3Uploader struct {
+	client   *s3.Client
+	uploader *manager.Uploader
+	bucket   string
+	prefix   string
+	progress ProgressFunc
+	// encrypted is set when the files are uploaded encrypted, see EncryptUploads.
+	encrypted bool
+}
+
+// newS3Uploader creates an S3 client for the configured bucket. Static credentials
+// are used when both keys are configured, otherwise the ambient AWS credentials
+// (environment, shared config or IAM role) apply.
+func newS3Uploader(config *Config) (*s3Uploader, error) {
+	if config.S3Bucket == "" {
+		return nil, fmt.Errorf("s3_bucket must be set for the s3 transfer protocol")
+	}
+
+	var options []func(*awsconfig.LoadOptions) error
+	if config.S3Region != "" {
+		options = append(options, awsconfig.WithRegion(config.S3Region))
+	}
+	if config.S3AccessKeyID != "" || config.S3SecretAccessKey != "" {
+		options = append(options, awsconfig.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(config.S3AccessKeyID, config.S3SecretAccessKey, "")))
+	}
+
+	awsConfig, err := awsconfig.LoadDefaultConfig(context.Background(), options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS configuration: %v", err)
+	}
+
+	client := s3.NewFromConfig(awsConfig)
+	log.Printf("Uploading to S3 bucket %s (region %s)", config.S3Bucket, awsConfig.Region)
+	return &s3Uploader{
+		client:    client,
+		uploader:  manager.NewUploader(client),
+		bucket:    config.S3Bucket,
+		prefix:    config.S3Prefix,
+		encrypted: config.EncryptUploads,
+	}, nil
+}
+
+// key maps a remote path to an object key below the configured prefix.
+func (u *s3Uploader) key(targetFile string) string {
+	return strings.TrimPrefix(path.Join(u.prefix, filepath.ToSlash(targetFile)), "/")
+}
+
+func (u *s3Uploader) Upload(ctx context.Context, sourceFile string, targetFile string) (err error) {
+	file, err := os.Open(sourceFile)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		closeErr := file.Close()
+		if closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	return u.UploadReader(ctx, file, targetFile)
+}
+
+// Append uploads the whole file: S3 objects cannot be appended to.
+func (u *s3Uploader) Append(ctx context.Context, sourceFile string, targetFile string) error {
+	return u.Upload(ctx, sourceFile, targetFile)
+}
+
+func (u *s3Uploader) UploadReader(ctx context.Context, r io.Reader, targetFile string) error {
+	_, err := u.uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(u.bucket),
+		Key:    aws.String(u.key(targetFile)),
+		Body:   withProgress(r, targetFile, 0, u.progress),
+	})
+	return err
+}
+
+func (u *s3Uploader) Unchanged(sourceFile string, targetFile string) bool {
+	info, err := os.Stat(sourceFile)
+	if err != nil {
+		return false
+	}
+	head, err := u.client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String(u.bucket),
+		Key:    aws.String(u.key(targetFile)),
+	})
+	// Some S3-compatible servers leave out the modification time, so the object
+	// cannot be known to be current.
+	if err != nil || head.ContentLength == nil || head.LastModified == nil {
+		return false
+	}
+	size := info.Size()
+	if u.encrypted {
+		size = encryptedSize(size)
+	}
+	return *head.ContentLength == size && !head.LastModified.Before(info.ModTime())
+}
+
+func (u *s3Uploader) SetProgress(progress ProgressFunc) {
+	u.progress = progress
+}
+
+// List returns the objects directly below the key prefix of dir.
+func (u *s3Uploader) List(dir string) (map[string]int64, error) {
+	prefix := u.key(dir) + "/"
+	files := make(map[string]int64)
+	paginator := s3.NewListObjectsV2Paginator(u.client, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(u.bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range page.Contents {
+			files[strings.TrimPrefix(aws.ToString(object.Key), prefix)] = aws.ToInt64(object.Size)
+		}
+	}
+	return files, nil
+}
+
+// MakeDir does nothing: S3 has no directories, keys are created with their prefix.
+func (u *s3Uploader) MakeDir(dir string) error {
+	return nil
+}
+
+func (u *s3Uploader) Close() error {
+	return nil
+}
+
+// selfTest uploads and deletes a small probe object, for the -check mode.
+func (u *s3Uploader) selfTest(targetFile string) error {
+	err := u.UploadReader(context.Background(), strings.NewReader("FTPDataGenerator self-test\n"), targetFile)
+	if err != nil {
+		return fmt.Errorf("failed to upload S3 object '%s': %v", u.key(targetFile), err)
+	}
+	_, err = u.client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+		Bucket: aws.String(u.bucket),
+		Key:    aws.String(u.key(targetFile)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete S3 object '%s': %v", u.key(targetFile), err)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+// sceneFileName is the name of the file in OutputDir listing the frames taken
+// by SceneChangeThreshold, as printed by ffmpeg's metadata filter.
+const sceneFileName = "scenes.txt"
+
+// sceneFile returns the local path of the list of the frames taken on scene
+// changes.
+func sceneFile(config Config) string {
+	return filepath.Join(config.OutputDir, sceneFileName)
+}
+
+// sceneFilter returns the ffmpeg filters taking the frames whose scene change
+// score exceeds SceneChangeThreshold and printing their times to sceneFile.
+func sceneFilter(config Config) string {
+	threshold := strconv.FormatFloat(config.SceneChangeThreshold, 'f', -1, 64)
+	return "select='gt(scene," + threshold + ")',metadata=print:file='" + escapeFilterValue(sceneFile(config)) + "'"
+}
+
+// sceneTimePattern matches the line of sceneFile that starts the entry of a
+// frame, such as "frame:0    pts:12800   pts_time:1", capturing its time.
+var sceneTimePattern = regexp.MustCompile(`^frame:\S+\s+pts:\S+\s+pts_time:(\S+)`)
+
+// readSceneTimes returns the times in the video, in seconds, of the frames taken
+// on scene changes, in the order of the snapshots.
+func readSceneTimes(config Config) ([]string, error) {
+	file, err := os.Open(sceneFile(config))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scene change times: %v", err)
+	}
+	defer file.Close()
+
+	var times []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if match := sceneTimePattern.FindStringSubmatch(scanner.Text()); match != nil {
+			times = append(times, match[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read scene change times: %v", err)
+	}
+	return times, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"os"
+	"sort"
+)
+
+// configSchema is the JSON Schema describing configuration.json.
+//
+//go:embed configuration.schema.json
+var configSchema []byte
+
+// validateConfigFile checks the configuration file against the embedded schema and
+// returns every violation found, including unknown keys. An error is returned only
+// when the file cannot be read or parsed.
+func validateConfigFile(file string) ([]string, error) {
+	schemaDoc, err := jsonschema.UnmarshalJSON(bytes.NewReader(configSchema))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the embedded schema: %v", err)
+	}
+	compiler := jsonschema.NewCompiler()
+	err = compiler.AddResource("configuration.schema.json", schemaDoc)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := compiler.Compile("configuration.schema.json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile the embedded schema: %v", err)
+	}
+
+	configFile, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer configFile.Close()
+
+	doc, err := jsonschema.UnmarshalJSON(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse '%s': %v", file, err)
+	}
+
+	err = schema.Validate(doc)
+	if err == nil {
+		return nil, nil
+	}
+	validationErr, ok := err.(*jsonschema.ValidationError)
+	if !ok {
+		return nil, err
+	}
+
+	var violations []string
+	for _, unit := range validationErr.BasicOutput().Errors {
+		if unit.Error == nil {
+			continue
+		}
+		location := unit.InstanceLocation
+		if location == "" {
+			location = "/"
+		}
+		violations = append(violations, fmt.Sprintf("%s: %s", location, unit.Error))
+	}
+	sort.Strings(violations)
+	return violations, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strconv"
+)
+
+// snapshotSegment is the part of the video one ffmpeg process extracts snapshots
+// from when SnapshotSegments is set.
+type snapshotSegment struct {
+	// first is the index of the first snapshot of the segment, starting at 0.
+	first int
+	// count is the number of snapshots in the segment.
+	count int
+	// start and length are the position and duration of the segment in seconds.
+	start  float64
+	length float64
+}
+
+// snapshotSegments splits the expected snapshots into at most n segments of
+// nearly equal size. The segment boundaries fall on snapshot times, so that each
+// segment yields exactly its own snapshots.
+func snapshotSegments(config Config, n int) []snapshotSegment {
+	total := expectedSnapshotCount(config)
+	n = min(n, total)
+	period := snapshotPeriod(config)
+
+	segments := make([]snapshotSegment, 0, n)
+	first := 0
+	for i := 0; i < n; i++ {
+		count := total / n
+		if i < total%n {
+			count++
+		}
+		segments = append(segments, snapshotSegment{
+			first:  first,
+			count:  count,
+			start:  float64(first) * period,
+			length: float64(count) * period,
+		})
+		first += count
+	}
+	return segments
+}
+
+// snapshotPeriod returns the number of seconds between two snapshots.
+func snapshotPeriod(config Config) float64 {
+	if config.SnapshotCount > 0 {
+		return float64(config.Duration) / float64(config.SnapshotCount)
+	}
+	if config.SnapshotFPS > 0 {
+		return 1 / config.SnapshotFPS
+	}
+	return config.Interval.Seconds()
+}
+
+// generateSnapshotSegments runs one ffmpeg process per segment of the video, at
+// most SnapshotWorkers at a time, all writing into the directory of work. Each
+// process numbers its snapshots from the global index of its first snapshot, so
+// together they form one contiguous sequence, as a single process would.
+func generateSnapshotSegments(ctx context.Context, config Config, work Config) error {
+	workers := config.SnapshotWorkers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	segments := snapshotSegments(config, config.SnapshotSegments)
+	debugf("Generating %d snapshots in %d segments, %d at a time", expectedSnapshotCount(config), len(segments), workers)
+
+	return runLimited(workers, len(segments), func(i int) error {
+		segment := segments[i]
+		args := []string{ffmpegOverwriteFlag(config), "-ss", formatSeconds(segment.start), "-t", formatSeconds(segment.length)}
+		args = append(args, snapshotArgs(config)...)
+		args = append(args, "-frames:v", strconv.Itoa(segment.count), "-start_number", strconv.Itoa(segment.first+1))
+		args = append(args, threadArgs(config)...)
+		args = append(args, colorArgs(config)...)
+		args = append(args, snapshotFormatArgs(config)...)
+		args = append(args, config.FFmpegExtraArgs...)
+		args = append(args, snapshotPattern(work))
+
+		err := runFFmpeg(ctx, config, fmt.Sprintf("snapshots-%03d", segment.first+1), args)
+		if err != nil {
+			return fmt.Errorf("segment at %ss: %v", formatSeconds(segment.start), err)
+		}
+		return nil
+	})
+}
+
+// formatSeconds formats a number of seconds for ffmpeg's -ss and -t options.
+func formatSeconds(seconds float64) string {
+	return strconv.FormatFloat(seconds, 'f', -1, 64)
+}
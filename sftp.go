@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sftpDefaultPort is the port of the SSH server when SFTPPort is unset.
+const sftpDefaultPort = 22
+
+// sftpUploader uploads over SFTP to an SSH server whose host key is listed in
+// SFTPKnownHosts.
+type sftpUploader struct {
+	conn      net.Conn
+	ssh       *ssh.Client
+	client    *sftp.Client
+	progress  ProgressFunc
+	encrypted bool
+}
+
+// sftpAddress returns the host:port address of the SSH server.
+func sftpAddress(config *Config) string {
+	port := config.SFTPPort
+	if port == 0 {
+		port = sftpDefaultPort
+	}
+	return net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(config.SFTPHost, "["), "]"), strconv.Itoa(port))
+}
+
+// newSFTPUploader connects and logs in to the SSH server with the password or
+// private key, and opens the SFTP session. Host keys are checked strictly: the
+// connection fails unless the server presents a key listed for it in the
+// known_hosts file SFTPKnownHosts, so an unknown server is never trusted on
+// first use.
+func newSFTPUploader(ctx context.Context, config *Config) (*sftpUploader, error) {
+	hostKeyCallback, err := knownhosts.New(config.SFTPKnownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sftp_known_hosts: %v", err)
+	}
+	var auth []ssh.AuthMethod
+	if config.SFTPPrivateKey != "" {
+		key, err := os.ReadFile(config.SFTPPrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read sftp_private_key: %v", err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse sftp_private_key: %v", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if config.SFTPPassword != "" {
+		auth = append(auth, ssh.Password(config.SFTPPassword))
+	}
+	sshConfig := &ssh.ClientConfig{
+		User:            config.SFTPUser,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+	}
+
+	addr := sftpAddress(config)
+	log.Printf("Connecting to SFTP server %s", addr)
+	dialer := net.Dialer{Timeout: time.Duration(config.DialTimeout) * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SFTP server %s: %v", addr, err)
+	}
+	// The handshake has no context, so it is limited by a deadline, the dial
+	// timeout, and broken off once ctx is done.
+	if config.DialTimeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(time.Duration(config.DialTimeout) * time.Second))
+	}
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+	sshConn, channels, requests, err := ssh.NewClientConn(conn, addr, sshConfig)
+	if !stop() && err == nil {
+		err = context.Cause(ctx)
+	}
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		_ = conn.Close()
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) && len(keyErr.Want) == 0 {
+			return nil, fmt.Errorf("SFTP server %s is not listed in sftp_known_hosts '%s': %v", addr, config.SFTPKnownHosts, err)
+		} else if errors.As(err, &keyErr) {
+			return nil, fmt.Errorf("host key of SFTP server %s does not match sftp_known_hosts '%s': %v", addr, config.SFTPKnownHosts, err)
+		}
+		return nil, fmt.Errorf("failed to log in to SFTP server %s: %v", addr, err)
+	}
+	sshClient := ssh.NewClient(sshConn, channels, requests)
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		_ = sshClient.Close()
+		return nil, fmt.Errorf("failed to start SFTP on %s: %v", addr, err)
+	}
+	return &sftpUploader{conn: conn, ssh: sshClient, client: client, encrypted: config.EncryptUploads}, nil
+}
+
+// remotePath returns the slash-separated path of targetFile on the server.
+func (u *sftpUploader) remotePath(targetFile string) string {
+	return filepath.ToSlash(targetFile)
+}
+
+// abortOnDone breaks off the transfers in progress once ctx is done, by setting
+// a deadline in the past on the connection, as a write to the server may block
+// without ever reading the next part of the content. The session is unusable
+// afterwards. The returned function stops watching ctx.
+func (u *sftpUploader) abortOnDone(ctx context.Context) func() bool {
+	return context.AfterFunc(ctx, func() { _ = u.conn.SetDeadline(time.Now()) })
+}
+
+func (u *sftpUploader) Upload(ctx context.Context, sourceFile string, targetFile string) (err error) {
+	file, err := os.Open(sourceFile)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		closeErr := file.Close()
+		if closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	return u.UploadReader(ctx, file, targetFile)
+}
+
+// Append sends the part of sourceFile beyond the size of targetFile on the
+// server, or the whole file when the remote one is missing or larger.
+func (u *sftpUploader) Append(ctx context.Context, sourceFile string, targetFile string) (err error) {
+	file, err := os.Open(sourceFile)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		closeErr := file.Close()
+		if closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	remote, err := u.client.Stat(u.remotePath(targetFile))
+	if err != nil || remote.Size() > info.Size() {
+		return u.UploadReader(ctx, file, targetFile)
+	}
+	if remote.Size() == info.Size() {
+		debugf("Nothing to append to '%s'", targetFile)
+		return nil
+	}
+	if _, err = file.Seek(remote.Size(), io.SeekStart); err != nil {
+		return err
+	}
+	return u.write(ctx, os.O_WRONLY, remote.Size(), withProgress(file, targetFile, remote.Size(), u.progress), targetFile)
+}
+
+func (u *sftpUploader) UploadReader(ctx context.Context, r io.Reader, targetFile string) error {
+	return u.write(ctx, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0, withProgress(r, targetFile, 0, u.progress), targetFile)
+}
+
+// write copies r to targetFile, opened with flag, from offset. Appending is
+// done by writing at the end, as servers may ignore the append flag of SFTP.
+func (u *sftpUploader) write(ctx context.Context, flag int, offset int64, r io.Reader, targetFile string) error {
+	defer u.abortOnDone(ctx)()
+	remote, err := u.client.OpenFile(u.remotePath(targetFile), flag)
+	if err != nil {
+		return err
+	}
+	_, err = remote.Seek(offset, io.SeekStart)
+	if err == nil {
+		_, err = io.Copy(remote, withContext(ctx, r))
+	}
+	closeErr := remote.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+func (u *sftpUploader) Unchanged(sourceFile string, targetFile string) bool {
+	info, err := os.Stat(sourceFile)
+	if err != nil {
+		return false
+	}
+	remote, err := u.client.Stat(u.remotePath(targetFile))
+	if err != nil {
+		return false
+	}
+	size := info.Size()
+	if u.encrypted {
+		size = encryptedSize(size)
+	}
+	// SFTP keeps modification times to the second.
+	return remote.Size() == size && !remote.ModTime().Before(info.ModTime().Truncate(time.Second))
+}
+
+func (u *sftpUploader) SetProgress(progress ProgressFunc) {
+	u.progress = progress
+}
+
+// List returns the regular files in the remote directory dir.
+func (u *sftpUploader) List(dir string) (map[string]int64, error) {
+	entries, err := u.client.ReadDir(u.remotePath(dir))
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]int64, len(entries))
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() {
+			files[entry.Name()] = entry.Size()
+		}
+	}
+	return files, nil
+}
+
+// MakeDir creates dir and its missing parents.
+func (u *sftpUploader) MakeDir(dir string) error {
+	return u.client.MkdirAll(u.remotePath(dir))
+}
+
+// Close closes the SSH connection, which ends the SFTP session with it. The
+// session is not ended first, as the SFTP client would wait for the server to
+// close it, which not every server does.
+func (u *sftpUploader) Close() error {
+	err := u.ssh.Close()
+	_ = u.client.Close()
+	return err
+}
+
+// selfTest creates a directory, uploads a small probe file to it and removes
+// both, for the -check mode.
+func (u *sftpUploader) selfTest(dir string) error {
+	err := u.MakeDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to create remote directory '%s': %v", dir, err)
+	}
+	probe := path.Join(u.remotePath(dir), "probe.txt")
+	err = u.UploadReader(context.Background(), strings.NewReader("FTPDataGenerator self-test\n"), probe)
+	if err != nil {
+		return fmt.Errorf("failed to upload remote file '%s': %v", probe, err)
+	}
+	err = u.client.Remove(probe)
+	if err != nil {
+		return fmt.Errorf("failed to delete remote file '%s': %v", probe, err)
+	}
+	err = u.client.RemoveDirectory(u.remotePath(dir))
+	if err != nil {
+		return fmt.Errorf("failed to remove remote directory '%s': %v", dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// startSFTPServer starts an SSH server on the loopback address that accepts the
+// password "password" and serves SFTP on the local file system. It returns its
+// address and its host key.
+func startSFTPServer(t *testing.T) (string, ssh.PublicKey) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) != "password" {
+				return nil, os.ErrPermission
+			}
+			return nil, nil
+		},
+	}
+	serverConfig.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTP(conn, serverConfig)
+		}
+	}()
+	return listener.Addr().String(), signer.PublicKey()
+}
+
+// serveSFTP serves the SFTP subsystem on the SSH connection conn.
+func serveSFTP(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for request := range channelRequests {
+				_ = request.Reply(request.Type == "subsystem" && string(request.Payload[4:]) == "sftp", nil)
+			}
+		}()
+		server, err := sftp.NewServer(channel)
+		if err != nil {
+			return
+		}
+		_ = server.Serve()
+		_ = server.Close()
+	}
+}
+
+// sftpTestConfig returns a configuration uploading to the SFTP server at addr,
+// whose host key known_hosts lists as key.
+func sftpTestConfig(t *testing.T, addr string, key ssh.PublicKey) Config {
+	t.Helper()
+	host, port, _ := net.SplitHostPort(addr)
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	err := os.WriteFile(knownHosts, []byte(knownhosts.Line([]string{addr}, key)+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := defaultConfig()
+	config.TransferProtocol = "sftp"
+	config.SFTPHost = host
+	config.SFTPPort, _ = net.LookupPort("tcp", port)
+	config.SFTPUser = "user"
+	config.SFTPPassword = "password"
+	config.SFTPKnownHosts = knownHosts
+	return config
+}
+
+// TestSFTPUploader uploads, appends to and lists files over SFTP.
+func TestSFTPUploader(t *testing.T) {
+	addr, key := startSFTPServer(t)
+	config := sftpTestConfig(t, addr, key)
+	if err := validateConfig(config); err != nil {
+		t.Fatalf("validateConfig: %v", err)
+	}
+	uploader, err := newUploader(context.Background(), &config)
+	if err != nil {
+		t.Fatalf("newUploader: %v", err)
+	}
+	defer uploader.Close()
+
+	local := filepath.Join(t.TempDir(), "metadata.csv")
+	remoteDir := filepath.Join(t.TempDir(), "remote", "out")
+	remote := filepath.Join(remoteDir, "metadata.csv")
+	if err := uploader.MakeDir(remoteDir); err != nil {
+		t.Fatalf("MakeDir: %v", err)
+	}
+	if err := os.WriteFile(local, []byte("a,b\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := uploader.Upload(context.Background(), local, remote); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if !uploader.Unchanged(local, remote) {
+		t.Error("uploaded file not reported unchanged")
+	}
+
+	if err := os.WriteFile(local, []byte("a,b\n1,2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if uploader.Unchanged(local, remote) {
+		t.Error("grown file reported unchanged")
+	}
+	if err := uploader.Append(context.Background(), local, remote); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	content, err := os.ReadFile(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "a,b\n1,2\n" {
+		t.Errorf("remote content %q after the append, want %q", content, "a,b\n1,2\n")
+	}
+
+	if err := uploader.UploadReader(context.Background(), strings.NewReader("probe"), filepath.Join(remoteDir, "probe.txt")); err != nil {
+		t.Fatalf("UploadReader: %v", err)
+	}
+	files, err := uploader.List(remoteDir)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(files) != 2 || files["metadata.csv"] != 8 || files["probe.txt"] != 5 {
+		t.Errorf("List = %v, want metadata.csv of 8 bytes and probe.txt of 5", files)
+	}
+}
+
+// TestSFTPHostKeyChecking checks that the connection fails when the server's
+// host key is not the one listed in known_hosts, or the server is not listed.
+func TestSFTPHostKeyChecking(t *testing.T) {
+	addr, _ := startSFTPServer(t)
+	otherAddr, otherKey := startSFTPServer(t)
+
+	for name, config := range map[string]Config{
+		"changed key": sftpTestConfig(t, addr, otherKey),
+		"unknown host": func() Config {
+			config := sftpTestConfig(t, otherAddr, otherKey)
+			host, port, _ := net.SplitHostPort(addr)
+			config.SFTPHost = host
+			config.SFTPPort, _ = net.LookupPort("tcp", port)
+			return config
+		}(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			uploader, err := newSFTPUploader(context.Background(), &config)
+			if err == nil {
+				_ = uploader.Close()
+				t.Fatal("connected to a server whose host key is not in known_hosts")
+			}
+			if !strings.Contains(err.Error(), "sftp_known_hosts") {
+				t.Errorf("error %q does not name sftp_known_hosts", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// snapshotFormat describes a value of SnapshotFormat: the extension of the
+// snapshot files and the ffmpeg arguments writing them.
+type snapshotFormat struct {
+	extension string
+	args      []string
+}
+
+// snapshotFormats are the lossless formats of SnapshotFormat. Both store 8-bit
+// RGB: "ppm" as binary PPM (P6) files, "raw" as bare pixels without a header.
+var snapshotFormats = map[string]snapshotFormat{
+	"ppm": {".ppm", []string{"-c:v", "ppm", "-pix_fmt", "rgb24"}},
+	"raw": {".raw", []string{"-c:v", "rawvideo", "-pix_fmt", "rgb24", "-f", "image2"}},
+}
+
+// baselineJPEGArgs are the ffmpeg output arguments of SnapshotJPEGBaseline.
+// ffmpeg's mjpeg encoder only writes baseline JPEG, never progressive, but by
+// default with Huffman tables optimized for each image and, from RGB sources,
+// without chroma subsampling, which some old decoders cannot read. These
+// arguments select the standard Huffman tables and 4:2:0 subsampling.
+var baselineJPEGArgs = []string{"-c:v", "mjpeg", "-huffman", "default", "-pix_fmt", "yuvj420p"}
+
+// validateSnapshotFormat checks SnapshotFormat and SnapshotJPEGBaseline. Raw
+// snapshots have no header telling their size, so nothing that reads them back
+// can be used with them.
+func validateSnapshotFormat(config Config) error {
+	if config.SnapshotJPEGBaseline {
+		if config.SnapshotFormat != "" {
+			return fmt.Errorf("snapshot_jpeg_baseline cannot be used with snapshot_format")
+		}
+		switch strings.ToLower(filepath.Ext(config.SnapshotNameTemplate)) {
+		case ".jpg", ".jpeg":
+		default:
+			return fmt.Errorf("snapshot_jpeg_baseline requires a .jpg or .jpeg snapshot_name_template, got %q", config.SnapshotNameTemplate)
+		}
+	}
+	if config.SnapshotFormat == "" {
+		return nil
+	}
+	if _, ok := snapshotFormats[config.SnapshotFormat]; !ok {
+		return fmt.Errorf("snapshot_format must be \"ppm\" or \"raw\", got %q", config.SnapshotFormat)
+	}
+	if config.SnapshotFormat != "raw" {
+		return nil
+	}
+	if config.ContactSheetPath != "" || config.SpritePath != "" || config.SkipUnchangedFrames {
+		return fmt.Errorf("snapshot_format \"raw\" cannot be used with contact_sheet_path, sprite_path or skip_unchanged_frames, use \"ppm\"")
+	}
+	for _, column := range config.MetadataColumns {
+		if column == "width" || column == "height" {
+			return fmt.Errorf("metadata column '%s' cannot be used with snapshot_format \"raw\", use \"ppm\"", column)
+		}
+	}
+	return nil
+}
+
+// snapshotTemplate returns SnapshotNameTemplate with the extension of
+// SnapshotFormat in place of its own, when a format is set.
+func snapshotTemplate(config Config) string {
+	format, ok := snapshotFormats[config.SnapshotFormat]
+	if !ok {
+		return config.SnapshotNameTemplate
+	}
+	return strings.TrimSuffix(config.SnapshotNameTemplate, filepath.Ext(config.SnapshotNameTemplate)) + format.extension
+}
+
+// snapshotFormatArgs returns the ffmpeg output arguments of SnapshotFormat, or
+// of SnapshotJPEGBaseline. Without either, ffmpeg picks the encoder and its
+// settings from the extension of the snapshots.
+func snapshotFormatArgs(config Config) []string {
+	if config.SnapshotJPEGBaseline {
+		return baselineJPEGArgs
+	}
+	return snapshotFormats[config.SnapshotFormat].args
+}
+
+// warnSnapshotSize warns that the uncompressed snapshots of SnapshotFormat take
+// a lot of disk space, with an estimate when the resolution is given as WxH.
+func warnSnapshotSize(config Config) {
+	var width, height int
+	_, err := fmt.Sscanf(config.Resolution, "%dx%d", &width, &height)
+	if err != nil || width <= 0 || height <= 0 {
+		warnf("%s snapshots are uncompressed and take a lot of disk space in '%s'", config.SnapshotFormat, config.SnapshotOutputDir)
+		return
+	}
+	count := expectedSnapshotCount(config)
+	size := int64(width) * int64(height) * 3 * int64(count)
+	warnf("%s snapshots are uncompressed, %d snapshots of %s take about %d MB in '%s'", config.SnapshotFormat, count, config.Resolution, (size+1<<20-1)>>20, config.SnapshotOutputDir)
+}
+
+// ppmMagic starts binary PPM files.
+const ppmMagic = "P6"
+
+// The PPM snapshots are decoded like the JPEG and PNG ones, for their size in
+// the metadata, the contact sheet and the sprite, and for SkipUnchangedFrames.
+func init() {
+	image.RegisterFormat("ppm", ppmMagic, decodePPM, decodePPMConfig)
+}
+
+// decodePPMConfig reads the header of a binary PPM image.
+func decodePPMConfig(r io.Reader) (image.Config, error) {
+	width, height, _, err := readPPMHeader(bufio.NewReader(r))
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{ColorModel: color.RGBAModel, Width: width, Height: height}, nil
+}
+
+// decodePPM decodes a binary PPM image with 8-bit samples, as written by
+// ffmpeg's ppm encoder from rgb24.
+func decodePPM(r io.Reader) (image.Image, error) {
+	br := bufio.NewReader(r)
+	width, height, maxValue, err := readPPMHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	if maxValue > 255 {
+		return nil, fmt.Errorf("ppm: 16-bit samples are not supported")
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	pixel := make([]byte, 3)
+	for i := 0; i < width*height; i++ {
+		_, err = io.ReadFull(br, pixel)
+		if err != nil {
+			return nil, fmt.Errorf("ppm: %v", err)
+		}
+		copy(img.Pix[i*4:], pixel)
+		img.Pix[i*4+3] = 0xff
+	}
+	return img, nil
+}
+
+// readPPMHeader reads the magic, width, height and maximum sample value of a
+// binary PPM image, leaving r at the first pixel.
+func readPPMHeader(r *bufio.Reader) (width int, height int, maxValue int, err error) {
+	var fields [4]string
+	for i := range fields {
+		fields[i], err = readPPMToken(r)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("ppm: invalid header: %v", err)
+		}
+	}
+	if fields[0] != ppmMagic {
+		return 0, 0, 0, fmt.Errorf("ppm: not a binary PPM image")
+	}
+	values := make([]int, 3)
+	for i, field := range fields[1:] {
+		values[i], err = strconv.Atoi(field)
+		if err != nil || values[i] <= 0 {
+			return 0, 0, 0, fmt.Errorf("ppm: invalid header value %q", field)
+		}
+	}
+	return values[0], values[1], values[2], nil
+}
+
+// readPPMToken reads the next whitespace separated token of a PPM header,
+// skipping comments, and the single whitespace character that ends it.
+func readPPMToken(r *bufio.Reader) (string, error) {
+	var token []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			if errors.Is(err, io.EOF) && len(token) > 0 {
+				return string(token), nil
+			}
+			return "", err
+		}
+		switch {
+		case c == '#' && len(token) == 0:
+			_, err = r.ReadString('\n')
+			if err != nil {
+				return "", err
+			}
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if len(token) > 0 {
+				return string(token), nil
+			}
+		default:
+			token = append(token, c)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// generateSprite packs the snapshots of config into the thumbnail sprite sheet at
+// SpritePath, SpriteColumns tiles of SpriteTileWidth pixels per row, and writes
+// the WebVTT index of web players next to it, see writeSpriteVTT.
+func generateSprite(ctx context.Context, config Config) error {
+	snapshotFiles, err := globSnapshots(config)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve snapshot files: %v", err)
+	}
+	if len(snapshotFiles) == 0 {
+		return fmt.Errorf("no snapshots for the sprite sheet")
+	}
+	// The tiles keep the aspect ratio of the snapshots, which all have the size
+	// of the first one.
+	width, height, err := imageSize(snapshotFiles[0])
+	if err != nil {
+		return err
+	}
+	tileWidth := config.SpriteTileWidth
+	tileHeight := max(int(math.Round(float64(tileWidth)*float64(height)/float64(width))), 1)
+
+	log.Println("Generating sprite sheet...")
+	err = createDirectory(filepath.Dir(config.SpritePath))
+	if err != nil {
+		return err
+	}
+	workDir, err := makeWorkDir(config, filepath.Dir(config.SpritePath))
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %v", err)
+	}
+	defer removeWorkDir(workDir)
+	workFile := filepath.Join(workDir, filepath.Base(config.SpritePath))
+
+	columns := min(config.SpriteColumns, len(snapshotFiles))
+	rows := (len(snapshotFiles) + columns - 1) / columns
+	args := []string{ffmpegOverwriteFlag(config), "-i", snapshotPattern(config),
+		"-vf", fmt.Sprintf("scale=%d:%d,tile=%dx%d", tileWidth, tileHeight, columns, rows),
+		"-frames:v", "1"}
+	args = append(args, threadArgs(config)...)
+	args = append(args, workFile)
+	err = runFFmpeg(ctx, config, "sprite", args)
+	if err != nil {
+		return fmt.Errorf("failed to generate sprite sheet: %v", err)
+	}
+	err = checkOutputFile(workFile)
+	if err != nil {
+		return fmt.Errorf("ffmpeg did not produce the sprite sheet: %v", err)
+	}
+	err = moveFile(workFile, config.SpritePath)
+	if err != nil {
+		return fmt.Errorf("failed to move sprite sheet to '%s': %v", config.SpritePath, err)
+	}
+
+	err = writeSpriteVTT(config, len(snapshotFiles), columns, tileWidth, tileHeight)
+	if err != nil {
+		return fmt.Errorf("failed to write sprite index: %v", err)
+	}
+	log.Printf("Sprite sheet of %d snapshots (%dx%d) written to '%s', index to '%s'", len(snapshotFiles), columns, rows, config.SpritePath, spriteVTTPath(config))
+	return nil
+}
+
+// writeSpriteVTT writes the WebVTT index of the sprite sheet: one cue per
+// snapshot, from its time in the video to the time of the next one, pointing to
+// its tile with a "#xywh=" fragment of the sprite's remote name. Snapshot i is
+// taken at i times the snapshot period, see snapshotPeriod.
+func writeSpriteVTT(config Config, count int, columns int, tileWidth int, tileHeight int) error {
+	period := time.Duration(snapshotPeriod(config) * float64(time.Second))
+	sprite := remoteName(config, spriteRemoteName(config), config.SpritePath)
+
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+	for i := 0; i < count; i++ {
+		x, y := i%columns*tileWidth, i/columns*tileHeight
+		fmt.Fprintf(&b, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n",
+			vttTimestamp(time.Duration(i)*period), vttTimestamp(time.Duration(i+1)*period), sprite, x, y, tileWidth, tileHeight)
+	}
+	return writeFileAtomic(spriteVTTPath(config), []byte(b.String()))
+}
+
+// vttTimestamp formats d as a WebVTT timestamp, such as "00:01:02.500".
+func vttTimestamp(d time.Duration) string {
+	d = d.Round(time.Millisecond)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60, d.Milliseconds()%1000)
+}
+
+// spriteVTTPath returns the local path of the WebVTT index of the sprite sheet:
+// SpritePath with the extension .vtt.
+func spriteVTTPath(config Config) string {
+	return strings.TrimSuffix(config.SpritePath, filepath.Ext(config.SpritePath)) + ".vtt"
+}
+
+// spriteVTTRemoteName is the remote base name of the index of the sprite sheet.
+const spriteVTTRemoteName = "sprite.vtt"
+
+// spriteRemoteName returns the remote base name of the sprite sheet, "sprite"
+// with the extension of SpritePath.
+func spriteRemoteName(config Config) string {
+	return "sprite" + filepath.Ext(config.SpritePath)
+}
+
+// uploadSprite uploads the sprite sheet and its index to the remote directory.
+// The sheet goes first and the index is only uploaded with it, so that a player
+// never finds an index without its sheet.
+func uploadSprite(ctx context.Context, config *Config) {
+	files := []struct{ local, remote string }{
+		{config.SpritePath, spriteRemoteName(*config)},
+		{spriteVTTPath(*config), spriteVTTRemoteName},
+	}
+	for _, file := range files {
+		if ctx.Err() != nil {
+			log.Println("Sprite upload cancelled.")
+			return
+		}
+
+		targetFile := filepath.Join(remoteDir(*config), remoteName(*config, file.remote, file.local))
+		if config.SkipExisting && config.Uploader.Unchanged(file.local, targetFile) {
+			debugf("Skipping sprite file '%s', already on the server", file.local)
+			config.Stats.countSkipped()
+			continue
+		}
+
+		err := config.Uploader.Upload(ctx, file.local, targetFile)
+		if err != nil {
+			fileLogf(file.local, "Failed to upload sprite file '%s': %v", file.local, err)
+			config.Stats.countFailed(file.local, err)
+			return
+		}
+		fileLogf(file.local, "Uploaded sprite file '%s'", file.local)
+		config.Stats.countUploaded()
+	}
+}
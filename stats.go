@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// debugLogging enables the output of debugf. It is set from Config.Debug in main.
+var debugLogging bool
+
+// warnf logs a warning, at warn level in JSON mode.
+func warnf(format string, v ...interface{}) {
+	if jsonLogging {
+		slog.Warn(fmt.Sprintf(format, v...))
+		return
+	}
+	log.Printf("Warning: "+format, v...)
+}
+
+// debugf logs a message only when debug logging is enabled.
+func debugf(format string, v ...interface{}) {
+	if !debugLogging {
+		return
+	}
+	if jsonLogging {
+		slog.Debug(fmt.Sprintf(format, v...))
+		return
+	}
+	log.Printf("DEBUG: "+format, v...)
+}
+
+// Stats collects the counters reported in the run summary. It is shared by the
+// upload goroutines, so all updates go through its methods.
+type Stats struct {
+	mu sync.Mutex
+
+	Uploaded int
+	Failed   int
+	Skipped  int
+	// Discrepancies counts files found missing or with a different size on the
+	// server by the post-upload verification.
+	Discrepancies int
+	// Reconnects counts the FTP connections re-established after dropping.
+	Reconnects int
+	// MetadataFailures counts the metadata files that could not be uploaded.
+	// They are counted in Failed as well.
+	MetadataFailures int
+	// UnchangedFrames counts the snapshots skipped by SkipUnchangedFrames. They
+	// are counted in Skipped as well.
+	UnchangedFrames int
+	// AbortedFiles counts the snapshots not attempted because the upload of their
+	// batch was aborted by MaxConsecutiveFailures.
+	AbortedFiles int
+	// OverBudgetFiles counts the files not uploaded because the run sent
+	// MaxUploadBytes. They are not counted as failed.
+	OverBudgetFiles int
+	// abortErr is the error of the first aborted batch.
+	abortErr error
+	// UploadedBytes counts the bytes of the uploaded files. It is only counted
+	// with -bench, see benchUploader.
+	UploadedBytes int64
+
+	// Errors lists the failures of the run, one message each.
+	Errors []string
+	// Durations holds the wall time of the phases of the run, by phase name.
+	Durations map[string]time.Duration
+}
+
+// countUploaded records a successfully uploaded file.
+func (s *Stats) countUploaded() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Uploaded++
+}
+
+// countFailed records a file that could not be uploaded.
+func (s *Stats) countFailed(file string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if errors.Is(err, ErrByteBudget) {
+		s.OverBudgetFiles++
+		return
+	}
+	s.Failed++
+	s.Errors = append(s.Errors, fmt.Sprintf("%s: %v", file, err))
+}
+
+// recordError records a failure that is not tied to a single file.
+func (s *Stats) recordError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Errors = append(s.Errors, err.Error())
+}
+
+// recordDuration records how long a phase of the run took.
+func (s *Stats) recordDuration(phase string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Durations == nil {
+		s.Durations = map[string]time.Duration{}
+	}
+	s.Durations[phase] = d
+}
+
+// countMetadataFailure records a metadata file that could not be uploaded.
+func (s *Stats) countMetadataFailure() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.MetadataFailures++
+}
+
+// metadataFailures returns the number of metadata files not uploaded.
+func (s *Stats) metadataFailures() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.MetadataFailures
+}
+
+// notUploaded returns the number of files that failed to upload, were aborted or
+// were over the byte budget.
+func (s *Stats) notUploaded() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Failed + s.AbortedFiles + s.OverBudgetFiles
+}
+
+// countSkipped records a file that was not uploaded because the server already had it.
+func (s *Stats) countSkipped() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Skipped++
+}
+
+// countUnchangedFrame records a snapshot not uploaded because it did not differ
+// from the previous one.
+func (s *Stats) countUnchangedFrame() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Skipped++
+	s.UnchangedFrames++
+}
+
+// countAborted records a batch whose upload was aborted by err, leaving files
+// snapshots not attempted.
+func (s *Stats) countAborted(files int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.AbortedFiles += files
+	s.Errors = append(s.Errors, err.Error())
+	if s.abortErr == nil {
+		s.abortErr = err
+	}
+}
+
+// countOverBudget records files not attempted once MaxUploadBytes was sent.
+func (s *Stats) countOverBudget(files int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.OverBudgetFiles += files
+}
+
+// abortError returns the error of the first aborted batch, or nil.
+func (s *Stats) abortError() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.abortErr
+}
+
+// countDiscrepancy records a file missing or mismatched on the server.
+func (s *Stats) countDiscrepancy() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Discrepancies++
+}
+
+// countReconnect records a dropped FTP connection that was re-established.
+func (s *Stats) countReconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Reconnects++
+}
+
+// logSummary logs the collected counters at the end of the run runID, whose
+// configuration has the configHash hash.
+func (s *Stats) logSummary(runID string, hash string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	log.Printf("Configuration hash of run %s: %s", runID, hash)
+	log.Printf("Summary of run %s: %d uploaded, %d failed, %d skipped (%d unchanged frames), %d remote discrepancies, %d reconnects",
+		runID, s.Uploaded, s.Failed, s.Skipped, s.UnchangedFrames, s.Discrepancies, s.Reconnects)
+	if s.abortErr != nil {
+		log.Printf("Snapshot upload aborted after too many consecutive failures, %d files not uploaded", s.AbortedFiles)
+	}
+	if s.OverBudgetFiles > 0 {
+		log.Printf("Byte budget exhausted, %d files left for the next run", s.OverBudgetFiles)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// serviceStatus is the state of the program reported by the status server.
+type serviceStatus struct {
+	mu sync.Mutex
+
+	State         string    `json:"state"`
+	Runs          int       `json:"runs"`
+	LastStart     time.Time `json:"last_start,omitempty"`
+	LastEnd       time.Time `json:"last_end,omitempty"`
+	LastError     string    `json:"last_error,omitempty"`
+	Uploaded      int       `json:"uploaded"`
+	Failed        int       `json:"failed"`
+	Skipped       int       `json:"skipped"`
+	Discrepancies int       `json:"discrepancies"`
+	// NextRun is when the next queued run was due to start, unset when none is
+	// waiting.
+	NextRun    time.Time `json:"next_run,omitempty"`
+	lastFailed bool
+	idleState  string
+	// scheduler is the state of the watch scheduler starting the runs:
+	// "running", "stopped", or empty for a single run.
+	scheduler string
+	queued    int
+}
+
+// runOverdueAfter is how long a queued run may wait, with no run in progress,
+// before /healthz reports it overdue.
+const runOverdueAfter = time.Minute
+
+// status is updated by Run and read by the status server.
+var status = &serviceStatus{State: "starting", idleState: "idle"}
+
+// schedulerStarted records the start of the scheduler, with the state reported
+// between runs, "watching" for example.
+func (s *serviceStatus) schedulerStarted(idleState string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scheduler = "running"
+	s.idleState = idleState
+	if s.State != "running" {
+		s.State = idleState
+	}
+}
+
+// schedulerStopped records that the scheduler stopped, so no further run starts.
+func (s *serviceStatus) schedulerStopped() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scheduler = "stopped"
+	s.idleState = "stopped"
+	if s.State != "running" {
+		s.State = "stopped"
+	}
+}
+
+// runQueued records a run waiting to start. It is due at once unless another
+// run is waiting already.
+func (s *serviceStatus) runQueued() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queued++
+	if s.NextRun.IsZero() {
+		s.NextRun = time.Now()
+	}
+}
+
+// runStarted records the start of a run.
+func (s *serviceStatus) runStarted() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.State = "running"
+	s.LastStart = time.Now()
+	s.queued = max(s.queued-1, 0)
+	s.NextRun = time.Time{}
+}
+
+// runFinished records the outcome of a run and its counters.
+func (s *serviceStatus) runFinished(err error, stats *Stats) {
+	stats.mu.Lock()
+	uploaded, failed, skipped, discrepancies := stats.Uploaded, stats.Failed, stats.Skipped, stats.Discrepancies
+	stats.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.State = s.idleState
+	s.Runs++
+	s.LastEnd = time.Now()
+	s.lastFailed = err != nil
+	s.LastError = ""
+	if err != nil {
+		s.LastError = err.Error()
+	}
+	s.Uploaded, s.Failed, s.Skipped, s.Discrepancies = uploaded, failed, skipped, discrepancies
+	// The next queued run is due as soon as this one is over.
+	if s.queued > 0 {
+		s.NextRun = s.LastEnd
+	}
+}
+
+// unhealthy returns why /healthz fails at now: the last run failed, the
+// scheduler stopped, or a queued run has not started for runOverdueAfter. It
+// returns an empty string when the service is healthy.
+func (s *serviceStatus) unhealthy(now time.Time) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.lastFailed:
+		return "last run failed"
+	case s.scheduler == "stopped":
+		return "scheduler not running"
+	case s.State != "running" && !s.NextRun.IsZero() && now.Sub(s.NextRun) > runOverdueAfter:
+		return fmt.Sprintf("next run overdue since %s", s.NextRun.Format(time.RFC3339))
+	}
+	return ""
+}
+
+// serveStatus serves /healthz and /status on addr until ctx is done. /healthz
+// answers 200 unless the service is unhealthy, /status the serviceStatus as
+// JSON.
+func serveStatus(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if reason := status.unhealthy(time.Now()); reason != "" {
+			http.Error(w, reason, http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		status.mu.Lock()
+		body, err := json.Marshal(status)
+		status.mu.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(body)
+	})
+
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("Serving status on %s", addr)
+	err := server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("Failed to serve status: %v", err)
+	}
+}
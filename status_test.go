@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestStatusUnhealthy checks that /healthz fails after a failed run, once the
+// scheduler stopped and when a queued run did not start in time.
+func TestStatusUnhealthy(t *testing.T) {
+	s := &serviceStatus{State: "starting", idleState: "idle"}
+	now := time.Now()
+	if reason := s.unhealthy(now); reason != "" {
+		t.Errorf("unhealthy before the first run: %s", reason)
+	}
+
+	s.schedulerStarted("watching")
+	s.runQueued()
+	if reason := s.unhealthy(now); reason != "" {
+		t.Errorf("unhealthy with a run just queued: %s", reason)
+	}
+	if reason := s.unhealthy(now.Add(2 * runOverdueAfter)); reason == "" {
+		t.Error("queued run not reported overdue")
+	}
+
+	s.runStarted()
+	if reason := s.unhealthy(now.Add(2 * runOverdueAfter)); reason != "" {
+		t.Errorf("unhealthy with the queued run started: %s", reason)
+	}
+	s.runFinished(errors.New("upload failed"), &Stats{})
+	if reason := s.unhealthy(now); reason != "last run failed" {
+		t.Errorf("unhealthy = %q after a failed run, want %q", reason, "last run failed")
+	}
+	s.runStarted()
+	s.runFinished(nil, &Stats{})
+	if reason := s.unhealthy(now.Add(2 * runOverdueAfter)); reason != "" {
+		t.Errorf("unhealthy after a successful run with nothing queued: %s", reason)
+	}
+
+	s.schedulerStopped()
+	if reason := s.unhealthy(now); reason != "scheduler not running" {
+		t.Errorf("unhealthy = %q with the scheduler stopped, want %q", reason, "scheduler not running")
+	}
+	if s.State != "stopped" {
+		t.Errorf("state = %q with the scheduler stopped, want %q", s.State, "stopped")
+	}
+}
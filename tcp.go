@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The tcp transfer protocol streams every file over one connection to
+// TCPAddress, as a frame of:
+//
+//	name length (uint16) | name (UTF-8) | content length (uint64) | content
+//
+// Integers are big-endian. The name is the remote path of the file, with
+// slashes as separators, as it would be stored on an FTP server. Frames follow
+// each other on the connection without acknowledgement; the receiver closes it
+// to reject a file. Delivery is fire-and-forget: an upload succeeds once its
+// frame is written to the socket, so a frame still in flight when the receiver
+// closes the connection, or crashes, is lost without an error. The protocol has
+// no listing, so skip_existing uploads every file and verify_remote_listing
+// cannot be used.
+const tcpMaxNameLength = math.MaxUint16
+
+// tcpUploader uploads to an ingest endpoint speaking the tcp transfer protocol.
+type tcpUploader struct {
+	address string
+	dialer  net.Dialer
+	// timeout returns the time allowed for an upload of the given size, see
+	// transferTimeout.
+	timeout  func(size int64) time.Duration
+	progress ProgressFunc
+
+	// mu serializes the frames on conn, which is nil until the first upload
+	// and after a failed one.
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// newTCPUploader connects to the configured TCP ingest endpoint.
+func newTCPUploader(ctx context.Context, config *Config) (*tcpUploader, error) {
+	if config.TCPAddress == "" {
+		return nil, fmt.Errorf("tcp_address must be set for the tcp transfer protocol")
+	}
+	u := &tcpUploader{
+		address: config.TCPAddress,
+		dialer:  net.Dialer{Timeout: time.Duration(config.DialTimeout) * time.Second},
+		timeout: func(size int64) time.Duration { return transferTimeout(*config, size) },
+	}
+	conn, err := u.dialer.DialContext(ctx, "tcp", u.address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to TCP endpoint %s: %v", u.address, err)
+	}
+	u.conn = conn
+	log.Printf("Uploading to TCP endpoint %s", u.address)
+	return u, nil
+}
+
+func (u *tcpUploader) Upload(ctx context.Context, sourceFile string, targetFile string) (err error) {
+	file, err := os.Open(sourceFile)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		closeErr := file.Close()
+		if closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	return u.UploadReader(ctx, file, targetFile)
+}
+
+// Append uploads the whole file: a frame always carries a complete file.
+func (u *tcpUploader) Append(ctx context.Context, sourceFile string, targetFile string) error {
+	return u.Upload(ctx, sourceFile, targetFile)
+}
+
+// UploadReader sends r as one frame. Readers of unknown size, such as those of
+// encrypted uploads, are read into memory first, as the frame starts with the
+// content length.
+func (u *tcpUploader) UploadReader(ctx context.Context, r io.Reader, targetFile string) error {
+	name := filepath.ToSlash(targetFile)
+	if len(name) > tcpMaxNameLength {
+		return fmt.Errorf("remote name of %d bytes exceeds the limit of the tcp protocol", len(name))
+	}
+	size := readerSize(r)
+	if size < 0 {
+		content, err := io.ReadAll(withContext(ctx, r))
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(content)
+		size = int64(len(content))
+	}
+
+	header := binary.BigEndian.AppendUint16(nil, uint16(len(name)))
+	header = append(header, name...)
+	header = binary.BigEndian.AppendUint64(header, uint64(size))
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.conn == nil {
+		conn, err := u.dialer.DialContext(ctx, "tcp", u.address)
+		if err != nil {
+			return fmt.Errorf("failed to connect to TCP endpoint %s: %v", u.address, err)
+		}
+		u.conn = conn
+	}
+	// The deadline of an earlier frame must not carry over to one without a
+	// timeout.
+	if timeout := u.timeout(size); timeout > 0 {
+		_ = u.conn.SetDeadline(time.Now().Add(timeout))
+	} else {
+		_ = u.conn.SetDeadline(time.Time{})
+	}
+
+	// Once part of a frame was sent the stream cannot be resynchronized, so a
+	// failed upload drops the connection and the next one opens a new one.
+	content := withProgress(withContext(ctx, r), targetFile, 0, u.progress)
+	_, err := u.conn.Write(header)
+	if err == nil {
+		var n int64
+		n, err = io.CopyN(u.conn, content, size)
+		if errors.Is(err, io.EOF) {
+			err = fmt.Errorf("file shrank to %d of %d bytes during the upload", n, size)
+		}
+	}
+	if err != nil {
+		_ = u.conn.Close()
+		u.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Unchanged reports false: the protocol cannot query the receiver.
+func (u *tcpUploader) Unchanged(sourceFile string, targetFile string) bool {
+	return false
+}
+
+func (u *tcpUploader) SetProgress(progress ProgressFunc) {
+	u.progress = progress
+}
+
+// List fails: the protocol has no listing.
+func (u *tcpUploader) List(dir string) (map[string]int64, error) {
+	return nil, fmt.Errorf("the tcp transfer protocol cannot list remote directories")
+}
+
+// MakeDir does nothing: the remote path travels in the name of each file.
+func (u *tcpUploader) MakeDir(dir string) error {
+	return nil
+}
+
+func (u *tcpUploader) Close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.conn == nil {
+		return nil
+	}
+	err := u.conn.Close()
+	u.conn = nil
+	return err
+}
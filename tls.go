@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// tlsSessionCache holds the TLS sessions of all FTPS connections of the
+// process that verify the server against the CA chain, so that reconnections
+// and later runs, which build a new tls.Config, resume them instead of doing a
+// full handshake. Many servers also require the data connections to resume the
+// session of the control connection.
+var tlsSessionCache = tls.NewLRUClientSessionCache(0)
+
+// pinnedSessionCaches holds one session cache per pinned_cert_sha256, so that
+// a session verified against one trust anchor is never offered by a
+// configuration that trusts another.
+var (
+	pinnedSessionCachesMu sync.Mutex
+	pinnedSessionCaches   = map[string]tls.ClientSessionCache{}
+)
+
+// pinnedSessionCache returns the session cache of the given pin.
+func pinnedSessionCache(pin []byte) tls.ClientSessionCache {
+	pinnedSessionCachesMu.Lock()
+	defer pinnedSessionCachesMu.Unlock()
+	cache, ok := pinnedSessionCaches[string(pin)]
+	if !ok {
+		cache = tls.NewLRUClientSessionCache(0)
+		pinnedSessionCaches[string(pin)] = cache
+	}
+	return cache
+}
+
+// ftpTLSConfig builds the TLS configuration for FTPS, including the client
+// certificate for servers that require mutual TLS, the pinned server
+// certificate, if any, and the session cache unless FTPTLSSessionCache is off.
+func ftpTLSConfig(config *Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: ftpHost(config),
+		MinVersion: tls.VersionTLS12,
+	}
+	if config.FTPTLSSessionCache {
+		tlsConfig.ClientSessionCache = tlsSessionCache
+	}
+
+	if config.TLSClientCert != "" {
+		certificate, err := tls.LoadX509KeyPair(config.TLSClientCert, config.TLSClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS client certificate '%s' and key '%s': %v",
+				config.TLSClientCert, config.TLSClientKey, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	if config.PinnedCertSHA256 != "" {
+		pin, err := parseCertFingerprint(config.PinnedCertSHA256)
+		if err != nil {
+			return nil, err
+		}
+		// The pin replaces the CA chain as the trust anchor, so that servers with a
+		// self-signed certificate can be pinned as well. It is checked in
+		// VerifyConnection, as VerifyPeerCertificate is skipped on resumed
+		// sessions.
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = verifyPinnedCert(pin)
+		if config.FTPTLSSessionCache {
+			tlsConfig.ClientSessionCache = pinnedSessionCache(pin)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// parseCertFingerprint decodes a SHA-256 fingerprint written in hex, with or
+// without colons between the bytes.
+func parseCertFingerprint(fingerprint string) ([]byte, error) {
+	pin, err := hex.DecodeString(strings.ReplaceAll(fingerprint, ":", ""))
+	if err != nil || len(pin) != sha256.Size {
+		return nil, fmt.Errorf("pinned_cert_sha256 must be a SHA-256 fingerprint in hex, got '%s'", fingerprint)
+	}
+	return pin, nil
+}
+
+// verifyPinnedCert returns a VerifyConnection callback that accepts only a
+// server whose leaf certificate has the given SHA-256 fingerprint, on full and
+// resumed handshakes alike.
+func verifyPinnedCert(pin []byte) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return fmt.Errorf("server presented no certificate")
+		}
+		sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+		if !bytes.Equal(sum[:], pin) {
+			return fmt.Errorf("server certificate fingerprint %s does not match pinned_cert_sha256", hex.EncodeToString(sum[:]))
+		}
+		return nil
+	}
+}
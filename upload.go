@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Uploader transfers the generated files to a remote destination. Remote paths
+// are the slash-separated paths built from Config.OutputDir.
+type Uploader interface {
+	// Upload uploads the local sourceFile to targetFile, aborting when ctx is done.
+	Upload(ctx context.Context, sourceFile string, targetFile string) error
+	// Append uploads the part of sourceFile missing from the end of targetFile.
+	// Backends that cannot append upload the whole file.
+	Append(ctx context.Context, sourceFile string, targetFile string) error
+	// UploadReader uploads the content of r to targetFile, aborting when ctx is done.
+	UploadReader(ctx context.Context, r io.Reader, targetFile string) error
+	// Unchanged reports whether targetFile already exists remotely and matches sourceFile.
+	Unchanged(sourceFile string, targetFile string) bool
+	// SetProgress installs a callback invoked as bytes of each upload are sent.
+	SetProgress(progress ProgressFunc)
+	// List returns the files in the remote directory dir, mapped to their sizes.
+	List(dir string) (map[string]int64, error)
+	// MakeDir creates a remote directory. Backends without directories do nothing.
+	MakeDir(dir string) error
+	// Close releases the connection to the destination.
+	Close() error
+}
+
+// newUploader connects to the destination selected by config.TransferProtocol.
+func newUploader(ctx context.Context, config *Config) (Uploader, error) {
+	switch config.TransferProtocol {
+	case "", "ftp":
+		err := establishFTPConnection(ctx, config)
+		if err != nil {
+			return nil, err
+		}
+		return &ftpUploader{config: config}, nil
+	case "sftp":
+		return newSFTPUploader(ctx, config)
+	case "s3":
+		return newS3Uploader(config)
+	case "tcp":
+		return newTCPUploader(ctx, config)
+	default:
+		return nil, fmt.Errorf("unsupported transfer protocol %q", config.TransferProtocol)
+	}
+}
+
+// transferProtocolName returns the name of the upload destination of config
+// for the log: "FTP", "FTPS", "SFTP", "S3" or "TCP".
+func transferProtocolName(config Config) string {
+	switch config.TransferProtocol {
+	case "", "ftp":
+		if config.FTPTLS != "" {
+			return "FTPS"
+		}
+		return "FTP"
+	default:
+		return strings.ToUpper(config.TransferProtocol)
+	}
+}
+
+// ftpUploader uploads over the FTP connection held in its configuration.
+type ftpUploader struct {
+	config *Config
+}
+
+func (u *ftpUploader) Upload(ctx context.Context, sourceFile string, targetFile string) error {
+	return uploadFile(ctx, u.config, sourceFile, targetFile)
+}
+
+func (u *ftpUploader) Append(ctx context.Context, sourceFile string, targetFile string) error {
+	return appendFile(ctx, u.config, sourceFile, targetFile)
+}
+
+func (u *ftpUploader) UploadReader(ctx context.Context, r io.Reader, targetFile string) error {
+	return uploadReader(ctx, u.config, r, targetFile)
+}
+
+func (u *ftpUploader) Unchanged(sourceFile string, targetFile string) bool {
+	return remoteFileUnchanged(u.config, sourceFile, targetFile)
+}
+
+func (u *ftpUploader) SetProgress(progress ProgressFunc) {
+	u.config.progress = progress
+}
+
+func (u *ftpUploader) List(dir string) (map[string]int64, error) {
+	return listRemoteDir(u.config, dir)
+}
+
+func (u *ftpUploader) MakeDir(dir string) error {
+	makeRemoteDir(u.config, dir)
+	if u.config.AtomicRemoteUpload && !u.config.ResumeUploads {
+		removeAtomicLeftovers(u.config, dir)
+	}
+	return nil
+}
+
+func (u *ftpUploader) Close() error {
+	closeFTPConnection(u.config)
+	return nil
+}
+
+// contextReader fails reads once its context is done, aborting the transfer
+// consuming it.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// withContext wraps r so that reading it fails once ctx is done.
+func withContext(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, r: r}
+}
+
+func (c *contextReader) Read(b []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(b)
+}
+
+// ProgressFunc reports that sent of total bytes of targetFile have been uploaded.
+// total is -1 when the size of the upload is not known in advance.
+type ProgressFunc func(targetFile string, sent int64, total int64)
+
+// progressReader counts the bytes read through it and reports them to progress.
+type progressReader struct {
+	r          io.Reader
+	targetFile string
+	sent       int64
+	total      int64
+	progress   ProgressFunc
+}
+
+// withProgress wraps r so that progress is called as it is read. offset is the
+// number of bytes already uploaded, for resumed uploads. Without a callback r is
+// returned unchanged.
+func withProgress(r io.Reader, targetFile string, offset int64, progress ProgressFunc) io.Reader {
+	if progress == nil {
+		return r
+	}
+	return &progressReader{r: r, targetFile: targetFile, sent: offset, total: readerSize(r), progress: progress}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.sent += int64(n)
+		p.progress(p.targetFile, p.sent, p.total)
+	}
+	return n, err
+}
+
+// readerSize returns the total size of files and in-memory readers, or -1.
+func readerSize(r io.Reader) int64 {
+	switch v := r.(type) {
+	case interface{ Stat() (os.FileInfo, error) }:
+		if info, err := v.Stat(); err == nil {
+			return info.Size()
+		}
+	case interface{ Len() int }:
+		return int64(v.Len())
+	}
+	return -1
+}
+
+// progressLogger logs the progress of each upload whenever it crosses a 10% step.
+type progressLogger struct {
+	mu   sync.Mutex
+	last map[string]int64
+}
+
+func newProgressLogger() *progressLogger {
+	return &progressLogger{last: make(map[string]int64)}
+}
+
+func (l *progressLogger) log(targetFile string, sent int64, total int64) {
+	if total <= 0 {
+		return
+	}
+	step := sent * 10 / total
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if step <= l.last[targetFile] {
+		return
+	}
+	l.last[targetFile] = step
+	if step >= 10 {
+		delete(l.last, targetFile)
+	}
+	log.Printf("Uploading '%s': %d%% (%d/%d bytes)", targetFile, step*10, sent, total)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// watchQueueSize is the number of settled files that may wait for processing
+// before the watcher stops taking in new events.
+const watchQueueSize = 64
+
+// runWatch watches WatchDir and runs the pipeline with Run for every new file
+// matching WatchPattern, one file at a time, until ctx is done. A file is only
+// processed once no event has been seen for it for WatchDebounceMs and its size
+// stopped changing, so that files still being written are left alone.
+func runWatch(ctx context.Context, config Config) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to start watching: %v", err)
+	}
+	defer watcher.Close()
+
+	err = watcher.Add(config.WatchDir)
+	if err != nil {
+		return fmt.Errorf("failed to watch '%s': %v", config.WatchDir, err)
+	}
+	log.Printf("Watching '%s' for new files matching '%s'", config.WatchDir, config.WatchPattern)
+	status.schedulerStarted("watching")
+	defer status.schedulerStopped()
+
+	queue := make(chan string, watchQueueSize)
+	done := make(chan struct{})
+	// A single goroutine processes the queue, as Run must not run concurrently.
+	go func() {
+		defer close(done)
+		for file := range queue {
+			log.Printf("Processing '%s'...", file)
+			err := Run(ctx, watchedFileConfig(config, file))
+			if err != nil {
+				log.Printf("Failed to process '%s': %v", file, err)
+			}
+		}
+	}()
+
+	debounce := time.Duration(config.WatchDebounceMs) * time.Millisecond
+	settled := make(chan string)
+	timers := map[string]*time.Timer{}
+	sizes := map[string]int64{}
+	arm := func(file string) {
+		sizes[file] = fileSize(file)
+		if timer, ok := timers[file]; ok {
+			timer.Reset(debounce)
+			return
+		}
+		timers[file] = time.AfterFunc(debounce, func() {
+			select {
+			case settled <- file:
+			case <-ctx.Done():
+			}
+		})
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			for _, timer := range timers {
+				timer.Stop()
+			}
+			close(queue)
+			<-done
+			return nil
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return fmt.Errorf("watcher closed")
+			}
+			if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) {
+				continue
+			}
+			if match, _ := filepath.Match(config.WatchPattern, filepath.Base(event.Name)); !match {
+				continue
+			}
+			debugf("Watch event %s", event)
+			arm(event.Name)
+
+		case file := <-settled:
+			delete(timers, file)
+			if !fileExists(file) {
+				delete(sizes, file)
+				continue
+			}
+			if fileSize(file) != sizes[file] {
+				arm(file)
+				continue
+			}
+			delete(sizes, file)
+			status.runQueued()
+			queue <- file
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return fmt.Errorf("watcher closed")
+			}
+			log.Printf("Failed to watch '%s': %v", config.WatchDir, err)
+		}
+	}
+}
+
+// watchedFileConfig returns the configuration processing file: snapshots are
+// taken from it, and the local and remote outputs go to subdirectories named
+// after it, so that files do not overwrite each other's outputs.
+func watchedFileConfig(config Config, file string) Config {
+	name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+
+	variant := config
+	variant.WatchDir = ""
+	variant.SourceVideo = file
+	variant.Stats = &Stats{}
+	variant.OutputDir = filepath.Join(config.OutputDir, name)
+	if config.RemoteDirTemplate != "" {
+		variant.RemoteDirTemplate = filepath.Join(config.RemoteDirTemplate, name)
+	}
+	variant.SnapshotOutputDir = filepath.Join(config.SnapshotOutputDir, name)
+	variant.CsvOutputFile = filepath.Join(filepath.Dir(config.CsvOutputFile), name, filepath.Base(config.CsvOutputFile))
+	if config.ContactSheetPath != "" {
+		variant.ContactSheetPath = filepath.Join(filepath.Dir(config.ContactSheetPath), name, filepath.Base(config.ContactSheetPath))
+	}
+	return variant
+}
+
+// fileSize returns the size of file, or -1 when it cannot be read.
+func fileSize(file string) int64 {
+	info, err := os.Stat(file)
+	if err != nil {
+		return -1
+	}
+	return info.Size()
+}